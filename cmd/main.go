@@ -1,12 +1,43 @@
 package main
 
 import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	fairplex "github.com/eu90h/fairplex/pkg"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulate(os.Args[2:])
+		return
+	}
+
+	config := flag.String("config", "", "path to a JSON config file, reloaded on SIGHUP")
+	flag.Parse()
+
 	fp := fairplex.Fairplex{}
 	fp.RequestsPerMinute = 100
-	engine := fp.SetupRouter()
-	engine.Run("0.0.0.0:8118")
-}
\ No newline at end of file
+	fp.ConfigFile = *config
+	// e.g. FAIRPLEX_SERVERS=http://a:8080,http://b:8080
+	fp.Servers = fairplex.ParseServerList(os.Getenv("FAIRPLEX_SERVERS"))
+
+	// Let in-flight requests finish on ^C or SIGTERM.
+	shutdown := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		shutdown <- fp.Shutdown()
+	}()
+
+	if err := fp.Run("0.0.0.0:8118"); err != nil {
+		log.Fatal(err)
+	}
+	if err := <-shutdown; err != nil {
+		log.Fatal(err)
+	}
+}
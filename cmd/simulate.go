@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	fairplex "github.com/eu90h/fairplex/pkg"
+)
+
+// simulate runs `fairplex simulate`, printing how the keys read from stdin
+// (or -keys) would be spread over the servers, without starting fairplex.
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	servers := flags.String("servers", os.Getenv("FAIRPLEX_SERVERS"), "comma separated primary servers, e.g. http://a:8080,http://b:8080")
+	standby := flags.String("standby", "", "comma separated standby servers")
+	weights := flags.String("weights", "", "comma separated server weights, e.g. http://a:8080=2")
+	virtual_nodes := flags.Int("virtual-nodes", 0, "virtual nodes per server (default 4)")
+	salt := flags.String("salt", "", "the HashSalt to hash with")
+	keys := flags.String("keys", "", "file of keys, one per line, instead of stdin")
+	flags.Parse(args)
+
+	fp := fairplex.Fairplex{LogLevel: "error"}
+	fp.Servers = fairplex.ParseServerList(*servers)
+	fp.StandbyServers = fairplex.ParseServerList(*standby)
+	fp.VirtualNodes = *virtual_nodes
+	fp.HashSalt = *salt
+	server_weights, err := parseWeights(*weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var in io.Reader = os.Stdin
+	if *keys != "" {
+		f, err := os.Open(*keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	counts, err := fp.Simulate(in, server_weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var addrs []string
+	total := 0
+	for _, pool := range [][]*url.URL{fp.Servers, fp.StandbyServers} {
+		for _, u := range pool {
+			addrs = append(addrs, u.String())
+			total += counts[u.String()]
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "server\tkeys\tshare\t")
+	for _, addr := range addrs {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(counts[addr]) / float64(total)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%.2f%%\t\n", addr, counts[addr], share)
+	}
+	fmt.Fprintf(w, "total\t%v\t\t\n", total)
+	w.Flush()
+}
+
+// parseWeights parses a list such as "http://a:8080=2,http://b:8080=0.5"
+// into weights by server URL.
+func parseWeights(list string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("weight %q must look like http://a:8080=2", entry)
+		}
+		weight, err := strconv.ParseFloat(entry[i+1:], 64)
+		if err != nil || !(weight > 0) {
+			return nil, fmt.Errorf("weight of %v must be a positive number", entry[:i])
+		}
+		servers := fairplex.ParseServerList(entry[:i])
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("invalid server %q", entry[:i])
+		}
+		weights[servers[0].String()] = weight
+	}
+	return weights, nil
+}
@@ -4,19 +4,20 @@ go 1.21.3
 
 require (
 	github.com/didip/tollbooth v4.0.2+incompatible
-	github.com/emirpasic/gods v1.18.1
 	github.com/gin-gonic/gin v1.9.1
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	golang.org/x/sync v0.7.0
 )
 
 require (
 	github.com/patrickmn/go-cache v2.1.0+incompatible // indirect
-	golang.org/x/time v0.5.0 // indirect
+	golang.org/x/time v0.5.0
 )
 
 require (
 	github.com/bytedance/sonic v1.9.1 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
-	github.com/didip/tollbooth_gin v0.0.0-20170928041415-5752492be505
 	github.com/gabriel-vasile/mimetype v1.4.2 // indirect
 	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.14.1 // indirect
@@ -0,0 +1,330 @@
+package fairplex
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// backend is a registered server along with its per-server settings and state.
+type backend struct {
+	url *url.URL;
+	// Static headers added to every request forwarded to this server, e.g.
+	// an Authorization header with a service token. These may be secrets,
+	// so they're never logged or returned by the API. PUT /servers replaces
+	// the map rather than changing it, under Fairplex.mu.
+	headers http.Header;
+	// Whether the server belongs to the standby pool rather than the primary.
+	standby bool;
+	// HTTP methods this server accepts, e.g. GET and HEAD for a read
+	// replica. Empty means every method.
+	methods []string;
+	// Name the server was registered under, if any. Registering another URL
+	// under the same name replaces this server, e.g. after it moved to a new
+	// IP.
+	name string;
+	// Free-form labels given at registration, e.g. "canary", for filtering
+	// GET /servers. Guarded by Fairplex.mu.
+	tags []string;
+	// Scales the server's share of virtual nodes, e.g. 2 for a server twice
+	// the size of the others. Zero means 1. Guarded by Fairplex.mu.
+	weight float64;
+	// The zone the server is in, see Fairplex.Zone. Empty if not given.
+	zone string;
+	// Number of virtual nodes the server currently has in its ring.
+	// Guarded by Fairplex.mu, like the ring itself.
+	nodes int;
+	// Bumped whenever a warm-up starts or is cut short, so an older warm-up
+	// knows to stop. Guarded by Fairplex.mu.
+	warmUps int;
+	// Set while the server is out of its ring for a maintenance window,
+	// keeping rebuilds and warm-ups from putting it back early. Guarded by
+	// Fairplex.mu.
+	maintenance bool;
+	// Caps the requests per second sent to this server, regardless of how
+	// many clients they come from. Nil means no cap.
+	limiter *rate.Limiter;
+	// Measures the requests per second actually sent to this server.
+	meter rateMeter;
+	// Number of requests routed to this server, and when the last one was
+	// as Unix nanoseconds (zero if none yet). Kept across ring rebuilds.
+	requests atomic.Uint64;
+	lastRouted atomic.Int64;
+	// Number of requests currently being proxied to this server.
+	inFlight atomic.Int64;
+	// The transport requests are proxied to this server with. Each server has
+	// its own, so its idle connections can be closed when it leaves.
+	transport *http.Transport;
+	// Cleared by the health checker while the server fails its probes.
+	healthy atomic.Bool;
+	// Consecutive failed probes, written under Fairplex.probing.
+	failedProbes atomic.Int64;
+	// When a server that is down is next probed. Guarded by Fairplex.probing.
+	nextProbe time.Time;
+	// Moving average of how long the server takes to answer proxied
+	// requests, up to its response headers.
+	latency ewma;
+	// Until when, as Unix nanoseconds, the server is left out of selection
+	// because it answered 503 with a Retry-After.
+	coolingUntil atomic.Int64;
+}
+
+// The longest pause a server can ask for with Retry-After, so a bad header
+// can't take it out of the ring for good.
+const maxRetryAfter = 5 * time.Minute
+
+// coolDown leaves the server out of selection for as long as `resp` asks, if
+// it's a 503 with a Retry-After header.
+func (b *backend) coolDown(resp *http.Response, now time.Time) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return
+	}
+	var wait time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		wait = t.Sub(now)
+	} else {
+		return
+	}
+	if wait <= 0 {
+		return
+	}
+	wait = min(wait, maxRetryAfter)
+	infof("server %v asked for a %v pause\n", b.url.String(), wait)
+	b.coolingUntil.Store(now.Add(wait).UnixNano())
+}
+
+// cooling reports whether the server asked not to get requests at `now`.
+func (b *backend) cooling(now time.Time) bool {
+	return now.UnixNano() < b.coolingUntil.Load()
+}
+
+func newBackend(u *url.URL, standby bool) *backend {
+	b := &backend{url: u, standby: standby}
+	b.healthy.Store(true)
+	return b
+}
+
+// routed records that a request was sent to `b` at `now`.
+func (b *backend) routed(now time.Time) {
+	b.meter.mark(now)
+	b.requests.Add(1)
+	b.lastRouted.Store(now.UnixNano())
+}
+
+// checkServerURL returns why `u` can't be used as a server address, or nil if it can.
+func checkServerURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tcp" {
+		return fmt.Errorf("scheme must be http, https or tcp")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if u.Scheme == "tcp" && u.Port() == "" {
+		return fmt.Errorf("tcp servers need a port")
+	}
+	return nil
+}
+
+// parseServerURL parses the server address `addr` and checks it's usable.
+// IPv6 literals must be bracketed, as in "http://[::1]:8080", and are
+// rewritten in their canonical form, so that a server is known by the same
+// URL however its address was written.
+func parseServerURL(addr string) (*url.URL, error) {
+	// url.Parse rejects some unbracketed IPv6 literals, but takes others,
+	// e.g. "::1:8080", for a host and port, so check for them either way.
+	_, host, _ := strings.Cut(addr, "://")
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	host = host[strings.LastIndex(host, "@")+1:]
+	unbracketed := strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[")
+	u, err := url.Parse(addr)
+	if err != nil {
+		if unbracketed {
+			return nil, fmt.Errorf("%w; IPv6 addresses must be in brackets, as in http://[::1]:8080", err)
+		}
+		return nil, err
+	}
+	if unbracketed {
+		return nil, fmt.Errorf("IPv6 addresses must be in brackets, as in http://[::1]:8080")
+	}
+	if err := checkServerURL(u); err != nil {
+		return nil, err
+	}
+	normalizeURL(u)
+	return u, nil
+}
+
+// normalizeURL rewrites `u` so every way of writing the same server gives
+// the same String, which is the server's identity and what its virtual
+// nodes are hashed from: the host in lower case (IPv6 literals in
+// their canonical form, e.g. [0:0::1] as [::1]), without the scheme's
+// default port, and with no path rather than a lone "/".
+func normalizeURL(u *url.URL) {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if ip, err := netip.ParseAddr(host); err == nil && ip.Is6() {
+		host = ip.String()
+	}
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	if u.Path == "/" && u.RawPath == "" {
+		u.Path = ""
+	}
+}
+
+// ParseServerList parses a comma separated list of server URLs, such as the
+// FAIRPLEX_SERVERS environment variable, for seeding Fairplex.Servers.
+// Invalid entries are logged and skipped.
+func ParseServerList(list string) []*url.URL {
+	var servers []*url.URL
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		u, err := parseServerURL(addr)
+		if err != nil {
+			errorf("skipping invalid server %q: %v\n", addr, err)
+			continue
+		}
+		servers = append(servers, u)
+	}
+	return servers
+}
+
+// target returns the URL of `path` on the server. When `raw` is set, `path`
+// is taken to be percent-encoded already and is kept exactly as is;
+// otherwise it's a decoded path and gets encoded.
+func (b *backend) target(path string, raw bool) *url.URL {
+	if !raw {
+		path = (&url.URL{Path: path}).EscapedPath()
+	}
+	target := b.url.JoinPath(path)
+	if !strings.HasPrefix(target.Path, "/") {
+		// JoinPath leaves the path relative when the server URL has none.
+		target.Path = "/" + target.Path
+		if target.RawPath != "" {
+			target.RawPath = "/" + target.RawPath
+		}
+	}
+	return target
+}
+
+// setRate caps the requests sent to the server at `per_second`.
+func (b *backend) setRate(per_second float64) {
+	burst := int(per_second)
+	if burst < 1 {
+		burst = 1
+	}
+	b.limiter = rate.NewLimiter(rate.Limit(per_second), burst)
+}
+
+// allowRequest takes a token from the server's bucket, reporting whether it
+// may be sent another request right now.
+func (b *backend) allowRequest() bool {
+	return b.limiter == nil || b.limiter.Allow()
+}
+
+// allows reports whether the server accepts requests with `method`. tcp
+// servers, for RunTCP, accept no HTTP requests at all.
+func (b *backend) allows(method string) bool {
+	if isTCP(b) {
+		return false
+	}
+	if len(b.methods) == 0 {
+		return true
+	}
+	for _, m := range b.methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether `b` passes the GET /servers filters in `query`:
+// "tag" (which may be repeated, each must match) and "healthy" ("true" or
+// "false"). Any other value of "healthy" matches nothing.
+func (b *backend) matches(query url.Values) bool {
+	for _, tag := range query["tag"] {
+		if !slices.Contains(b.tags, tag) {
+			return false
+		}
+	}
+	if healthy, ok := query["healthy"]; ok {
+		want, err := strconv.ParseBool(healthy[0])
+		if err != nil || want != b.healthy.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// parseList parses a comma separated list such as "a, b", dropping empty entries.
+func parseList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseMethods parses a comma separated list of HTTP methods such as "GET,HEAD".
+func parseMethods(list string) []string {
+	methods := parseList(list)
+	for i, m := range methods {
+		methods[i] = strings.ToUpper(m)
+	}
+	return methods
+}
+
+// parseWeight parses a server's weight, a positive number.
+func parseWeight(s string) (float64, error) {
+	weight, err := strconv.ParseFloat(s, 64)
+	if err != nil || !(weight > 0) || math.IsInf(weight, 1) {
+		return 0, fmt.Errorf("weight must be a positive number")
+	}
+	return weight, nil
+}
+
+// parseHeaders parses registration headers given as "Name: value" strings.
+func parseHeaders(lines []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			// Don't echo the line back, it may hold a credential.
+			return nil, fmt.Errorf("invalid header, expected \"Name: value\"")
+		}
+		headers.Add(textproto.CanonicalMIMEHeaderKey(name), strings.TrimSpace(value))
+	}
+	return headers, nil
+}
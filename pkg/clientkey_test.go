@@ -0,0 +1,31 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHashKeyIgnoresClientPort(t *testing.T) {
+	fairplex := &Fairplex{}
+	tests := []struct {
+		a string;
+		b string;
+		same bool;
+	}{
+		{a: "192.0.2.1:54321", b: "192.0.2.1:40000", same: true},
+		{a: "[2001:db8::1]:54321", b: "[2001:db8::1]:40000", same: true},
+		{a: "192.0.2.1", b: "192.0.2.1:40000", same: true},
+		{a: "192.0.2.1:54321", b: "192.0.2.2:54321", same: false},
+	}
+	for _, tt := range tests {
+		key := func(remote_addr string) string {
+			req := httptest.NewRequest(http.MethodGet, "/users", nil)
+			req.RemoteAddr = remote_addr
+			return fairplex.hashKey(req, "users")
+		}
+		if same := key(tt.a) == key(tt.b); same != tt.same {
+			t.Errorf("keys for %v and %v: same is %v, want %v (%q, %q)", tt.a, tt.b, same, tt.same, key(tt.a), key(tt.b))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package fairplex
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// canCoalesce reports whether a request with `method` may share the
+// response of an identical one, see Coalesce.
+func canCoalesce(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// sharedResponse is a response recorded once to be written to every
+// request coalesced with the one it came from.
+type sharedResponse struct {
+	status int;
+	header http.Header;
+	body []byte;
+}
+
+// coalesce runs `proxy` for the request unless an identical one, with the
+// same method and URL, is already being proxied, in which case it waits for
+// that one's response instead. Either way the response is written from a
+// recording, so every request gets the same one.
+func (fairplex *Fairplex) coalesce(c *gin.Context, proxy func()) {
+	key := c.Request.Method + " " + c.Request.URL.RequestURI()
+	v, _, shared := fairplex.flights.Do(key, func() (any, error) {
+		rec := &responseRecorder{ResponseWriter: c.Writer, header: http.Header{}, status: http.StatusOK}
+		writer, req := c.Writer, c.Request
+		// The others waiting on the response shouldn't lose it just because
+		// this client gave up, but any RequestTimeout still holds.
+		ctx := context.WithoutCancel(req.Context())
+		if deadline, ok := req.Context().Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		c.Writer, c.Request = rec, req.WithContext(ctx)
+		defer func() { c.Writer, c.Request = writer, req }()
+		proxy()
+		return &sharedResponse{rec.status, rec.header, rec.body.Bytes()}, nil
+	})
+	if shared {
+		debugf("coalesced %v\n", key)
+	}
+
+	resp := v.(*sharedResponse)
+	header := c.Writer.Header()
+	for name, values := range resp.header {
+		header[name] = append([]string(nil), values...)
+	}
+	c.Status(resp.status)
+	c.Writer.Write(resp.body)
+}
+
+// responseRecorder is a gin.ResponseWriter keeping the response in memory.
+// Connection level methods, such as Hijack, go to the writer it replaces.
+type responseRecorder struct {
+	gin.ResponseWriter;
+	header http.Header;
+	status int;
+	body bytes.Buffer;
+	written bool;
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.written {
+		r.status = status
+		r.written = true
+	}
+}
+
+func (r *responseRecorder) WriteHeaderNow() {
+	r.written = true
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.written = true
+	return r.body.Write(p)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.written = true
+	return r.body.WriteString(s)
+}
+
+func (r *responseRecorder) Status() int {
+	return r.status
+}
+
+func (r *responseRecorder) Size() int {
+	if !r.written {
+		return -1
+	}
+	return r.body.Len()
+}
+
+func (r *responseRecorder) Written() bool {
+	return r.written
+}
+
+// Flush does nothing, the response is only written once it's complete.
+func (r *responseRecorder) Flush() {}
+
+// CloseNotify never fires, as the response may be going to other clients.
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
@@ -0,0 +1,66 @@
+package fairplex
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name string;
+		coalesce bool;
+		method string;
+		paths int;
+		reached int64;
+	}{
+		{name: "identical reads coalesced", coalesce: true, method: http.MethodGet, paths: 1, reached: 1},
+		{name: "different paths", coalesce: true, method: http.MethodGet, paths: 3, reached: 3},
+		{name: "writes not coalesced", coalesce: true, method: http.MethodPost, paths: 1, reached: 10},
+		{name: "off", coalesce: false, method: http.MethodGet, paths: 1, reached: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached atomic.Int64
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached.Add(1)
+				<-release
+				fmt.Fprint(w, r.URL.Path)
+			}))
+			t.Cleanup(srv.Close)
+			fairplex := &Fairplex{Proxy: true, Coalesce: tt.coalesce}
+			proxy := startProxy(t, fairplex)
+			register(t, fairplex, srv.URL)
+
+			const clients = 10
+			var wg sync.WaitGroup
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					path := fmt.Sprintf("/item%d", i%tt.paths)
+					code, body := send(t, tt.method, proxy.URL+path, nil)
+					if code != http.StatusOK || body != path {
+						t.Errorf("client %d got %d %q, want 200 %v", i, code, body, path)
+					}
+				}(i)
+			}
+			// Give every client time to be waiting on the server.
+			deadline := time.Now().Add(2 * time.Second)
+			for reached.Load() < tt.reached && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+			if got := reached.Load(); got != tt.reached {
+				t.Errorf("%d requests reached the server, want %d", got, tt.reached)
+			}
+		})
+	}
+}
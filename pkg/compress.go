@@ -0,0 +1,139 @@
+package fairplex
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses known to be smaller than this aren't worth compressing.
+const minCompressSize = 256
+
+// acceptsGzip reports whether the Accept-Encoding header `accept` allows a
+// gzip encoded response.
+func acceptsGzip(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if v, ok := strings.CutPrefix(q, "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressible reports whether a response of media type `content_type` is
+// likely to shrink when gzipped. Images, video, archives and the like are
+// compressed already.
+func compressible(content_type string) bool {
+	t, _, err := mime.ParseMediaType(content_type)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(t, "text/") || strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml") {
+		return true
+	}
+	switch t {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// decompressResponse gunzips `resp` on its way to a client whose
+// Accept-Encoding doesn't allow gzip, for servers that send it anyway.
+// (Clients sending no Accept-Encoding at all are already taken care of by
+// the transport, which asks for gzip on their behalf and decompresses it.)
+func decompressResponse(resp *http.Response, req *http.Request) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		return
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	if req.Method == http.MethodHead {
+		return
+	}
+	resp.Body = &gunzipBody{body: resp.Body}
+}
+
+// gunzipBody decompresses a gzipped response body, starting on the first
+// read, so a body that isn't valid gzip fails the copy to the client rather
+// than the response as a whole.
+type gunzipBody struct {
+	body io.ReadCloser;
+	gz *gzip.Reader;
+}
+
+func (g *gunzipBody) Read(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.body)
+		if err != nil {
+			return 0, err
+		}
+		g.gz = gz
+	}
+	return g.gz.Read(p)
+}
+
+func (g *gunzipBody) Close() error {
+	return g.body.Close()
+}
+
+// compressResponse gzips `resp` on its way to the client if the client
+// accepts gzip and the server sent it uncompressed. Responses the server
+// has already encoded are passed through untouched.
+func compressResponse(resp *http.Response, req *http.Request) {
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return
+	}
+	if resp.Header.Get("Content-Encoding") != "" || !acceptsGzip(req.Header.Get("Accept-Encoding")) {
+		return
+	}
+	// gzip would hold events back until it had a block's worth.
+	if isStream(resp) {
+		return
+	}
+	if !compressible(resp.Header.Get("Content-Type")) || (resp.ContentLength >= 0 && resp.ContentLength < minCompressSize) {
+		return
+	}
+
+	body := resp.Body
+	r, w := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(w)
+		_, err := io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		body.Close()
+		w.CloseWithError(err)
+	}()
+	resp.Body = r
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	// The bytes differ from the server's now, so a strong ETag no longer holds.
+	if etag := resp.Header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
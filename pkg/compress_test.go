@@ -0,0 +1,138 @@
+package fairplex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := strings.Repeat("fairplex ", 100)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	io.WriteString(gz, text)
+	gz.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/text":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, text)
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "fairplex")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, text)
+		case "/gzipped":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		}
+	}))
+	t.Cleanup(srv.Close)
+	fairplex := &Fairplex{Proxy: true, Compress: true}
+	proxy := startProxy(t, fairplex)
+	register(t, fairplex, srv.URL)
+
+	// Compression is left to the test, so responses arrive as relayed.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	tests := []struct {
+		path string;
+		accept string;
+		encoding string;
+		body []byte;
+	}{
+		{path: "/text", accept: "gzip", encoding: "gzip", body: []byte(text)},
+		{path: "/text", accept: "gzip;q=0", encoding: "", body: []byte(text)},
+		{path: "/text", accept: "", encoding: "", body: []byte(text)},
+		{path: "/small", accept: "gzip", encoding: "", body: []byte("fairplex")},
+		{path: "/image", accept: "gzip", encoding: "", body: []byte(text)},
+		// Passed through as is, not compressed twice.
+		{path: "/gzipped", accept: "gzip", encoding: "gzip", body: gzipped.Bytes()},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept-Encoding", tt.accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		encoding := resp.Header.Get("Content-Encoding")
+		if encoding != tt.encoding {
+			t.Errorf("%v with Accept-Encoding %q: Content-Encoding is %q, want %q", tt.path, tt.accept, encoding, tt.encoding)
+			continue
+		}
+		if tt.path == "/text" && encoding == "gzip" {
+			r, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("%v: %v", tt.path, err)
+			}
+			body, _ = io.ReadAll(r)
+		}
+		if !bytes.Equal(body, tt.body) {
+			t.Errorf("%v with Accept-Encoding %q: body differs", tt.path, tt.accept)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	text := strings.Repeat("fairplex ", 100)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	io.WriteString(gz, text)
+	gz.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Gzipped whatever the client asked for.
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(gzipped.Len()))
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(gzipped.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	tests := []struct {
+		decompress bool;
+		accept string;
+		encoding string;
+		body []byte;
+		etag string;
+	}{
+		{decompress: true, accept: "identity", encoding: "", body: []byte(text), etag: `W/"v1"`},
+		{decompress: true, accept: "gzip", encoding: "gzip", body: gzipped.Bytes(), etag: `"v1"`},
+		{decompress: false, accept: "identity", encoding: "gzip", body: gzipped.Bytes(), etag: `"v1"`},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: true, Decompress: tt.decompress}
+		proxy := startProxy(t, fairplex)
+		register(t, fairplex, srv.URL)
+
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/doc", nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Content-Encoding") != tt.encoding || !bytes.Equal(body, tt.body) || resp.Header.Get("ETag") != tt.etag {
+			t.Errorf("decompress %v, Accept-Encoding %q: got encoding %q, etag %v, %d bytes; want %q, %v, %d bytes",
+				tt.decompress, tt.accept, resp.Header.Get("Content-Encoding"), resp.Header.Get("ETag"), len(body), tt.encoding, tt.etag, len(tt.body))
+		}
+		if tt.encoding == "" && resp.ContentLength != -1 && resp.ContentLength != int64(len(text)) {
+			t.Errorf("decompress %v: Content-Length is %d for a %d byte body", tt.decompress, resp.ContentLength, len(text))
+		}
+	}
+}
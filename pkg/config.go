@@ -0,0 +1,283 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// duration is a time.Duration written in config files as a string such as "10s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"10s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// Config is the on-disk (JSON) form of fairplex's settings. Zero-valued
+// fields are treated as unset and leave the current setting alone.
+type Config struct {
+	// Address to listen on. Changing it requires a restart.
+	Addr string `json:"addr"`;
+	// Number of requests a user can make per minute.
+	RequestsPerMinute float64 `json:"requests_per_minute"`;
+	// Request header selecting the client class for rate limiting.
+	ClassHeader string `json:"class_header"`;
+	// Requests per minute for each client class.
+	ClassRequestsPerMinute map[string]float64 `json:"class_requests_per_minute"`;
+	// Requests per minute for each HTTP method.
+	MethodRequestsPerMinute map[string]float64 `json:"method_requests_per_minute"`;
+	// Number of virtual nodes each server gets in the ring.
+	VirtualNodes int `json:"virtual_nodes"`;
+	// How often servers are health checked, e.g. "10s".
+	HealthCheckInterval duration `json:"health_check_interval"`;
+	// One of "debug", "info" or "error".
+	LogLevel string `json:"log_level"`;
+	// "all" or "errors".
+	AccessLog string `json:"access_log"`;
+	// Between 0 and 1.
+	AccessLogSampleRate float64 `json:"access_log_sample_rate"`;
+}
+
+// LoadConfig reads and parses the JSON config file at `path`.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %v: %w", path, err)
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %v: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// checkConfig runs Validate on the current settings with the set fields of
+// `cfg` in place, so a config that would leave fairplex with unusable
+// settings is turned down before anything is changed.
+func (fairplex *Fairplex) checkConfig(cfg *Config) error {
+	fairplex.mu.Lock()
+	candidate := &Fairplex{
+		RequestsPerMinute: fairplex.RequestsPerMinute,
+		ClassRequestsPerMinute: fairplex.ClassRequestsPerMinute,
+		MethodRequestsPerMinute: fairplex.MethodRequestsPerMinute,
+		VirtualNodes: fairplex.VirtualNodes,
+		HealthCheckInterval: fairplex.HealthCheckInterval,
+		LogLevel: fairplex.LogLevel,
+		AccessLog: fairplex.AccessLog,
+		AccessLogSampleRate: fairplex.AccessLogSampleRate,
+	}
+	fairplex.mu.Unlock()
+
+	if cfg.RequestsPerMinute != 0 {
+		candidate.RequestsPerMinute = cfg.RequestsPerMinute
+	}
+	if cfg.ClassRequestsPerMinute != nil {
+		candidate.ClassRequestsPerMinute = cfg.ClassRequestsPerMinute
+	}
+	if cfg.MethodRequestsPerMinute != nil {
+		candidate.MethodRequestsPerMinute = cfg.MethodRequestsPerMinute
+	}
+	if cfg.VirtualNodes != 0 {
+		candidate.VirtualNodes = cfg.VirtualNodes
+	}
+	if cfg.HealthCheckInterval != 0 {
+		candidate.HealthCheckInterval = time.Duration(cfg.HealthCheckInterval)
+	}
+	if cfg.LogLevel != "" {
+		candidate.LogLevel = cfg.LogLevel
+	}
+	if cfg.AccessLog != "" {
+		candidate.AccessLog = cfg.AccessLog
+	}
+	if cfg.AccessLogSampleRate != 0 {
+		candidate.AccessLogSampleRate = cfg.AccessLogSampleRate
+	}
+	return candidate.Validate()
+}
+
+// applyConfig copies the set fields of `cfg` onto fairplex. It is used both
+// at startup and on reload, so everything done here must be safe to do
+// while requests are being served. If the result wouldn't pass Validate,
+// nothing is changed and the problems are returned.
+func (fairplex *Fairplex) applyConfig(cfg *Config) error {
+	if err := fairplex.checkConfig(cfg); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	if cfg.Addr != "" && fairplex.addr != "" && cfg.Addr != fairplex.addr {
+		infof("config addr changed from %v to %v, a restart is required to apply it\n", fairplex.addr, cfg.Addr)
+	}
+
+	if cfg.LogLevel != "" && cfg.LogLevel != fairplex.LogLevel {
+		fairplex.LogLevel = cfg.LogLevel
+		setLogLevel(cfg.LogLevel)
+	}
+	if cfg.AccessLog != "" && cfg.AccessLog != fairplex.AccessLog {
+		fairplex.AccessLog = cfg.AccessLog
+		setAccessLog(cfg.AccessLog)
+	}
+	if cfg.AccessLogSampleRate != 0 && cfg.AccessLogSampleRate != fairplex.AccessLogSampleRate {
+		fairplex.AccessLogSampleRate = cfg.AccessLogSampleRate
+		setAccessLogSampleRate(cfg.AccessLogSampleRate)
+	}
+
+	if cfg.RequestsPerMinute != 0 {
+		fairplex.mu.Lock()
+		if cfg.RequestsPerMinute != fairplex.RequestsPerMinute {
+			fairplex.RequestsPerMinute = cfg.RequestsPerMinute
+			if fairplex.limiter != nil {
+				setLimit(fairplex.limiter, fairplex.RequestsPerMinute)
+			}
+		}
+		fairplex.mu.Unlock()
+	}
+
+	if cfg.ClassHeader != "" || cfg.ClassRequestsPerMinute != nil {
+		fairplex.mu.Lock()
+		if cfg.ClassHeader != "" {
+			fairplex.ClassHeader = cfg.ClassHeader
+		}
+		if cfg.ClassRequestsPerMinute != nil {
+			fairplex.setClassLimits(cfg.ClassRequestsPerMinute)
+		}
+		fairplex.mu.Unlock()
+	}
+
+	if cfg.MethodRequestsPerMinute != nil {
+		fairplex.mu.Lock()
+		fairplex.setMethodLimits(cfg.MethodRequestsPerMinute)
+		fairplex.mu.Unlock()
+	}
+
+	if cfg.HealthCheckInterval != 0 {
+		fairplex.mu.Lock()
+		fairplex.HealthCheckInterval = time.Duration(cfg.HealthCheckInterval)
+		running := fairplex.ring != nil
+		fairplex.mu.Unlock()
+		if running {
+			// In case health checks were disabled until now.
+			fairplex.startHealthChecks()
+		}
+	}
+
+	if cfg.VirtualNodes != 0 {
+		fairplex.mu.Lock()
+		changed := cfg.VirtualNodes != fairplex.VirtualNodes
+		fairplex.VirtualNodes = checkVirtualNodes(cfg.VirtualNodes)
+		running := fairplex.ring != nil
+		fairplex.mu.Unlock()
+		if changed && running {
+			fairplex.rebuildRing()
+		}
+	}
+	return nil
+}
+
+// Reload re-reads ConfigFile and applies the settings that can change while
+// serving: rate limits (default, class and method), health-check interval,
+// log level and virtual node count (which rebuilds the ring). Settings that
+// need a new listener are logged and left alone. A config that doesn't pass
+// Validate is rejected as a whole.
+func (fairplex *Fairplex) Reload() error {
+	if fairplex.ConfigFile == "" {
+		return fmt.Errorf("no config file set")
+	}
+	cfg, err := LoadConfig(fairplex.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if err := fairplex.applyConfig(cfg); err != nil {
+		return err
+	}
+	infof("reloaded config from %v\n", fairplex.ConfigFile)
+	return nil
+}
+
+// redacted stands in for secrets in GET /config: "[redacted]" if `secret`
+// is set, so it's clear whether it is, and "" otherwise.
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// configHandler serves GET /config, the settings currently in effect, with
+// defaults filled in and secrets redacted.
+func (fairplex *Fairplex) configHandler(c *gin.Context) {
+	fairplex.mu.Lock()
+	health_check_method := fairplex.HealthCheckMethod
+	if health_check_method == "" {
+		health_check_method = http.MethodGet
+	}
+	health_check_max_backoff := fairplex.HealthCheckMaxBackoff
+	if health_check_max_backoff <= 0 {
+		health_check_max_backoff = defaultHealthCheckMaxBackoff
+	}
+	log_level := fairplex.LogLevel
+	if log_level == "" {
+		log_level = "info"
+	}
+	access_log := fairplex.AccessLog
+	if access_log == "" {
+		access_log = "all"
+	}
+	config := gin.H{
+		"addr": fairplex.addr,
+		"proxy": fairplex.Proxy,
+		"preserve_host": fairplex.PreserveHost,
+		"dry_run": fairplex.DryRun,
+		"strategy": fairplex.Strategy.String(),
+		"zone": fairplex.Zone,
+		"virtual_nodes": fairplex.virtualNodes(),
+		"replication_factor": fairplex.ReplicationFactor,
+		"read_fan_out": fairplex.ReadFanOut,
+		"hash_query": fairplex.HashQuery,
+		"key_headers": fairplex.KeyHeaders,
+		"key_header_fallback": fairplex.KeyHeaderFallback.String(),
+		"hash_salt": redacted(fairplex.HashSalt),
+		"requests_per_minute": fairplex.RequestsPerMinute,
+		"class_header": fairplex.ClassHeader,
+		"class_requests_per_minute": maps.Clone(fairplex.ClassRequestsPerMinute),
+		"method_requests_per_minute": maps.Clone(fairplex.MethodRequestsPerMinute),
+		"max_failover_attempts": fairplex.maxFailoverAttempts(),
+		"non_idempotent_retry": fairplex.NonIdempotentRetry.String(),
+		"failover_hysteresis": fairplex.failoverHysteresis(),
+		"health_check_interval": fairplex.HealthCheckInterval.String(),
+		"health_check_max_backoff": health_check_max_backoff.String(),
+		"health_check_method": health_check_method,
+		"health_check_expect_body": fairplex.HealthCheckExpectBody,
+		"slow_start_duration": fairplex.SlowStartDuration.String(),
+		"prewarm_on_add": fairplex.PrewarmOnAdd,
+		"dial_timeout": fairplex.DialTimeout.String(),
+		"request_timeout": fairplex.RequestTimeout.String(),
+		"read_timeout": orDefault(fairplex.ReadTimeout, defaultReadTimeout).String(),
+		"write_timeout": orDefault(fairplex.WriteTimeout, defaultWriteTimeout).String(),
+		"idle_timeout": orDefault(fairplex.IdleTimeout, defaultIdleTimeout).String(),
+		"stream_timeout": fairplex.StreamTimeout.String(),
+		"stream_keep_alive": fairplex.StreamKeepAlive.String(),
+		"shutdown_grace_period": orDefault(fairplex.ShutdownGracePeriod, defaultShutdownGracePeriod).String(),
+		"max_response_bytes": fairplex.MaxResponseBytes,
+		"max_buffered_body_bytes": fairplex.maxBufferedBodyBytes(),
+		"server_list_token": redacted(fairplex.ServerListToken),
+		"control_plane_token": redacted(fairplex.ControlPlaneToken),
+		"log_level": log_level,
+		"access_log": access_log,
+		"access_log_sample_rate": fairplex.AccessLogSampleRate,
+	}
+	fairplex.mu.Unlock()
+	c.JSON(http.StatusOK, config)
+}
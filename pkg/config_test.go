@@ -0,0 +1,128 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadValidates(t *testing.T) {
+	tests := []struct {
+		name string;
+		config string;
+		err string;
+		rpm float64;
+		interval time.Duration;
+	}{
+		{name: "valid", config: `{"requests_per_minute": 30, "health_check_interval": "5s"}`, rpm: 30, interval: 5 * time.Second},
+		{name: "negative interval", config: `{"requests_per_minute": 30, "health_check_interval": "-5s"}`, err: "HealthCheckInterval", rpm: 60},
+		{name: "negative rate", config: `{"requests_per_minute": -1}`, err: "RequestsPerMinute", rpm: 60},
+		{name: "negative class rate", config: `{"class_requests_per_minute": {"free": -1}}`, err: "ClassRequestsPerMinute", rpm: 60},
+		{name: "bad log level", config: `{"log_level": "loud"}`, err: "LogLevel", rpm: 60},
+		{name: "bad sample rate", config: `{"access_log_sample_rate": 2}`, err: "AccessLogSampleRate", rpm: 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fairplex.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			fairplex := &Fairplex{RequestsPerMinute: 60, ConfigFile: path}
+			fairplex.SetupRouter()
+			err := fairplex.Reload()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Reload: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Reload: got %v, want an error about %v", err, tt.err)
+			}
+			if fairplex.RequestsPerMinute != tt.rpm || fairplex.HealthCheckInterval != tt.interval {
+				t.Errorf("got %v rpm and interval %v, want %v and %v", fairplex.RequestsPerMinute, fairplex.HealthCheckInterval, tt.rpm, tt.interval)
+			}
+			fairplex.stopHealthChecks()
+		})
+	}
+}
+
+func TestApplyConfigVirtualNodes(t *testing.T) {
+	fairplex := &Fairplex{}
+	fairplex.SetupRouter()
+	register(t, fairplex, "http://127.0.0.1:1")
+	if err := fairplex.applyConfig(&Config{VirtualNodes: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fairplex.RingSnapshot()); n != 7 {
+		t.Errorf("ring has %d nodes after setting 7 virtual nodes", n)
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	fairplex := &Fairplex{
+		Proxy: true,
+		Strategy: StrategyP2C,
+		VirtualNodes: 42,
+		RequestsPerMinute: 120,
+		MaxFailoverAttempts: 5,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckMethod: http.MethodHead,
+		RequestTimeout: 3 * time.Second,
+		HashSalt: "pepper",
+		ServerListToken: "s3cret",
+	}
+	r := fairplex.SetupRouter()
+	t.Cleanup(fairplex.stopHealthChecks)
+
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/config", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	if w := get(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without the token: got %d, want 401", w.Code)
+	}
+	w := get("s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("with the token: got %d: %v", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "s3cret") || strings.Contains(w.Body.String(), "pepper") {
+		t.Errorf("secrets appear in %v", w.Body)
+	}
+	var config map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key string;
+		want any;
+	}{
+		{key: "proxy", want: true},
+		{key: "strategy", want: "p2c"},
+		{key: "virtual_nodes", want: 42.0},
+		{key: "requests_per_minute", want: 120.0},
+		{key: "max_failover_attempts", want: 5.0},
+		{key: "health_check_interval", want: "10s"},
+		{key: "health_check_method", want: "HEAD"},
+		{key: "request_timeout", want: "3s"},
+		{key: "hash_salt", want: "[redacted]"},
+		{key: "server_list_token", want: "[redacted]"},
+		{key: "control_plane_token", want: ""},
+		// Defaults are filled in.
+		{key: "health_check_max_backoff", want: "1m0s"},
+		{key: "shutdown_grace_period", want: "30s"},
+		{key: "log_level", want: "info"},
+	}
+	for _, tt := range tests {
+		if got := config[tt.key]; got != tt.want {
+			t.Errorf("%v is %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
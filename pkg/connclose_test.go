@@ -0,0 +1,95 @@
+package fairplex
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConnectionClose(t *testing.T) {
+	const requests = 3
+	tests := []struct {
+		name string;
+		client_closes bool;
+		backend_closes bool;
+		// Connections the backend is sent the requests over.
+		backend_conns int64;
+		// Requests the client sends over a connection it already had.
+		client_reused int;
+	}{
+		// The client's close is for its own connection, not the pool's.
+		{name: "client closes", client_closes: true, backend_conns: 1, client_reused: 0},
+		// The backend's close is for the pool's connection, not the client's.
+		{name: "backend closes", backend_closes: true, backend_conns: requests, client_reused: requests - 1},
+		{name: "neither closes", backend_conns: 1, client_reused: requests - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int64
+			var saw_close atomic.Bool
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Close || r.Header.Get("Connection") != "" {
+					saw_close.Store(true)
+				}
+				if tt.backend_closes {
+					w.Header().Set("Connection", "close")
+				}
+				io.WriteString(w, "ok")
+			}))
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			t.Cleanup(srv.Close)
+			fairplex := &Fairplex{Proxy: true}
+			proxy := startProxy(t, fairplex)
+			register(t, fairplex, srv.URL)
+
+			transport := &http.Transport{}
+			t.Cleanup(transport.CloseIdleConnections)
+			client := &http.Client{Transport: transport}
+			reused := 0
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+				if info.Reused {
+					reused++
+				}
+			}}
+			for i := 0; i < requests; i++ {
+				req, err := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Close = tt.client_closes
+				req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("request %d: got %d", i+1, resp.StatusCode)
+				}
+				if resp.Close != tt.client_closes {
+					t.Errorf("request %d: client told to close %v, want %v", i+1, resp.Close, tt.client_closes)
+				}
+			}
+
+			if saw_close.Load() {
+				t.Error("the client's Connection header reached the backend")
+			}
+			if got := conns.Load(); got != tt.backend_conns {
+				t.Errorf("backend got %d connections, want %d", got, tt.backend_conns)
+			}
+			if reused != tt.client_reused {
+				t.Errorf("client reused its connection %d times, want %d", reused, tt.client_reused)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDegradedRatio(t *testing.T) {
+	live := newTestBackend(t, "live")
+	standby := newTestBackend(t, "standby")
+	fallback := newTestBackend(t, "fallback")
+	fallback_url, _ := url.Parse(fallback.URL)
+	dead := deadAddr(t)
+
+	tests := []struct {
+		name string;
+		primaries []string;
+		standby bool;
+		fallback *url.URL;
+		// Requests hashed to each primary, by address.
+		requests map[string]int;
+		routed uint64;
+		degraded uint64;
+	}{
+		{name: "healthy", primaries: []string{live.URL}, requests: map[string]int{live.URL: 4}, routed: 4, degraded: 0},
+		{name: "failed over", primaries: []string{live.URL, dead}, requests: map[string]int{live.URL: 3, dead: 1}, routed: 4, degraded: 1},
+		{name: "standby", standby: true, requests: map[string]int{"": 4}, routed: 4, degraded: 4},
+		{name: "fallback", fallback: fallback_url, requests: map[string]int{"": 2}, routed: 2, degraded: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{Proxy: true, KeyHeaders: []string{"X-Key"}, VirtualNodes: 20, FallbackBackend: tt.fallback}
+			proxy := startProxy(t, fairplex)
+			primaries := map[string]*backend{}
+			for _, addr := range tt.primaries {
+				primaries[addr] = register(t, fairplex, addr)
+			}
+			if tt.standby {
+				u, _ := parseServerURL(standby.URL)
+				fairplex.addServer(newBackend(u, true))
+			}
+
+			for addr, n := range tt.requests {
+				key := "any"
+				if b := primaries[addr]; b != nil {
+					key = keyFor(t, fairplex, b)
+				}
+				for i := 0; i < n; i++ {
+					req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+					req.Header.Set("X-Key", key)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						t.Fatal(err)
+					}
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						t.Fatalf("request for %v: got %d", addr, resp.StatusCode)
+					}
+				}
+			}
+
+			ratio := float64(tt.degraded) / float64(tt.routed)
+			var stats struct {
+				Degraded struct {
+					Routed uint64 `json:"routed"`;
+					Degraded uint64 `json:"degraded"`;
+					Ratio float64 `json:"ratio"`;
+				} `json:"degraded"`;
+			}
+			h := proxy.Config.Handler
+			if err := json.Unmarshal(serve(h, http.MethodGet, "/stats", nil).Body.Bytes(), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if got := stats.Degraded; got.Routed != tt.routed || got.Degraded != tt.degraded || got.Ratio != ratio {
+				t.Errorf("/stats: %+v, want %d routed, %d degraded, ratio %v", got, tt.routed, tt.degraded, ratio)
+			}
+			metrics := serve(h, http.MethodGet, "/metrics", nil).Body.String()
+			for _, line := range []string{
+				fmt.Sprintf("fairplex_routed_requests_total %d\n", tt.routed),
+				fmt.Sprintf("fairplex_degraded_requests_total %d\n", tt.degraded),
+				fmt.Sprintf("fairplex_degraded_ratio %g\n", ratio),
+			} {
+				if !strings.Contains(metrics, line) {
+					t.Errorf("/metrics lacks %q", line)
+				}
+			}
+		})
+	}
+}
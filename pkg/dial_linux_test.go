@@ -0,0 +1,72 @@
+package fairplex
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// blackholeAddr returns the address of a listener whose backlog is full and
+// which never accepts, so connecting to it hangs until the dialer gives up.
+func blackholeAddr(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	// A backlog of 0 still takes one connection; fill it.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return "http://" + addr
+}
+
+func TestDialTimeoutFailsOverFast(t *testing.T) {
+	other := newTestBackend(t, "other")
+	tests := []struct {
+		attempts int;
+		code int;
+		body string;
+	}{
+		{attempts: 3, code: http.StatusOK, body: "other"},
+		{attempts: 1, code: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: true, DialTimeout: 100 * time.Millisecond, MaxFailoverAttempts: tt.attempts, KeyHeaders: []string{"X-Key"}}
+		proxy := startProxy(t, fairplex)
+		blackholed := register(t, fairplex, blackholeAddr(t))
+		register(t, fairplex, other.URL)
+
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+		req.Header.Set("X-Key", keyFor(t, fairplex, blackholed))
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("attempts %d: took %v with a 100ms DialTimeout", tt.attempts, elapsed)
+		}
+		if resp.StatusCode != tt.code || (tt.body != "" && resp.Header.Get("X-Backend") != tt.body) {
+			t.Errorf("attempts %d: got %d from %q, want %d from %q", tt.attempts, resp.StatusCode, resp.Header.Get("X-Backend"), tt.code, tt.body)
+		}
+	}
+}
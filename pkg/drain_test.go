@@ -0,0 +1,74 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestDrainAll(t *testing.T) {
+	a := newTestBackend(t, "a")
+	b := newTestBackend(t, "b")
+	c := newTestBackend(t, "c")
+	late := newTestBackend(t, "late")
+	fairplex := &Fairplex{VirtualNodes: 10}
+	r := fairplex.SetupRouter()
+	postServer(t, r, url.Values{"addr": {a.URL}})
+	postServer(t, r, url.Values{"addr": {b.URL}})
+	postServer(t, r, url.Values{"addr": {c.URL}, "pool": {"standby"}})
+
+	tests := []struct {
+		name string;
+		path string;
+		add string;
+		servers int;
+		primary int;
+		standby int;
+		code int;
+	}{
+		{name: "drained", path: "/drain-all", servers: 3, primary: 0, standby: 0, code: http.StatusServiceUnavailable},
+		// Servers registered while drained wait to join with the others.
+		{name: "registered while drained", add: late.URL, servers: 4, primary: 0, standby: 0, code: http.StatusServiceUnavailable},
+		{name: "undrained", path: "/undrain-all", servers: 4, primary: 30, standby: 10, code: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.path != "" {
+				w := serve(r, http.MethodPost, tt.path, nil)
+				var body struct {
+					Status string `json:"status"`;
+					Servers int `json:"servers"`;
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusOK || body.Servers != tt.servers {
+					t.Fatalf("POST %v: got %d %v, want 200 with %d servers", tt.path, w.Code, w.Body, tt.servers)
+				}
+			}
+			if tt.add != "" {
+				postServer(t, r, url.Values{"addr": {tt.add}})
+			}
+
+			primary, standby := 0, 0
+			for _, n := range fairplex.RingSnapshot() {
+				if n.Standby {
+					standby++
+				} else {
+					primary++
+				}
+			}
+			if primary != tt.primary || standby != tt.standby {
+				t.Errorf("ring has %d primary and %d standby nodes, want %d and %d", primary, standby, tt.primary, tt.standby)
+			}
+
+			// The servers stay registered throughout.
+			var servers []url.URL
+			json.Unmarshal(serve(r, http.MethodGet, "/servers", nil).Body.Bytes(), &servers)
+			if len(servers) != tt.servers {
+				t.Errorf("GET /servers lists %v, want %d servers", servers, tt.servers)
+			}
+			if w := serve(r, http.MethodGet, "/users", nil); w.Code != tt.code {
+				t.Errorf("GET /users: got %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
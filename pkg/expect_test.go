@@ -0,0 +1,65 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpectContinue(t *testing.T) {
+	var expect atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expect.Store(r.Header.Get("Expect"))
+		if r.URL.Path == "/reject" {
+			// Answering without reading the body sends no 100 Continue.
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	fairplex := &Fairplex{Proxy: true}
+	proxy := startProxy(t, fairplex)
+	register(t, fairplex, srv.URL)
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	tests := []struct {
+		path string;
+		code int;
+		continued bool;
+		body string;
+	}{
+		{path: "/accept", code: http.StatusOK, continued: true, body: "upload"},
+		{path: "/reject", code: http.StatusRequestEntityTooLarge, continued: false, body: ""},
+	}
+	for _, tt := range tests {
+		expect.Store("")
+		continued := false
+		trace := &httptrace.ClientTrace{Got100Continue: func() { continued = true }}
+		req, _ := http.NewRequest(http.MethodPut, proxy.URL+tt.path, strings.NewReader("upload"))
+		req.Header.Set("Expect", "100-continue")
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got := expect.Load(); got != "100-continue" {
+			t.Errorf("%v: server got Expect %q, want 100-continue", tt.path, got)
+		}
+		if resp.StatusCode != tt.code || string(body) != tt.body {
+			t.Errorf("%v: got %d %q, want %d %q", tt.path, resp.StatusCode, body, tt.code, tt.body)
+		}
+		if continued != tt.continued {
+			t.Errorf("%v: client got 100 Continue: %v, want %v", tt.path, continued, tt.continued)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFailoverWithBody(t *testing.T) {
+	tests := []struct {
+		name string;
+		method string;
+		body string;
+		policy RetryPolicy;
+		max_buffered int64;
+		want int;
+	}{
+		{name: "get without body", method: http.MethodGet, want: http.StatusOK},
+		{name: "put with body", method: http.MethodPut, body: "payload", want: http.StatusOK},
+		{name: "post never retried", method: http.MethodPost, body: "payload", want: http.StatusBadGateway},
+		{name: "post on connect error", method: http.MethodPost, body: "payload", policy: RetryOnConnectError, want: http.StatusOK},
+		{name: "post always", method: http.MethodPost, body: "payload", policy: RetryAlways, want: http.StatusOK},
+		{name: "body over buffer", method: http.MethodPut, body: "payload", max_buffered: 4, want: http.StatusBadGateway},
+		{name: "body at buffer", method: http.MethodPut, body: "payload", max_buffered: 7, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = string(b)
+			}))
+			defer live.Close()
+			fairplex := &Fairplex{
+				Proxy: true,
+				KeyHeaders: []string{"X-Key"},
+				NonIdempotentRetry: tt.policy,
+				MaxBufferedBodyBytes: tt.max_buffered,
+			}
+			srv := httptest.NewServer(fairplex.SetupRouter())
+			defer srv.Close()
+			dead := register(t, fairplex, deadAddr(t))
+			register(t, fairplex, live.URL)
+
+			req, _ := http.NewRequest(tt.method, srv.URL+"/x", strings.NewReader(tt.body))
+			req.Header.Set("X-Key", keyFor(t, fairplex, dead))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusOK && got != tt.body {
+				t.Errorf("server got body %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
+
+func TestFailoverAfterSent(t *testing.T) {
+	// How the first server fails once it has read the request.
+	dropped := func(w http.ResponseWriter) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+	partial := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Length", "100")
+		io.WriteString(w, "part of it")
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+	tests := []struct {
+		name string;
+		fail func(http.ResponseWriter);
+		method string;
+		policy RetryPolicy;
+		code int;
+		// Whether the second server gets the request.
+		failed_over bool;
+	}{
+		{name: "dropped post, never", fail: dropped, method: http.MethodPost, policy: RetryNever, code: http.StatusBadGateway},
+		{name: "dropped post, on connect error", fail: dropped, method: http.MethodPost, policy: RetryOnConnectError, code: http.StatusBadGateway},
+		{name: "dropped post, always", fail: dropped, method: http.MethodPost, policy: RetryAlways, code: http.StatusOK, failed_over: true},
+		{name: "dropped put, never", fail: dropped, method: http.MethodPut, policy: RetryNever, code: http.StatusBadGateway},
+		{name: "dropped put, on connect error", fail: dropped, method: http.MethodPut, policy: RetryOnConnectError, code: http.StatusBadGateway},
+		{name: "dropped put, always", fail: dropped, method: http.MethodPut, policy: RetryAlways, code: http.StatusOK, failed_over: true},
+		{name: "dropped get, always", fail: dropped, method: http.MethodGet, policy: RetryAlways, code: http.StatusOK, failed_over: true},
+		// Once part of the response has reached the client, nothing is
+		// retried, under any policy.
+		{name: "partial post, never", fail: partial, method: http.MethodPost, policy: RetryNever, code: http.StatusOK},
+		{name: "partial post, on connect error", fail: partial, method: http.MethodPost, policy: RetryOnConnectError, code: http.StatusOK},
+		{name: "partial post, always", fail: partial, method: http.MethodPost, policy: RetryAlways, code: http.StatusOK},
+		{name: "partial get, always", fail: partial, method: http.MethodGet, policy: RetryAlways, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var first_hits, second_hits atomic.Int64
+			first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				first_hits.Add(1)
+				tt.fail(w)
+			}))
+			defer first.Close()
+			second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.ReadAll(r.Body)
+				second_hits.Add(1)
+				io.WriteString(w, "second")
+			}))
+			defer second.Close()
+			fairplex := &Fairplex{Proxy: true, KeyHeaders: []string{"X-Key"}, NonIdempotentRetry: tt.policy}
+			proxy := startProxy(t, fairplex)
+			b := register(t, fairplex, first.URL)
+			register(t, fairplex, second.URL)
+
+			req, _ := http.NewRequest(tt.method, proxy.URL+"/x", strings.NewReader("payload"))
+			req.Header.Set("X-Key", keyFor(t, fairplex, b))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, read_err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("got %d, want %d", resp.StatusCode, tt.code)
+			}
+			if tt.code == http.StatusOK && !tt.failed_over && read_err == nil {
+				t.Errorf("cut off response read in full: %q", body)
+			}
+			if got := first_hits.Load(); got != 1 {
+				t.Errorf("first server got the request %d times, want once", got)
+			}
+			want := int64(0)
+			if tt.failed_over {
+				want = 1
+			}
+			if got := second_hits.Load(); got != want {
+				t.Errorf("second server got the request %d times, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestMaxFailoverAttempts(t *testing.T) {
+	tests := []struct {
+		max int;
+		attempts int;
+	}{
+		{max: 0, attempts: defaultMaxFailoverAttempts},
+		{max: 1, attempts: 1},
+		{max: 5, attempts: 5},
+		// No server is tried twice.
+		{max: 20, attempts: 8},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: true, MaxFailoverAttempts: tt.max, VerboseErrors: true}
+		proxy := startProxy(t, fairplex)
+		for i := 0; i < 8; i++ {
+			register(t, fairplex, deadAddr(t))
+		}
+
+		code, body := send(t, http.MethodGet, proxy.URL+"/users", nil)
+		var resp struct {
+			Attempts []struct {
+				Server string `json:"server"`;
+			} `json:"attempts"`;
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		servers := map[string]bool{}
+		for _, a := range resp.Attempts {
+			servers[a.Server] = true
+		}
+		if code != http.StatusBadGateway || len(resp.Attempts) != tt.attempts || len(servers) != tt.attempts {
+			t.Errorf("MaxFailoverAttempts %d: got %d after %d attempts on %d servers, want 502 after %d", tt.max, code, len(resp.Attempts), len(servers), tt.attempts)
+		}
+	}
+}
+
+func TestVerboseErrors(t *testing.T) {
+	tests := []struct {
+		verbose bool;
+		attempts int;
+	}{
+		{verbose: false, attempts: 0},
+		{verbose: true, attempts: 2},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: true, MaxFailoverAttempts: 2, VerboseErrors: tt.verbose}
+		proxy := startProxy(t, fairplex)
+		dead := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			b := register(t, fairplex, deadAddr(t))
+			dead[b.url.String()] = true
+		}
+
+		code, body := send(t, http.MethodGet, proxy.URL+"/users", nil)
+		var resp struct {
+			Status string `json:"status"`;
+			Reason string `json:"reason"`;
+			Attempts []struct {
+				Server string `json:"server"`;
+				Error string `json:"error"`;
+			} `json:"attempts"`;
+		}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusBadGateway || resp.Status != "error" || resp.Reason != "bad gateway" {
+			t.Errorf("verbose %v: got %d %v, want a 502 bad gateway", tt.verbose, code, body)
+		}
+		if !tt.verbose && strings.Contains(body, "attempts") {
+			t.Errorf("attempts listed without VerboseErrors: %v", body)
+		}
+		if len(resp.Attempts) != tt.attempts {
+			t.Fatalf("verbose %v: %d attempts listed, want %d", tt.verbose, len(resp.Attempts), tt.attempts)
+		}
+		for _, a := range resp.Attempts {
+			if !dead[a.Server] || !strings.Contains(a.Error, "connection refused") {
+				t.Errorf("attempt on %v failed with %q, want one of the dead servers refusing", a.Server, a.Error)
+			}
+		}
+	}
+}
@@ -2,148 +2,924 @@ package fairplex
 
 import (
 	"crypto/sha1"
+	"crypto/tls"
 
 	"encoding/hex"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/didip/tollbooth"
 	"github.com/didip/tollbooth/limiter"
-	"github.com/didip/tollbooth_gin"
-	rbtree "github.com/emirpasic/gods/trees/redblacktree"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type Fairplex struct {
-	// List of all server URLs.
+	// List of all server URLs in the primary pool.
 	Servers []*url.URL;
-	// Number of requests a user can make per minute
+	// List of server URLs in the standby pool, which only receives traffic
+	// once every primary server is down (see FailoverHysteresis).
+	StandbyServers []*url.URL;
+	// Number of requests a client (by IP) can make per minute, counting
+	// every route, balanced or admin. Zero disables rate limiting; negative
+	// values fail Validate, and a config file setting one is rejected.
 	RequestsPerMinute float64;
-	// Server addresses are hashed and put in a red-black tree, with hash as the key
-	// and address as the value.
-	tree *rbtree.Tree;
+	// Request header naming the client's class for rate limiting, e.g. "X-Plan".
+	// It should be set by a trusted upstream, since clients can pick their own.
+	ClassHeader string;
+	// Requests per minute allowed for each client class, e.g. {"premium": 1000}.
+	// Clients with no class, or one not listed here, get RequestsPerMinute.
+	ClassRequestsPerMinute map[string]float64;
+	// Requests per minute allowed for each HTTP method, e.g. {"DELETE": 10},
+	// counted separately from and on top of the client's class limit.
+	// Methods not listed have no limit of their own.
+	MethodRequestsPerMinute map[string]float64;
+	// The 429 given to rate limited requests, by route: an admin path
+	// without AdminPrefix, such as "/servers", optionally preceded by a
+	// method, as in "POST /servers", or "*" for the balanced paths. A
+	// route's entry for the request's method comes first. Routes not listed
+	// get {"error": "too many requests"}.
+	RateLimitResponses map[string]RateLimitResponse;
+	// In proxy mode, the most servers a request is tried on when they can't
+	// be connected to, before giving up with a 502. Each attempt goes to the
+	// next server the strategy picks. Requests with a body are only failed
+	// over if it fits in MaxBufferedBodyBytes and they don't carry "Expect:
+	// 100-continue". Defaults to 3.
+	MaxFailoverAttempts int;
+	// Whether POST and PATCH requests, which may not be safe to repeat, are
+	// failed over too. Defaults to RetryNever.
+	NonIdempotentRetry RetryPolicy;
+	// In proxy mode, the largest request body read into memory so it can be
+	// sent more than once, for failover, replication and mirroring. A
+	// request with a larger body goes to one server only: it isn't failed
+	// over or mirrored, and replicated writes get a 413. Defaults to 1MiB.
+	MaxBufferedBodyBytes int64;
+	// If set, the 502 given when a request couldn't be proxied lists every
+	// server tried and the error it failed with. This reveals server
+	// addresses to clients, so it's meant for debugging.
+	VerboseErrors bool;
+	// If set, called instead of answering with JSON when there's no server
+	// to take a request (`status` is 503), it couldn't be proxied (502) or
+	// its server timed out (504), e.g. to serve a branded maintenance page.
+	// It must write the response.
+	ErrorHandler func(c *gin.Context, status int);
+	// How servers are picked for requests. Defaults to StrategyConsistentHash.
+	Strategy Strategy;
+	// The zone, e.g. an availability zone, fairplex runs in. When set,
+	// requests go to servers registered in the same zone, and only to
+	// servers elsewhere when no server of the zone can take them. Writes
+	// replicated with ReplicationFactor go to the usual servers regardless.
+	Zone string;
+	// If set, the query string is part of the routing key, so /a?id=1 and
+	// /a?id=2 can go to different servers. Parameter order doesn't matter,
+	// and IgnoreQueryParams (e.g. "utm_source") are left out, so tracking
+	// parameters don't scatter requests for the same resource.
+	HashQuery bool;
+	IgnoreQueryParams []string;
+	// If set, requests are hashed on the values of these headers, in order
+	// and joined with KeyHeaderSeparator ("|" by default), instead of on the
+	// client and path, e.g. {"X-Tenant", "X-Region"} to keep each tenant's
+	// requests in a region on one server. KeyHeaderFallback stands in for
+	// the headers a request doesn't have.
+	KeyHeaders []string;
+	KeyHeaderSeparator string;
+	KeyHeaderFallback KeyFallback;
+	// Number of virtual nodes each server is given in the ring. Defaults to 4,
+	// and can be at most 10000. Negative values fail Validate.
+	VirtualNodes int;
+	// Mixed into both server and request hashes, so deployments with the same
+	// servers don't route keys identically and routing can't be predicted
+	// from the server list alone. Every instance sharing a ring must use the
+	// same salt; changing it reshuffles the ring.
+	HashSalt string;
+	// Log level, one of "debug", "info" or "error". Defaults to "info".
+	LogLevel string;
+	// Which requests are logged: "all" (the default), or "errors" for just
+	// those answered with a 4xx or 5xx, such as rate limited requests and
+	// ones no server could take. Only applies to the engine SetupRouter
+	// creates, not to a provided Engine.
+	AccessLog string;
+	// The fraction of successful requests logged, between 0 and 1, e.g. 0.01
+	// for one in a hundred. Requests answered with a 4xx or 5xx are always
+	// logged. Zero, the default, logs every request.
+	AccessLogSampleRate float64;
+	// Path prefix for the admin routes (/ping, /servers, /stats, ...), e.g.
+	// "/_fairplex". Empty by default, which puts them at the root.
+	AdminPrefix string;
+	// GET /servers lists the address of every server to anyone who can reach
+	// the admin routes, as do the other routes naming servers: /stats,
+	// /metrics, /config, GET /servers/<id>/stats and POST /servers/check.
+	// HideServerList makes them all answer 404 instead, and ServerListToken,
+	// if set, requires "Authorization: Bearer <token>" on them. Registering
+	// and removing servers is unaffected.
+	HideServerList bool;
+	ServerListToken string;
+	// If set, replacing the whole server list with a JSON PUT /servers, as a
+	// control plane pushing the list would, requires "Authorization: Bearer
+	// <token>".
+	ControlPlaneToken string;
+	// Path to a JSON config file (see Config). If set, Run loads it at startup
+	// and again whenever the process receives SIGHUP.
+	ConfigFile string;
+	// If set, SetupRouter registers fairplex's routes on this engine instead of
+	// a new one, so middleware already added to it (auth, logging, ...) runs
+	// ahead of fairplex's handlers. Fairplex turns on its UseRawPath and
+	// HandleMethodNotAllowed and sets its NoRoute and NoMethod handlers (call
+	// those again after SetupRouter to override them), and leaves logging,
+	// recovery and trusted proxies to its owner.
+	Engine *gin.Engine;
+	// Handles requests for "/", e.g. with a status page. If nil, they're
+	// balanced like any other path, with an empty path as the key.
+	RootHandler gin.HandlerFunc;
+	// If set, requests are forwarded to the selected server and its response
+	// relayed back, instead of redirecting the client to it.
+	Proxy bool;
+	// If set, requests are routed as usual, and counted in /stats and
+	// /metrics, but answered with a 200 naming the server they'd have gone
+	// to instead of being redirected or proxied. This lets the distribution
+	// be checked before fairplex takes real traffic.
+	DryRun bool;
+	// How often every server is probed via its /ping endpoint. Servers failing
+	// the probe get no traffic until they pass again. Zero disables background
+	// health checks, in which case every server is assumed healthy.
+	HealthCheckInterval time.Duration;
+	// The longest a down server goes unprobed. Servers failing their health
+	// check are probed again after HealthCheckInterval, then after twice
+	// that, four times, and so on up to this cap; recovery resets them to
+	// the normal interval. Defaults to one minute.
+	HealthCheckMaxBackoff time.Duration;
+	// HTTP method health checks and registration checks probe /ping with,
+	// e.g. "HEAD". Defaults to GET.
+	HealthCheckMethod string;
+	// If set, health checks follow redirects and judge the server by the
+	// final response. Otherwise a 3xx response fails the check.
+	HealthCheckFollowRedirects bool;
+	// If set, the body of a server's /ping response must contain this, e.g.
+	// `"status":"ok"`, for the server to count as healthy. Only the first
+	// maxHealthCheckBody bytes are looked at. HEAD responses have no body,
+	// so setting this with a HealthCheckMethod of HEAD fails Validate.
+	HealthCheckExpectBody string;
+	// If set, TLS certificates of https servers aren't verified, neither by
+	// health checks nor when proxying. This allows self-signed certificates
+	// on internal servers, but also lets anyone able to intercept the traffic
+	// impersonate a server, so only use it on networks you trust.
+	InsecureSkipVerify bool;
+	// PEM files with the client certificate and key fairplex presents to
+	// https servers requiring mutual TLS, both when proxying and for health
+	// checks. CACertFile, if set, holds the CAs server certificates are
+	// verified against instead of the system's.
+	ClientCertFile string;
+	ClientKeyFile string;
+	CACertFile string;
+	// With RunTLS, a PEM file of the CAs client certificates are verified
+	// against. Clients may still connect without a certificate.
+	ClientCAFile string;
+	// If set, a client presenting a verified certificate is identified by
+	// its subject (the common name, or else its first DNS name, URI or email
+	// address) rather than its IP, both in the hash key and for rate limits.
+	// Clients without one are still identified by their IP.
+	ClientCertIdentity bool;
+	// If set, a newly registered or recovered server starts with a single
+	// virtual node and is ramped up to its full share over this duration.
+	SlowStartDuration time.Duration;
+	// If set, once a server registered through POST /servers passes its
+	// check, fairplex opens a connection to it (with a request for its
+	// /ping) that's kept for proxying, so the first request proxied there
+	// doesn't wait on a TCP and TLS handshake.
+	PrewarmOnAdd bool;
+	// Number of consecutive health-check rounds the primary pool must be fully
+	// down before failing over to the standby pool, and healthy again before
+	// failing back. Defaults to 3.
+	FailoverHysteresis int;
+	// If set, OPTIONS requests on the data plane are answered by fairplex
+	// itself, with an Allow header listing the methods it balances, instead
+	// of being sent on to a server.
+	AnswerOptions bool;
+	// In proxy mode, the number of distinct servers POST, PUT, PATCH and
+	// DELETE requests are sent to: the selected server and its ring
+	// successors. A request succeeds when a majority of them return a 2xx.
+	// Zero or one sends writes to a single server like any other request.
+	ReplicationFactor int;
+	// In proxy mode, if set, concurrent GET and HEAD requests for the same
+	// URL share a single request to the server, e.g. to keep a cache miss
+	// from reaching the origin once per client. Request headers aren't
+	// compared, so responses mustn't vary by client. Coalesced responses
+	// are held in memory until complete, rather than streamed.
+	Coalesce bool;
+	// In proxy mode, for a read-through cache fleet: the most servers a GET
+	// or HEAD is tried on, in ring order, while their responses are cache
+	// misses as defined by ReadMissStatuses and ReadMissHeader. The last
+	// server's response is relayed whatever it is. Zero or one tries only
+	// the selected server.
+	ReadFanOut int;
+	// Response status codes that count as cache misses for ReadFanOut, e.g. 404.
+	ReadMissStatuses []int;
+	// A response header that marks a cache miss for ReadFanOut, as
+	// "Name: value", e.g. "X-Cache: MISS". The value is matched without
+	// regard to case.
+	ReadMissHeader string;
+	// In proxy mode, the largest response body accepted from a server. Larger
+	// responses get a 502 instead. Responses of unknown length are buffered
+	// up to this size before being relayed, so they aren't streamed. Zero
+	// means no limit.
+	MaxResponseBytes int64;
+	// Name of a response header servers identify themselves with, e.g.
+	// "X-Served-By". In proxy mode its value is logged and copied to the
+	// X-Fairplex-Served-By response header, showing which instance actually
+	// handled the request.
+	ServedByHeader string;
+	// If set, proxied text responses (HTML, JSON, ...) the server sent
+	// uncompressed are gzipped for clients accepting it. Responses the server
+	// compressed itself are passed through as they are.
+	Compress bool;
+	// If set, proxied responses the server gzipped regardless are
+	// decompressed for clients whose Accept-Encoding doesn't allow gzip.
+	// Otherwise they're passed through as they are.
+	Decompress bool;
+	// In proxy mode, request headers not passed on to servers, e.g.
+	// "Cookie" or "Authorization". Headers given when a server registered
+	// are still added. Hop-by-hop headers (Connection and those it names,
+	// Keep-Alive, Proxy-*, Transfer-Encoding, Upgrade, ...) are always
+	// removed.
+	StripRequestHeaders []string;
+	// In proxy mode, headers removed from responses before they're relayed
+	// to the client, e.g. "Server" or "X-Powered-By".
+	StripResponseHeaders []string;
+	// In proxy mode, headers set on every relayed response, replacing any
+	// the server sent, e.g. "X-Content-Type-Options": "nosniff".
+	AddResponseHeaders map[string]string;
+	// If set, Location headers in proxied responses that point at the server
+	// are rewritten to point at fairplex instead, like nginx's proxy_redirect.
+	RewriteLocation bool;
+	// If set, proxied requests keep the Host the client sent, for servers
+	// that route by virtual host. Otherwise Host is the server's own, as in
+	// its registered URL.
+	PreserveHost bool;
+	// If set, request paths are hashed and forwarded in the percent-encoded
+	// form the client sent, so /a%2Fb reaches the server as /a%2Fb. Otherwise
+	// paths are decoded first and an encoded slash arrives as a plain one.
+	RawPath bool;
+	// Server that gets requests when no server in the ring can take them,
+	// e.g. one serving a maintenance page. If nil such requests get a 503.
+	FallbackBackend *url.URL;
+	// In proxy mode, a server that gets a copy of ShadowPercent percent of
+	// requests, e.g. a new version being tried on real traffic. Its responses
+	// are discarded and its failures never reach the client. Mirrored
+	// requests have their bodies read into memory first, so those with a
+	// body over MaxBufferedBodyBytes aren't mirrored, and neither are those
+	// with "Expect: 100-continue".
+	ShadowBackend *url.URL;
+	ShadowPercent float64;
+	// How long connecting to a server may take, both when proxying and for
+	// health checks, so an unreachable server fails fast and is taken out
+	// of the ring by the next health check. Zero keeps net/http's default
+	// of 30s (health checks are always capped at 5s overall).
+	DialTimeout time.Duration;
+	// Upper bound on the time spent handling a single request, including
+	// selection and every backend attempt. Zero means no limit.
+	RequestTimeout time.Duration;
+	// Longest request path, in bytes as sent, that is accepted. Longer paths
+	// get a 414 before being hashed or logged. Zero means no limit.
+	MaxPathLength int;
+	// Timeouts for the http.Server started by Run and RunTLS. Zero selects the
+	// defaults of 30s to read a request, 60s to write a response and 120s for
+	// idle keep-alive connections; a negative value means no timeout.
+	ReadTimeout time.Duration;
+	WriteTimeout time.Duration;
+	IdleTimeout time.Duration;
+	// In proxy mode, how long a response streaming server-sent events
+	// (Content-Type text/event-stream) may keep going, in place of
+	// WriteTimeout, which would cut off long-lived streams. Zero means no
+	// limit. RequestTimeout still applies, so leave that unset for streams.
+	StreamTimeout time.Duration;
+	// In proxy mode, how long an event stream may be quiet before fairplex
+	// sends the client a ": keep-alive" comment, to keep the connection
+	// from being dropped as idle along the way. Zero sends none.
+	StreamKeepAlive time.Duration;
+	// How long Shutdown waits for in-flight requests to finish before closing
+	// their connections. Zero selects 30s; negative waits indefinitely.
+	ShutdownGracePeriod time.Duration;
+	// Maximum size of request headers accepted by Run and RunTLS. Zero selects
+	// net/http's default of 1MB.
+	MaxHeaderBytes int;
+	// If set, every data-plane request gets a span covering selection and
+	// proxying, and the trace context is passed on to the selected server.
+	// Nil (the default) turns tracing off.
+	TracerProvider trace.TracerProvider;
+	// Server addresses are hashed and put in a ring, with hash as the key
+	// and server as the value. The standby pool has a ring of its own.
+	ring *ring;
+	standbyRing *ring;
+	// Set between POST /drain-all and POST /undrain-all, keeping every
+	// server out of the rings. Guarded by mu.
+	drained bool;
+	// Whether traffic is currently going to the standby pool, and the health
+	// check rounds counted towards switching pools.
+	standbyActive bool;
+	primaryDownRounds int;
+	primaryUpRounds int;
+	// The TLS config for connecting to servers, if any TLS settings are set.
+	clientTLS *tls.Config;
+	// The servers for FallbackBackend and ShadowBackend, if any.
+	fallback *backend;
+	shadow *backend;
+	// Closed to stop the health checker.
+	stopHealth chan struct{};
+	// Held while probing servers, so the health checker and POST
+	// /servers/check don't probe at the same time.
+	probing sync.Mutex;
+	// Per-server settings, keyed by server URL.
+	backends map[string]*backend;
 	mu sync.Mutex;
+	// Requests being proxied for Coalesce, by method and URL.
+	flights singleflight.Group;
+	// The rate limiter for clients without a class of their own.
+	limiter *limiter.Limiter;
+	// Rate limiters for the client classes in ClassRequestsPerMinute.
+	classLimiters map[string]*limiter.Limiter;
+	// Rate limiters for the methods in MethodRequestsPerMinute.
+	methodLimiters map[string]*limiter.Limiter;
+	// The address Run is listening on, and the server doing so.
+	addr string;
+	server *http.Server;
+	setupOnce sync.Once;
+	// The listener of RunTCP, closed by Shutdown.
+	tcpListener net.Listener;
+	// Counters exposed through /stats and /metrics.
+	stats stats;
 }
 
+// hash returns the hex encoded SHA-1 digest of `s`. The whole digest is
+// used, so swapping in a wider hash keeps all of its entropy.
 func hash(s string) string {
 	h := sha1.New()
     _, err := h.Write([]byte(s))
 	if err != nil {
-		log.Printf("failed to hash %v: %v\n", s, err)
+		errorf("failed to hash %v: %v\n", s, err)
 	}
-	return hex.EncodeToString(h.Sum(nil))[:40]
+	return hex.EncodeToString(h.Sum(nil))
 }
 
+// How long a health check may take before the server is considered down.
+// A var so tests needn't wait this long.
+var healthCheckTimeout = 5 * time.Second
+
+// healthClient returns the client health checks are made with. Unless
+// HealthCheckFollowRedirects is set it doesn't follow redirects, so a server
+// redirecting /ping to e.g. a login page fails the check.
+func (fairplex *Fairplex) healthClient() *http.Client {
+	c := &http.Client{Timeout: healthCheckTimeout}
+	if fairplex.clientTLS != nil || fairplex.DialTimeout > 0 {
+		// A client is made per check, so don't leave connections behind.
+		t := fairplex.newTransport()
+		t.DisableKeepAlives = true
+		c.Transport = t
+	}
+	if !fairplex.HealthCheckFollowRedirects {
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return c
+}
+
+// addrError is why a server address failed checkAddr. Its reason is one of
+// "parse_error", "unreachable", "timeout" or "bad_status".
+type addrError struct {
+	reason string;
+	err error;
+}
+
+func (e *addrError) Error() string {
+	return e.err.Error()
+}
+
+func (e *addrError) Unwrap() error {
+	return e.err
+}
+
+// How much of a /ping response is searched for HealthCheckExpectBody.
+const maxHealthCheckBody = 64 << 10
+
 // Checks if the given address `addr` is valid by making a
-// GET request to addr + "/ping". The server must respond with 
-// a 200 OK status to be valid.
-func (fairplex *Fairplex) isAddrValid(addr string) bool {
-	c := http.Client{}
+// HealthCheckMethod request to addr + "/ping". The server must respond with
+// a 200 OK status, and a body containing HealthCheckExpectBody if that's
+// set, to be valid; if it isn't, the returned *addrError says why. A tcp
+// server need only accept a connection.
+func (fairplex *Fairplex) checkAddr(addr string) error {
+	c := fairplex.healthClient()
 	u, err := url.Parse(addr)
+	if err == nil {
+		err = checkServerURL(u)
+	}
 	if err != nil {
-		log.Printf("error parsing addr: %v\n", addr)
-		return false
+		return &addrError{"parse_error", err}
+	}
+
+	if u.Scheme == "tcp" {
+		return checkTCP(u.Host)
 	}
 
-	resp, err := c.Get(u.JoinPath("/ping").String())
+	method := fairplex.HealthCheckMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, u.JoinPath("/ping").String(), nil)
 	if err != nil {
-		log.Printf("error pinging addr %v: %v\n", u.String(), err)
-		return false
+		return &addrError{"parse_error", err}
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		var net_err net.Error
+		if errors.As(err, &net_err) && net_err.Timeout() {
+			return &addrError{"timeout", err}
+		}
+		return &addrError{"unreachable", err}
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+	if resp.StatusCode != http.StatusOK {
+		return &addrError{"bad_status", fmt.Errorf("%v /ping returned %v", method, resp.Status)}
+	}
+	if fairplex.HealthCheckExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+		if err != nil {
+			return &addrError{"unreachable", err}
+		}
+		if !strings.Contains(string(body), fairplex.HealthCheckExpectBody) {
+			return &addrError{"bad_body", fmt.Errorf("%v /ping response doesn't contain %q", method, fairplex.HealthCheckExpectBody)}
+		}
+	}
+	return nil
+}
+
+// clientHost returns the IP of `remote_addr` without its port, which changes
+// with every connection and so mustn't be part of a client's hash key.
+func clientHost(remote_addr string) string {
+	host, _, err := net.SplitHostPort(remote_addr)
+	if err != nil {
+		return remote_addr
+	}
+	return host
+}
+
+// clientID returns what identifies the client of `req` in its hash key and
+// for rate limits: its IP, or the subject of its certificate with
+// ClientCertIdentity.
+func (fairplex *Fairplex) clientID(req *http.Request) string {
+	if fairplex.ClientCertIdentity && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if subject := certSubject(req.TLS.VerifiedChains[0][0]); subject != "" {
+			// Kept apart from IPs, in case a subject is one.
+			return "cert:" + subject
+		}
+	}
+	return clientHost(req.RemoteAddr)
+}
+
+// routingKey returns the part of a request for `path` at `u` that is hashed
+// along with the client: the path, plus the query if HashQuery is set. The
+// query is put in a canonical order, less IgnoreQueryParams.
+func (fairplex *Fairplex) routingKey(path string, u *url.URL) string {
+	if !fairplex.HashQuery {
+		return path
+	}
+	query := u.Query()
+	for _, name := range fairplex.IgnoreQueryParams {
+		query.Del(name)
+	}
+	if len(query) == 0 {
+		return path
+	}
+	return path + "?" + query.Encode()
 }
 
 // This is the main function that handles all request methods.
 func (fairplex *Fairplex) balanceRequest(c *gin.Context) {
 	path := c.Params.ByName("path")
-	path_hash := hash(c.Request.RemoteAddr + path)
-
-	log.Printf("client %v requesting %v\n%v", c.Request.RemoteAddr, c.Request.URL.Path, path)
-	log.Printf("%v\n", path_hash)
-
-	iter := fairplex.tree.Iterator()
-	iter.Begin()
-	if iter.First() {
-		v := iter.Key().(string)
-		selected_server := iter.Value().(*url.URL)
-		if v > path_hash {
-			log.Printf("selected server %v for %v\n",selected_server.String(), path)
-			c.Redirect(http.StatusTemporaryRedirect, selected_server.JoinPath(path).String())
-			return
-		} else {
-			for iter.Next() {
-				v = iter.Key().(string)
-				selected_server = iter.Value().(*url.URL)
-				if v > path_hash {
-					log.Printf("selected server %v for %v\n",selected_server.String(), path)
-					c.Redirect(http.StatusTemporaryRedirect, selected_server.JoinPath(path).String())
-					return
-				}
+	if fairplex.RawPath {
+		// The param is only left encoded when the client's encoding differs
+		// from the default one, so take the path from the URL instead.
+		path = strings.TrimPrefix(c.Request.URL.EscapedPath(), "/")
+	}
+	path_hash := saltedKey(fairplex.HashSalt, fairplex.hashKey(c.Request, path))
+
+	infof("client %v requesting %v\n%v", c.Request.RemoteAddr, c.Request.URL.Path, path)
+	debugf("%v\n", path_hash)
+
+	method := c.Request.Method
+	started := time.Now()
+	accepts_method := func(b *backend) bool {
+		return b.allows(method)
+	}
+	accept := func(b *backend) bool {
+		// Checked last, since it takes a token from the server's bucket.
+		return accepts_method(b) && b.allowRequest()
+	}
+
+	if fairplex.Proxy && fairplex.ReplicationFactor > 1 && isWrite(method) {
+		servers := fairplex.selectServers(path_hash, fairplex.ReplicationFactor, accept)
+		if len(servers) > 0 {
+			fairplex.traceSelection(c, servers[0], time.Since(started))
+			now := time.Now()
+			for _, b := range servers {
+				b.routed(now)
+			}
+			fairplex.recordRouted(servers[0])
+			infof("replicating %v to %v servers\n", path, len(servers))
+			fairplex.stats.routing.record(time.Since(started))
+			if fairplex.DryRun {
+				dryRun(c, servers...)
+				return
 			}
-			log.Printf("fell-through to server %v for %v\n",selected_server.String(), path)
-			c.Redirect(http.StatusTemporaryRedirect, selected_server.JoinPath(path).String())
+			fairplex.replicateRequest(c, servers, path)
 			return
 		}
+	}
+
+	var selected_server *backend
+	if fairplex.Strategy == StrategyP2C {
+		selected_server = fairplex.selectP2C(accept)
 	} else {
-		log.Println("no servers in tree")
+		selected_server = fairplex.selectServer(path_hash, accept)
+	}
+	fairplex.traceSelection(c, selected_server, time.Since(started))
+	if selected_server == nil {
+		if fairplex.selectServer(path_hash, accepts_method) != nil {
+			errorf("every server accepting %v requests is at its rate limit\n", method)
+			fairplex.respondError(c, http.StatusServiceUnavailable, gin.H{"status": "error", "reason": "servers are at their rate limit"})
+			return
+		}
+		if fairplex.selectServer(path_hash, isHTTP) != nil {
+			errorf("no server accepts %v requests\n", method)
+			fairplex.respondError(c, http.StatusBadGateway, gin.H{"status": "error", "reason": "no server accepts " + method + " requests"})
+			return
+		}
+		if fairplex.fallback == nil {
+			errorf("no servers in ring\n")
+			fairplex.respondError(c, http.StatusServiceUnavailable, gin.H{"status": "error", "reason": "no servers available"})
+			return
+		}
+		infof("no servers available, using fallback server %v\n", fairplex.fallback.url.String())
+		selected_server = fairplex.fallback
+	}
+	infof("selected server %v for %v\n", selected_server.url.String(), path)
+	selected_server.routed(time.Now())
+	fairplex.recordRouted(selected_server)
+
+	if fairplex.DryRun {
+		fairplex.stats.routing.record(time.Since(started))
+		dryRun(c, selected_server)
+		return
 	}
+	if fairplex.Proxy {
+		if fairplex.shouldMirror() {
+			fairplex.mirrorRequest(c, path)
+		}
+		fairplex.stats.routing.record(time.Since(started))
+		if fairplex.Coalesce && canCoalesce(method) {
+			fairplex.coalesce(c, func() {
+				fairplex.proxyWithFailover(c, selected_server, path, path_hash, accept)
+			})
+			return
+		}
+		fairplex.proxyWithFailover(c, selected_server, path, path_hash, accept)
+		return
+	}
+	target := selected_server.target(path, fairplex.RawPath).String()
+	fairplex.stats.routing.record(time.Since(started))
+	c.Redirect(http.StatusTemporaryRedirect, target)
+}
+
+// dryRun answers a request in DryRun mode, listing the servers it was routed to.
+func dryRun(c *gin.Context, servers ...*backend) {
+	urls := make([]string, 0, len(servers))
+	for _, b := range servers {
+		urls = append(urls, b.url.String())
+	}
+	c.Header("X-Fairplex-Dry-Run", strings.Join(urls, ", "))
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "dry_run": true, "servers": urls})
 }
 
-// SetupRouter creates the gin.Engine object, attaching method handlers.
+// The methods requests are balanced for.
+var balancedMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodOptions,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodHead,
+}
+
+// rejectOtherMethods makes every route registered on `r` so far answer the
+// balanced methods it doesn't handle with 405 Method Not Allowed, rather
+// than letting them fall through to the balancer. This keeps the admin
+// paths out of the data plane. Methods that aren't balanced at all, such as
+// TRACE, get a 405 on every path.
+func (fairplex *Fairplex) rejectOtherMethods(r *gin.Engine) {
+	allowed := map[string][]string{}
+	for _, route := range r.Routes() {
+		allowed[route.Path] = append(allowed[route.Path], route.Method)
+	}
+	for path, methods := range allowed {
+		allow := strings.Join(methods, ", ")
+		for _, method := range balancedMethods {
+			if !slices.Contains(methods, method) {
+				r.Handle(method, path, func(c *gin.Context) {
+					methodNotAllowed(c, allow)
+				})
+			}
+		}
+	}
+
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(func(c *gin.Context) {
+		// Paths registered so far are looked up as is; anything else is balanced.
+		methods, ok := allowed[c.Request.URL.Path]
+		if !ok {
+			methods = balancedMethods
+		}
+		methodNotAllowed(c, strings.Join(methods, ", "))
+	})
+}
+
+// methodNotAllowed answers with 405 Method Not Allowed, listing the methods
+// in `allow`.
+func methodNotAllowed(c *gin.Context, allow string) {
+	c.Header("Allow", allow)
+	c.JSON(http.StatusMethodNotAllowed, gin.H{"status": "error", "reason": "method not allowed"})
+}
+
+// notFound answers requests that match no route, such as a path with more
+// than one segment, with a JSON 404 rather than gin's plain text one.
+func notFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{"status": "error", "reason": "not found"})
+}
+
+// answerOptions responds to an OPTIONS request on the data plane with the
+// methods fairplex balances.
+func answerOptions(c *gin.Context) {
+	c.Header("Allow", strings.Join(balancedMethods, ", "))
+	c.Status(http.StatusNoContent)
+}
+
+// setup applies the settings and starts the health checker, ahead of
+// serving HTTP or TCP. Only the first call does anything, so RunTCP and
+// Run can share a Fairplex.
+func (fairplex *Fairplex) setup() {
+	fairplex.setupOnce.Do(fairplex.setupLocked)
+}
+
+func (fairplex *Fairplex) setupLocked() {
+	setLogLevel(fairplex.LogLevel)
+	setAccessLog(fairplex.AccessLog)
+	setAccessLogSampleRate(fairplex.AccessLogSampleRate)
+	client_tls, err := fairplex.clientTLSConfig()
+	if err != nil {
+		errorf("not using TLS client settings: %v\n", err)
+	}
+	fairplex.clientTLS = client_tls
+	fairplex.VirtualNodes = checkVirtualNodes(fairplex.VirtualNodes)
+	fairplex.rebuildRing()
+	fairplex.startHealthChecks()
+	if fairplex.FallbackBackend != nil {
+		fairplex.fallback = newBackend(fairplex.FallbackBackend, false)
+		fairplex.fallback.transport = fairplex.newTransport()
+	}
+	if fairplex.ShadowBackend != nil {
+		fairplex.shadow = newBackend(fairplex.ShadowBackend, false)
+		fairplex.shadow.transport = fairplex.newTransport()
+	}
+}
+
+// SetupRouter creates the gin.Engine object (or takes Engine, if set),
+// attaching method handlers. It panics if the settings don't pass Validate.
 func (fairplex *Fairplex) SetupRouter() *gin.Engine {
-	r := gin.Default()
-	r.SetTrustedProxies(nil) //https://github.com/gin-gonic/gin/issues/2809
+	if err := fairplex.Validate(); err != nil {
+		panic(fmt.Sprintf("fairplex: invalid settings: %v", err))
+	}
+	fairplex.setup()
+
+	r := fairplex.Engine
+	if r == nil {
+		r = gin.New()
+		if fairplex.MaxPathLength > 0 {
+			r.Use(fairplex.pathLengthMiddleware)
+		}
+		r.Use(gin.LoggerWithFormatter(formatAccessLog), gin.Recovery())
+		r.SetTrustedProxies(nil) //https://github.com/gin-gonic/gin/issues/2809
+	} else if fairplex.MaxPathLength > 0 {
+		r.Use(fairplex.pathLengthMiddleware)
+	}
+	// Route on the path as sent, so an encoded slash stays within :path
+	// rather than splitting it in two.
+	r.UseRawPath = true
+	if fairplex.RequestTimeout > 0 {
+		r.Use(fairplex.timeoutMiddleware)
+	}
 
-	limiter := tollbooth.NewLimiter(fairplex.RequestsPerMinute, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Minute})
-	limiter.SetMethods([]string{"POST"})
-	limiter.SetMessage(`{"error": "too many requests"}`)
-	limiter.SetMessageContentType("application/json; charset=utf-8")
+	fairplex.setupLimiters()
 
-	r.GET("/ping", tollbooth_gin.LimitHandler(limiter),  func(c *gin.Context) {
+	admin := r.Group(fairplex.AdminPrefix)
+	admin.GET("/ping", fairplex.limitHandler, func(c *gin.Context) {
+		backends, ring_size := fairplex.ringHealth()
+		c.Header("X-Fairplex-Backends", strconv.Itoa(backends))
+		c.Header("X-Fairplex-Ring-Size", strconv.Itoa(ring_size))
+		// Plain text unless the client asks for JSON, e.g. a monitoring probe.
+		if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEJSON) == gin.MIMEJSON {
+			c.JSON(http.StatusOK, gin.H{"status": "ok", "backends": backends, "ring_size": ring_size})
+			return
+		}
 		c.String(http.StatusOK, "pong")
 	})
 
-	r.GET("/servers", tollbooth_gin.LimitHandler(limiter), func(c *gin.Context) {
-		c.JSON(http.StatusOK, fairplex.Servers)
+	admin.GET("/servers", fairplex.limitHandler, fairplex.serverListGuard, func(c *gin.Context) {
+		query := c.Request.URL.Query()
+		fairplex.mu.Lock()
+		servers := []*url.URL{}
+		for _, u := range append(append([]*url.URL{}, fairplex.Servers...), fairplex.StandbyServers...) {
+			if b, ok := fairplex.backends[u.String()]; ok && b.matches(query) {
+				servers = append(servers, u)
+			}
+		}
+		fairplex.mu.Unlock()
+		c.JSON(http.StatusOK, servers)
 	})
 
-	r.POST("/servers", tollbooth_gin.LimitHandler(limiter), func(c *gin.Context) {
-		addr := c.Request.FormValue("addr")
-		if !fairplex.isAddrValid(addr) {
-			c.JSON(http.StatusNotAcceptable, gin.H{"status": "error", "reason": "invalid address"})
+	admin.GET("/stats", fairplex.limitHandler, fairplex.serverListGuard, fairplex.statsHandler)
+	admin.GET("/servers/:id/stats", fairplex.limitHandler, fairplex.serverListGuard, fairplex.serverStatsHandler)
+	admin.GET("/metrics", fairplex.limitHandler, fairplex.serverListGuard, fairplex.metricsHandler)
+	admin.GET("/version", fairplex.limitHandler, versionHandler)
+	admin.GET("/config", fairplex.limitHandler, fairplex.serverListGuard, fairplex.configHandler)
+
+	admin.POST("/servers", fairplex.limitHandler, func(c *gin.Context) {
+		addr := strings.TrimSpace(c.Request.FormValue("addr"))
+		if addr == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "addr is required"})
+			return
+		}
+		pool := c.Request.FormValue("pool")
+		if pool != "" && pool != "primary" && pool != "standby" {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "pool must be primary or standby"})
 			return
 		}
-		
-		u, err := url.Parse(addr)
+		headers, err := parseHeaders(c.Request.Form["headers"])
 		if err != nil {
-			log.Printf("error parsing received server URL %v: %v", addr, err)
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": err.Error()})
+			return
+		}
+		// Something like "foobar" parses as a relative URL, so check there's
+		// a scheme and host before going any further.
+		u, err := parseServerURL(addr)
+		if err != nil {
+			errorf("rejected server %q: %v\n", addr, err)
+			c.JSON(http.StatusNotAcceptable, gin.H{"status": "error", "reason": "parse_error", "detail": err.Error()})
+			return
+		}
+		if err := fairplex.checkAddr(u.String()); err != nil {
+			errorf("rejected server %v: %v\n", addr, err)
+			c.JSON(http.StatusNotAcceptable, gin.H{"status": "error", "reason": err.(*addrError).reason, "detail": err.Error()})
+			return
 		}
 
-		fairplex.mu.Lock()
-		fairplex.Servers = append(fairplex.Servers, u)
-		if fairplex.tree == nil {
-			fairplex.tree = rbtree.NewWithStringComparator()
-		}
-		fairplex.tree.Put(hash(u.String() + "0"), u)
-		fairplex.tree.Put(hash(u.String() + "1"), u)
-		fairplex.tree.Put(hash(u.String() + "2"), u)
-		fairplex.tree.Put(hash(u.String() + "3"), u)
-		fairplex.mu.Unlock()
+		b := newBackend(u, pool == "standby")
+		b.headers = headers
+		b.methods = parseMethods(c.Request.FormValue("methods"))
+		b.tags = parseList(c.Request.FormValue("tags"))
+		b.name = strings.TrimSpace(c.Request.FormValue("name"))
+		b.zone = strings.TrimSpace(c.Request.FormValue("zone"))
+		if v := c.Request.FormValue("rate"); v != "" {
+			per_second, err := strconv.ParseFloat(v, 64)
+			if err != nil || per_second <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "rate must be a positive number of requests per second"})
+				return
+			}
+			b.setRate(per_second)
+		}
+		if v := c.Request.FormValue("weight"); v != "" {
+			if b.weight, err = parseWeight(v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": err.Error()})
+				return
+			}
+		}
+		start, end, err := parseMaintenance(c.Request.FormValue("maintenance_start"), c.Request.FormValue("maintenance_end"), time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": err.Error()})
+			return
+		}
+		fairplex.addServer(b)
+		if fairplex.PrewarmOnAdd {
+			go fairplex.prewarm(b)
+		}
+		if !end.IsZero() {
+			fairplex.scheduleMaintenance(b, start, end)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	admin.PUT("/servers", fairplex.limitHandler, func(c *gin.Context) {
+		if c.ContentType() == gin.MIMEJSON {
+			requireBearer(c, fairplex.ControlPlaneToken)
+			if !c.IsAborted() {
+				fairplex.replaceServersHandler(c)
+			}
+			return
+		}
+		c.Request.ParseForm()
+		var update serverUpdate
+		if v := c.Request.FormValue("weight"); v != "" {
+			weight, err := parseWeight(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": err.Error()})
+				return
+			}
+			update.weight = &weight
+		}
+		// Given but empty clears the tags or headers.
+		if _, ok := c.Request.Form["tags"]; ok {
+			update.tags = append([]string{}, parseList(c.Request.FormValue("tags"))...)
+		}
+		if lines, ok := c.Request.Form["headers"]; ok {
+			headers, err := parseHeaders(slices.DeleteFunc(lines, func(line string) bool { return line == "" }))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": err.Error()})
+				return
+			}
+			update.headers = headers
+		}
+		if !fairplex.updateServer(c.Request.FormValue("addr"), update) {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "reason": "server not registered"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
 
+	admin.POST("/drain-all", fairplex.limitHandler, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "servers": fairplex.drainAll()})
+	})
+	admin.POST("/undrain-all", fairplex.limitHandler, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "servers": fairplex.undrainAll()})
+	})
+
+	admin.POST("/servers/check", fairplex.limitHandler, fairplex.serverListGuard, fairplex.checkHandler)
+
+	admin.DELETE("/servers", fairplex.limitHandler, func(c *gin.Context) {
+		if !fairplex.RemoveServer(c.Request.FormValue("addr")) {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "reason": "server not registered"})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
-	r.GET("/:path", fairplex.balanceRequest)
-	r.POST("/:path", fairplex.balanceRequest)
-	r.PUT("/:path", fairplex.balanceRequest)
-	r.OPTIONS("/:path", fairplex.balanceRequest)
-	r.PATCH("/:path", fairplex.balanceRequest)
-	r.DELETE("/:path", fairplex.balanceRequest)
-	r.HEAD("/:path", fairplex.balanceRequest)
-	
+	fairplex.rejectOtherMethods(r)
+
+	data_plane := []gin.HandlerFunc{}
+	if fairplex.TracerProvider != nil {
+		data_plane = append(data_plane, fairplex.tracingMiddleware)
+	}
+	data_plane = append(data_plane, fairplex.limitHandler)
+
+	for _, method := range balancedMethods {
+		handler := fairplex.balanceRequest
+		if method == http.MethodOptions && fairplex.AnswerOptions {
+			handler = answerOptions
+		}
+		handlers := append(append([]gin.HandlerFunc{}, data_plane...), handler)
+		r.Handle(method, "/:path", handlers...)
+	}
+
+	// "/" isn't matched by "/:path", so give it handlers of its own, unless
+	// a provided Engine already has some.
+	root_taken := map[string]bool{}
+	for _, route := range r.Routes() {
+		if route.Path == "/" {
+			root_taken[route.Method] = true
+		}
+	}
+	for _, method := range balancedMethods {
+		if root_taken[method] {
+			continue
+		}
+		handler := fairplex.RootHandler
+		if handler == nil {
+			handler = fairplex.balanceRequest
+			if method == http.MethodOptions && fairplex.AnswerOptions {
+				handler = answerOptions
+			}
+		}
+		handlers := append(append([]gin.HandlerFunc{}, data_plane...), handler)
+		r.Handle(method, "/", handlers...)
+	}
+	r.NoRoute(notFound)
+
 	return r
 }
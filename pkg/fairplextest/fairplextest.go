@@ -0,0 +1,165 @@
+// Package fairplextest runs fairplex in front of fake backends for end to
+// end tests of routing, failover and proxying, in the spirit of
+// net/http/httptest.
+package fairplextest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fairplex "github.com/eu90h/fairplex/pkg"
+)
+
+// The response header a Backend names itself in.
+const BackendHeader = "X-Fairplex-Test-Backend"
+
+// Backend is a fake server that answers /ping with 200 and every other
+// request with its name, until it's killed.
+type Backend struct {
+	*httptest.Server;
+	Name string;
+	hits atomic.Int64;
+}
+
+// NewBackend starts a Backend called `name`. Close it when done.
+func NewBackend(name string) *Backend {
+	b := &Backend{Name: name}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serveHTTP))
+	return b
+}
+
+func (b *Backend) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		io.WriteString(w, "pong")
+		return
+	}
+	b.hits.Add(1)
+	w.Header().Set(BackendHeader, b.Name)
+	io.WriteString(w, b.Name)
+}
+
+// Kill closes the backend's listener and its open connections, as if its
+// process had died, so connecting to it fails: fairplex fails requests
+// over to other servers and its health checks evict it. Kill and Restore
+// must not be called concurrently with each other or Close.
+func (b *Backend) Kill() {
+	b.Listener.Close()
+	b.CloseClientConnections()
+}
+
+// Restore undoes Kill, listening on the backend's address again.
+func (b *Backend) Restore() {
+	addr := b.Listener.Addr().String()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(fmt.Sprintf("fairplextest: failed to listen on %v again: %v", addr, err))
+	}
+	b.Listener = ln
+	go b.Config.Serve(ln)
+}
+
+// Hits returns the number of requests, other than /ping, the backend has served.
+func (b *Backend) Hits() int64 {
+	return b.hits.Load()
+}
+
+// Harness is a fairplex serving in front of a set of Backends.
+type Harness struct {
+	t testing.TB;
+	Fairplex *fairplex.Fairplex;
+	// Fairplex's router, listening on a local address.
+	Server *httptest.Server;
+	Backends []*Backend;
+	// The client requests are made with. It follows redirects, so requests
+	// reach a backend whether or not fairplex is proxying.
+	Client *http.Client;
+}
+
+// New starts `fp` with `n` backends named "backend-0", "backend-1" and so
+// on, registered through POST /servers. Everything is shut down when the
+// test ends.
+func New(t testing.TB, fp *fairplex.Fairplex, n int) *Harness {
+	t.Helper()
+	h := &Harness{t: t, Fairplex: fp, Client: &http.Client{Timeout: 10 * time.Second}}
+	h.Server = httptest.NewServer(fp.SetupRouter())
+	t.Cleanup(h.close)
+	for i := 0; i < n; i++ {
+		h.AddBackend(fmt.Sprintf("backend-%d", i))
+	}
+	return h
+}
+
+// AddBackend starts another backend and registers it with fairplex.
+func (h *Harness) AddBackend(name string) *Backend {
+	h.t.Helper()
+	b := NewBackend(name)
+	h.Backends = append(h.Backends, b)
+	resp, err := h.Client.PostForm(h.URL(h.Fairplex.AdminPrefix+"/servers"), url.Values{"addr": {b.URL}})
+	if err != nil {
+		h.t.Fatalf("registering %v: %v", name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		h.t.Fatalf("registering %v: got %v", name, resp.Status)
+	}
+	return b
+}
+
+// URL returns the address of `path` on fairplex.
+func (h *Harness) URL(path string) string {
+	return h.Server.URL + path
+}
+
+// Get requests `path` from fairplex, returning the name of the backend that
+// served it ("" if none did) and the final status code.
+func (h *Harness) Get(path string) (string, int) {
+	h.t.Helper()
+	resp, err := h.Client.Get(h.URL(path))
+	if err != nil {
+		h.t.Fatalf("GET %v: %v", path, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.Header.Get(BackendHeader), resp.StatusCode
+}
+
+// Distribution requests `n` distinct paths and counts the requests each
+// backend served, by name.
+func (h *Harness) Distribution(n int) map[string]int {
+	h.t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		name, _ := h.Get(fmt.Sprintf("/key-%d", i))
+		counts[name]++
+	}
+	return counts
+}
+
+// WaitUntil polls `cond` until it holds or `timeout` passes, failing the
+// test in the latter case. Use it to wait for health checks to notice a
+// Kill or Restore.
+func (h *Harness) WaitUntil(timeout time.Duration, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("condition not met within %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (h *Harness) close() {
+	h.Server.Close()
+	h.Fairplex.Shutdown()
+	for _, b := range h.Backends {
+		b.Close()
+	}
+}
@@ -0,0 +1,41 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFallbackBackend(t *testing.T) {
+	fallback := newTestBackend(t, "fallback")
+	fallback_url, _ := url.Parse(fallback.URL)
+	tests := []struct {
+		name string;
+		fallback *url.URL;
+		// Whether a server is registered, and whether it's healthy.
+		server bool;
+		healthy bool;
+		want int;
+		body string;
+	}{
+		{name: "empty ring", fallback: fallback_url, want: http.StatusOK, body: "fallback"},
+		{name: "all unhealthy", fallback: fallback_url, server: true, want: http.StatusOK, body: "fallback"},
+		{name: "no fallback", want: http.StatusServiceUnavailable, body: `"reason":"no servers available"`},
+		{name: "healthy server first", fallback: fallback_url, server: true, healthy: true, want: http.StatusOK, body: "server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{Proxy: true, FallbackBackend: tt.fallback}
+			srv := startProxy(t, fairplex)
+			if tt.server {
+				b := register(t, fairplex, newTestBackend(t, "server").URL)
+				b.healthy.Store(tt.healthy)
+			}
+			status, body := send(t, http.MethodGet, srv.URL+"/x", nil)
+			if status != tt.want || !strings.Contains(body, tt.body) {
+				t.Errorf("got %d %q, want %d with %q", status, body, tt.want, tt.body)
+			}
+		})
+	}
+}
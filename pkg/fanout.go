@@ -0,0 +1,42 @@
+package fairplex
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// errCacheMiss is returned for responses ReadFanOut moves on from.
+var errCacheMiss = errors.New("cache miss")
+
+// fansOut reports whether the request is a read ReadFanOut applies to.
+func (fairplex *Fairplex) fansOut(req *http.Request) bool {
+	return fairplex.ReadFanOut > 1 && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+}
+
+// hasNext reports whether a server not in `tried` could take a `method`
+// request for `key`, were the request passed on. Rate limits aren't
+// checked, as that would use up a token.
+func (fairplex *Fairplex) hasNext(key ringKey, tried []*backend, method string) bool {
+	untried := func(s *backend) bool {
+		return !slices.Contains(tried, s) && s.allows(method)
+	}
+	if fairplex.Strategy == StrategyP2C {
+		return fairplex.selectP2C(untried) != nil
+	}
+	return fairplex.selectServer(key, untried) != nil
+}
+
+// isMiss reports whether `resp` is a cache miss, per ReadMissStatuses and
+// ReadMissHeader.
+func (fairplex *Fairplex) isMiss(resp *http.Response) bool {
+	if slices.Contains(fairplex.ReadMissStatuses, resp.StatusCode) {
+		return true
+	}
+	name, value, ok := strings.Cut(fairplex.ReadMissHeader, ":")
+	if !ok {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(resp.Header.Get(strings.TrimSpace(name))), strings.TrimSpace(value))
+}
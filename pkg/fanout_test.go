@@ -0,0 +1,77 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestReadFanOut(t *testing.T) {
+	tests := []struct {
+		name string;
+		method string;
+		fan_out int;
+		// How each server in ring order answers: "hit", "404" or "header".
+		answers []string;
+		code int;
+		body string;
+		asked int;
+	}{
+		{name: "miss then hit", method: http.MethodGet, fan_out: 2, answers: []string{"404", "hit", "hit"}, code: http.StatusOK, body: "1", asked: 2},
+		{name: "header miss then hit", method: http.MethodGet, fan_out: 2, answers: []string{"header", "hit", "hit"}, code: http.StatusOK, body: "1", asked: 2},
+		{name: "hit first", method: http.MethodGet, fan_out: 3, answers: []string{"hit", "hit", "hit"}, code: http.StatusOK, body: "0", asked: 1},
+		{name: "two misses then hit", method: http.MethodGet, fan_out: 3, answers: []string{"404", "header", "hit"}, code: http.StatusOK, body: "2", asked: 3},
+		{name: "last miss relayed", method: http.MethodGet, fan_out: 2, answers: []string{"404", "404", "hit"}, code: http.StatusNotFound, body: "1", asked: 2},
+		{name: "fan out off", method: http.MethodGet, fan_out: 0, answers: []string{"404", "hit", "hit"}, code: http.StatusNotFound, body: "0", asked: 1},
+		{name: "writes not fanned out", method: http.MethodPost, fan_out: 3, answers: []string{"404", "hit", "hit"}, code: http.StatusNotFound, body: "0", asked: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{
+				Proxy: true,
+				KeyHeaders: []string{"X-Key"},
+				ReadFanOut: tt.fan_out,
+				ReadMissStatuses: []int{http.StatusNotFound},
+				ReadMissHeader: "X-Cache: miss",
+			}
+			proxy := startProxy(t, fairplex)
+			// Each server answers as its place in the ring for the key says,
+			// with that place as the body.
+			place := map[string]int{}
+			asked := 0
+			for i := 0; i < 3; i++ {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					asked++
+					n := place["http://"+r.Host]
+					switch tt.answers[n] {
+					case "404":
+						w.WriteHeader(http.StatusNotFound)
+					case "header":
+						w.Header().Set("X-Cache", "MISS")
+					}
+					io.WriteString(w, strconv.Itoa(n))
+				}))
+				t.Cleanup(srv.Close)
+				register(t, fairplex, srv.URL)
+			}
+			key := "key"
+			for i, b := range fairplex.selectServers(saltedKey(fairplex.HashSalt, key), 3, nil) {
+				place[b.url.String()] = i
+			}
+
+			req, _ := http.NewRequest(tt.method, proxy.URL+"/item", nil)
+			req.Header.Set("X-Key", key)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.code || string(body) != tt.body || asked != tt.asked {
+				t.Errorf("got %d from server %q after asking %d, want %d from %q after %d", resp.StatusCode, body, asked, tt.code, tt.body, tt.asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package fairplex_test
+
+import (
+	"testing"
+	"time"
+
+	fairplex "github.com/eu90h/fairplex/pkg"
+	"github.com/eu90h/fairplex/pkg/fairplextest"
+)
+
+func TestHarnessDistribution(t *testing.T) {
+	tests := []struct {
+		name string;
+		fp *fairplex.Fairplex;
+	}{
+		// With the default 4 virtual nodes, the ports the backends happen to
+		// get can leave one with a sliver of the ring.
+		{name: "redirect", fp: &fairplex.Fairplex{LogLevel: "error", VirtualNodes: 100}},
+		{name: "proxy", fp: &fairplex.Fairplex{LogLevel: "error", Proxy: true, VirtualNodes: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := fairplextest.New(t, tt.fp, 4)
+			const requests = 400
+			counts := h.Distribution(requests)
+			total := 0
+			for _, b := range h.Backends {
+				// An even share is 100; consistent hashing keeps it rough.
+				if counts[b.Name] < requests/4/3 {
+					t.Errorf("%v served %d of %d requests: %v", b.Name, counts[b.Name], requests, counts)
+				}
+				total += counts[b.Name]
+			}
+			if total != requests {
+				t.Errorf("backends served %d of %d requests: %v", total, requests, counts)
+			}
+
+			// The same keys go to the same backends.
+			again := h.Distribution(requests)
+			for name, n := range counts {
+				if again[name] != n {
+					t.Errorf("%v served %d requests, then %d", name, n, again[name])
+				}
+			}
+		})
+	}
+}
+
+func TestHarnessFailover(t *testing.T) {
+	h := fairplextest.New(t, &fairplex.Fairplex{LogLevel: "error", Proxy: true}, 3)
+	killed := h.Backends[0]
+	before := h.Distribution(300)
+	if before[killed.Name] == 0 {
+		t.Fatalf("%v served nothing to begin with: %v", killed.Name, before)
+	}
+	killed.Kill()
+
+	// With no health checks, the failed connections alone move its keys,
+	// and no request fails.
+	during := h.Distribution(300)
+	if during[killed.Name] != 0 || during[""] != 0 {
+		t.Fatalf("after killing %v: %v", killed.Name, during)
+	}
+	for name, n := range before {
+		if name != killed.Name && during[name] < n {
+			t.Errorf("%v served %d requests, down from %d", name, during[name], n)
+		}
+	}
+
+	killed.Restore()
+	after := h.Distribution(300)
+	for name, n := range before {
+		if after[name] != n {
+			t.Errorf("after Restore %v served %d requests, want %d as before", name, after[name], n)
+		}
+	}
+}
+
+func TestHarnessHealthChecks(t *testing.T) {
+	// Without failover, requests for a killed backend fail until the health
+	// checker takes it out.
+	fp := &fairplex.Fairplex{LogLevel: "error", Proxy: true, MaxFailoverAttempts: 1, HealthCheckInterval: 20 * time.Millisecond}
+	h := fairplextest.New(t, fp, 3)
+	killed := h.Backends[1]
+	killed.Kill()
+	h.WaitUntil(5*time.Second, func() bool {
+		return h.Distribution(100)[""] == 0
+	})
+	killed.Restore()
+	h.WaitUntil(5*time.Second, func() bool {
+		return h.Distribution(100)[killed.Name] > 0
+	})
+}
@@ -0,0 +1,291 @@
+package fairplex
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The number of consecutive health-check rounds used when FailoverHysteresis is unset.
+const defaultFailoverHysteresis = 3
+
+func (fairplex *Fairplex) failoverHysteresis() int {
+	if fairplex.FailoverHysteresis <= 0 {
+		return defaultFailoverHysteresis
+	}
+	return fairplex.FailoverHysteresis
+}
+
+// The longest time between probes of a down server when
+// HealthCheckMaxBackoff is unset.
+const defaultHealthCheckMaxBackoff = time.Minute
+
+// probeBackoff returns how long to wait before probing a server again after
+// `failed` consecutive failed probes: HealthCheckInterval after the first,
+// doubling with each further failure up to HealthCheckMaxBackoff.
+func (fairplex *Fairplex) probeBackoff(failed int) time.Duration {
+	fairplex.mu.Lock()
+	interval := fairplex.HealthCheckInterval
+	limit := fairplex.HealthCheckMaxBackoff
+	fairplex.mu.Unlock()
+	if limit <= 0 {
+		limit = defaultHealthCheckMaxBackoff
+	}
+	limit = max(limit, interval)
+
+	backoff := interval
+	for i := 1; i < failed && backoff < limit; i++ {
+		backoff *= 2
+	}
+	return min(backoff, limit)
+}
+
+// startHealthChecks probes every server each HealthCheckInterval until
+// fairplex.stopHealth is closed. It does nothing if the interval is zero.
+func (fairplex *Fairplex) startHealthChecks() {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	if fairplex.HealthCheckInterval <= 0 || fairplex.stopHealth != nil {
+		return
+	}
+	stop := make(chan struct{})
+	fairplex.stopHealth = stop
+
+	go func() {
+		for {
+			fairplex.mu.Lock()
+			interval := fairplex.HealthCheckInterval
+			fairplex.mu.Unlock()
+
+			select {
+			case <-time.After(interval):
+				fairplex.checkHealth()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopHealthChecks stops the health checker, if it's running.
+func (fairplex *Fairplex) stopHealthChecks() {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	if fairplex.stopHealth != nil {
+		close(fairplex.stopHealth)
+		fairplex.stopHealth = nil
+	}
+}
+
+// checkHealth probes every registered server once, updating its health, and
+// then decides which pool should be active.
+func (fairplex *Fairplex) checkHealth() {
+	fairplex.mu.Lock()
+	backends := make([]*backend, 0, len(fairplex.backends))
+	for _, b := range fairplex.backends {
+		backends = append(backends, b)
+	}
+	fairplex.mu.Unlock()
+
+	fairplex.probing.Lock()
+	defer fairplex.probing.Unlock()
+
+	var primary, standby poolHealth
+	now := time.Now()
+	for _, b := range backends {
+		pool := &primary
+		if b.standby {
+			pool = &standby
+		}
+		if !isTCP(b) {
+			pool.hasHTTP = true
+		}
+		if !b.healthy.Load() && now.Before(b.nextProbe) {
+			// Still down, and backing off.
+			continue
+		}
+		if fairplex.probe(b, now) != nil {
+			continue
+		}
+		if isTCP(b) {
+			pool.tcp++
+		} else {
+			pool.http++
+		}
+	}
+
+	fairplex.updateActivePool(primary.healthy(), standby.healthy())
+}
+
+// poolHealth counts the healthy servers of a pool in one round of checks.
+type poolHealth struct {
+	http int;
+	tcp int;
+	// Whether the pool has any http servers, healthy or not.
+	hasHTTP bool;
+}
+
+// healthy returns the number of healthy servers the pool is judged by: its
+// http servers, so a healthy tcp server can't keep HTTP traffic from
+// failing over, or its tcp servers if it has only those, as when RunTCP
+// balances tcp servers alone.
+func (p poolHealth) healthy() int {
+	if p.hasHTTP {
+		return p.http
+	}
+	return p.tcp
+}
+
+// probe checks the health of `b` at `now`, updating its state, and returns
+// why it's unhealthy, or nil if it's healthy. Callers must hold
+// fairplex.probing.
+func (fairplex *Fairplex) probe(b *backend, now time.Time) error {
+	err := fairplex.checkAddr(b.url.String())
+	healthy := err == nil
+	if healthy {
+		b.failedProbes.Store(0)
+	} else {
+		failed := b.failedProbes.Add(1)
+		b.nextProbe = now.Add(fairplex.probeBackoff(int(failed)))
+	}
+	if b.healthy.Swap(healthy) != healthy {
+		if healthy {
+			infof("server %v is healthy again\n", b.url.String())
+			if fairplex.SlowStartDuration > 0 {
+				fairplex.mu.Lock()
+				fairplex.startWarmUp(b)
+				fairplex.mu.Unlock()
+			}
+		} else {
+			errorf("server %v failed its health check: %v\n", b.url.String(), err)
+		}
+	}
+	return err
+}
+
+// prewarm requests the /ping of `b` over the transport its requests are
+// proxied with, leaving an idle connection behind for the first of them.
+func (fairplex *Fairplex) prewarm(b *backend) {
+	method := fairplex.HealthCheckMethod
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, b.url.JoinPath("/ping").String(), nil)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	resp, err := b.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		debugf("couldn't prewarm a connection to %v: %v\n", b.url.String(), err)
+		return
+	}
+	// The connection is only put back once the body's been read.
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHealthCheckBody))
+	resp.Body.Close()
+	debugf("prewarmed a connection to %v\n", b.url.String())
+}
+
+// checkHandler serves POST /servers/check, probing every server, or just
+// the one in `addr`, right away rather than at the next health check, and
+// returning their health. Servers that are down are probed even if they're
+// backing off. Which pool is active is left to the health checker.
+func (fairplex *Fairplex) checkHandler(c *gin.Context) {
+	addr := c.Request.FormValue("addr")
+	backends := fairplex.sortedBackends()
+	if addr != "" {
+		u, err := url.Parse(addr)
+		i := -1
+		if err == nil {
+			normalizeURL(u)
+			i = slices.IndexFunc(backends, func(b *backend) bool { return b.url.String() == u.String() })
+		}
+		if i < 0 {
+			c.JSON(http.StatusNotFound, gin.H{"status": "error", "reason": "server not registered"})
+			return
+		}
+		backends = backends[i : i+1]
+	}
+
+	fairplex.probing.Lock()
+	defer fairplex.probing.Unlock()
+
+	now := time.Now()
+	servers := make([]gin.H, 0, len(backends))
+	for _, b := range backends {
+		server := gin.H{"url": b.url.String(), "healthy": true}
+		if err := fairplex.probe(b, now); err != nil {
+			server["healthy"] = false
+			server["reason"] = err.(*addrError).reason
+			server["detail"] = err.Error()
+		}
+		servers = append(servers, server)
+	}
+	c.JSON(http.StatusOK, servers)
+}
+
+// updateActivePool fails the ring over to the standby pool once the primary
+// pool has had no healthy servers for FailoverHysteresis consecutive rounds,
+// and back once it has had some for as many rounds. This keeps a single
+// flapping primary server from bouncing traffic between pools.
+func (fairplex *Fairplex) updateActivePool(primary_healthy, standby_healthy int) {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	if primary_healthy == 0 {
+		fairplex.primaryDownRounds++
+		fairplex.primaryUpRounds = 0
+	} else {
+		fairplex.primaryUpRounds++
+		fairplex.primaryDownRounds = 0
+	}
+
+	hysteresis := fairplex.failoverHysteresis()
+	if !fairplex.standbyActive && fairplex.primaryDownRounds >= hysteresis && standby_healthy > 0 {
+		fairplex.standbyActive = true
+		errorf("primary pool is down, failing over to the standby pool\n")
+	} else if fairplex.standbyActive && fairplex.primaryUpRounds >= hysteresis {
+		fairplex.standbyActive = false
+		infof("primary pool is back, failing back from the standby pool\n")
+	}
+}
+
+// ringHealth returns the number of healthy servers and of virtual nodes on
+// both rings, for GET /ping.
+func (fairplex *Fairplex) ringHealth() (int, int) {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	healthy := 0
+	for _, b := range fairplex.backends {
+		if b.healthy.Load() {
+			healthy++
+		}
+	}
+	ring_size := 0
+	for _, r := range []*ring{fairplex.ring, fairplex.standbyRing} {
+		if r != nil {
+			ring_size += len(r.nodes)
+		}
+	}
+	return healthy, ring_size
+}
+
+// activePool names the pool currently receiving traffic.
+func (fairplex *Fairplex) activePool() string {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	if fairplex.standbyActive {
+		return "standby"
+	}
+	return "primary"
+}
@@ -0,0 +1,210 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRedirectingBackend starts a server whose /ping redirects to /login,
+// which answers "pong".
+func newRedirectingBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		io.WriteString(w, "pong")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestHealthCheckRedirects(t *testing.T) {
+	redirecting := newRedirectingBackend(t)
+	tests := []struct {
+		follow bool;
+		register int;
+		healthy bool;
+	}{
+		{follow: false, register: http.StatusNotAcceptable, healthy: false},
+		{follow: true, register: http.StatusOK, healthy: true},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{HealthCheckFollowRedirects: tt.follow}
+		r := fairplex.SetupRouter()
+		w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {redirecting.URL}})
+		if w.Code != tt.register {
+			t.Errorf("follow %v: registering got %d, want %d: %v", tt.follow, w.Code, tt.register, w.Body)
+		}
+
+		// A server registered before it started redirecting is judged the same way.
+		b := register(t, fairplex, redirecting.URL)
+		fairplex.checkHealth()
+		if b.healthy.Load() != tt.healthy {
+			t.Errorf("follow %v: healthy is %v, want %v", tt.follow, b.healthy.Load(), tt.healthy)
+		}
+	}
+}
+
+func TestHealthCheckMethod(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	tests := []struct {
+		method string;
+		register int;
+		healthy bool;
+	}{
+		{method: "", register: http.StatusNotAcceptable, healthy: false},
+		{method: http.MethodHead, register: http.StatusOK, healthy: true},
+	}
+	for _, tt := range tests {
+		methods = nil
+		fairplex := &Fairplex{HealthCheckMethod: tt.method}
+		r := fairplex.SetupRouter()
+		w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {srv.URL}})
+		if w.Code != tt.register {
+			t.Errorf("method %q: registering got %d, want %d: %v", tt.method, w.Code, tt.register, w.Body)
+		}
+
+		b := register(t, fairplex, srv.URL)
+		fairplex.checkHealth()
+		if b.healthy.Load() != tt.healthy {
+			t.Errorf("method %q: healthy is %v, want %v", tt.method, b.healthy.Load(), tt.healthy)
+		}
+		want := tt.method
+		if want == "" {
+			want = http.MethodGet
+		}
+		if len(methods) != 2 {
+			t.Errorf("method %q: server was checked %d times, want 2", tt.method, len(methods))
+		}
+		for _, m := range methods {
+			if m != want {
+				t.Errorf("method %q: server was checked with %v", tt.method, m)
+			}
+		}
+	}
+}
+
+func TestProbeBackoff(t *testing.T) {
+	fairplex := &Fairplex{HealthCheckInterval: time.Second, HealthCheckMaxBackoff: 10 * time.Second}
+	tests := []struct {
+		failed int;
+		want time.Duration;
+	}{
+		{failed: 1, want: time.Second},
+		{failed: 2, want: 2 * time.Second},
+		{failed: 3, want: 4 * time.Second},
+		{failed: 4, want: 8 * time.Second},
+		{failed: 5, want: 10 * time.Second},
+		{failed: 100, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := fairplex.probeBackoff(tt.failed); got != tt.want {
+			t.Errorf("after %d failures: %v, want %v", tt.failed, got, tt.want)
+		}
+	}
+}
+
+func TestDownServerProbedLessOften(t *testing.T) {
+	var mu sync.Mutex
+	var probes []time.Time
+	var up atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		probes = append(probes, time.Now())
+		mu.Unlock()
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "pong")
+	}))
+	t.Cleanup(srv.Close)
+	gaps := func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		var gaps []time.Duration
+		for i := 1; i < len(probes); i++ {
+			gaps = append(gaps, probes[i].Sub(probes[i-1]))
+		}
+		probes = nil
+		return gaps
+	}
+
+	fairplex := &Fairplex{HealthCheckInterval: 20 * time.Millisecond, HealthCheckMaxBackoff: 160 * time.Millisecond}
+	fairplex.SetupRouter()
+	t.Cleanup(fairplex.stopHealthChecks)
+	register(t, fairplex, srv.URL)
+	time.Sleep(time.Second)
+
+	// 20ms, 40ms, 80ms, then 160ms from there on, give or take a tick.
+	down := gaps()
+	if len(down) < 4 {
+		t.Fatalf("down server probed %d times in a second, want at least 5", len(down)+1)
+	}
+	if down[0] > 60*time.Millisecond {
+		t.Errorf("first retry after %v, want about 20ms", down[0])
+	}
+	for _, gap := range down[len(down)-2:] {
+		if gap < 140*time.Millisecond || gap > 300*time.Millisecond {
+			t.Errorf("probes of a long-down server %v apart, want about 160ms: %v", gap, down)
+		}
+	}
+
+	// Once it's back up it's probed every interval again.
+	up.Store(true)
+	time.Sleep(200 * time.Millisecond)
+	gaps()
+	time.Sleep(200 * time.Millisecond)
+	for _, gap := range gaps() {
+		if gap > 60*time.Millisecond {
+			t.Errorf("healthy server probes %v apart, want about 20ms", gap)
+		}
+	}
+}
+
+func TestHealthCheckExpectBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"status":"ok","version":"1.2"}`)
+	}))
+	t.Cleanup(srv.Close)
+	tests := []struct {
+		expect string;
+		register int;
+		healthy bool;
+	}{
+		{expect: "", register: http.StatusOK, healthy: true},
+		{expect: `"status":"ok"`, register: http.StatusOK, healthy: true},
+		{expect: `"version":"1.2"`, register: http.StatusOK, healthy: true},
+		{expect: `"version":"1.3"`, register: http.StatusNotAcceptable, healthy: false},
+		{expect: "pong", register: http.StatusNotAcceptable, healthy: false},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{HealthCheckExpectBody: tt.expect}
+		r := fairplex.SetupRouter()
+		w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {srv.URL}})
+		if w.Code != tt.register {
+			t.Errorf("expecting %q: registering got %d, want %d: %v", tt.expect, w.Code, tt.register, w.Body)
+		}
+
+		b := register(t, fairplex, srv.URL)
+		fairplex.checkHealth()
+		if b.healthy.Load() != tt.healthy {
+			t.Errorf("expecting %q: healthy is %v, want %v", tt.expect, b.healthy.Load(), tt.healthy)
+		}
+	}
+}
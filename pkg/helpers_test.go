@@ -0,0 +1,125 @@
+package fairplex
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	// Recovery reports the ReverseProxy aborting a response cut off midway.
+	gin.DefaultErrorWriter = io.Discard
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestBackend starts a server that answers /ping with "pong", as the
+// registration probe expects, and every other path with `name`.
+func newTestBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			io.WriteString(w, "pong")
+			return
+		}
+		w.Header().Set("X-Backend", name)
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// register adds the server `addr` to the primary pool without probing it.
+func register(t *testing.T, fairplex *Fairplex, addr string) *backend {
+	t.Helper()
+	u, err := parseServerURL(addr)
+	if err != nil {
+		t.Fatalf("parsing %v: %v", addr, err)
+	}
+	b := newBackend(u, false)
+	fairplex.addServer(b)
+	return b
+}
+
+// serve sends a request to `h` and returns the recorded response.
+func serve(h http.Handler, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, body))
+	return w
+}
+
+// deadAddr returns the address of a server that has been shut down, so
+// connecting to it fails.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+// keyFor returns a hash key that the ring places on `b`, for requests
+// hashed on a KeyHeaders header.
+func keyFor(t *testing.T, fairplex *Fairplex, b *backend) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if fairplex.selectServer(saltedKey(fairplex.HashSalt, key), nil) == b {
+			return key
+		}
+	}
+	t.Fatalf("no key maps to %v", b.url)
+	return ""
+}
+
+// startProxy serves `fairplex` on a test server. Proxied requests need a
+// real connection, since the ReverseProxy doesn't work with a recorder.
+func startProxy(t *testing.T, fairplex *Fairplex) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(fairplex.SetupRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// send makes a request to `target` and returns its status and body.
+func send(t *testing.T, method, target string, body io.Reader) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+// serveForm sends `form` to `h` as a form, the way servers are registered.
+func serveForm(h http.Handler, method, target string, form url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// postServer registers a server through POST /servers with `form`, which
+// probes it first.
+func postServer(t *testing.T, h http.Handler, form url.Values) {
+	t.Helper()
+	if w := serveForm(h, http.MethodPost, "/servers", form); w.Code != http.StatusOK {
+		t.Fatalf("registering %v: got %d: %v", form, w.Code, w.Body)
+	}
+}
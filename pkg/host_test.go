@@ -0,0 +1,79 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPreserveHost(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string]string{}
+	start_backend := func() *httptest.Server {
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen[srv.URL] = r.Host
+			mu.Unlock()
+			io.WriteString(w, "ok")
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	a, b := start_backend(), start_backend()
+
+	tests := []struct {
+		name string;
+		preserve bool;
+		method string;
+		replicas int;
+	}{
+		{name: "rewritten", method: http.MethodGet, replicas: 1},
+		{name: "preserved", preserve: true, method: http.MethodGet, replicas: 1},
+		{name: "rewritten replicated write", method: http.MethodPost, replicas: 2},
+		{name: "preserved replicated write", preserve: true, method: http.MethodPost, replicas: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clear(seen)
+			mu.Unlock()
+			fairplex := &Fairplex{Proxy: true, PreserveHost: tt.preserve, ReplicationFactor: tt.replicas}
+			proxy := startProxy(t, fairplex)
+			register(t, fairplex, a.URL)
+			register(t, fairplex, b.URL)
+
+			req, err := http.NewRequest(tt.method, proxy.URL+"/items", strings.NewReader("item"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "app.example.com"
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got %d, want 200", resp.StatusCode)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(seen) != tt.replicas {
+				t.Fatalf("reached %d servers, want %d", len(seen), tt.replicas)
+			}
+			for server, host := range seen {
+				want := strings.TrimPrefix(server, "http://")
+				if tt.preserve {
+					want = "app.example.com"
+				}
+				if host != want {
+					t.Errorf("%v got Host %q, want %q", server, host, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package fairplex
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseServerURLIPv6(t *testing.T) {
+	tests := []struct {
+		addr string;
+		want string;
+		err string;
+	}{
+		{addr: "http://[::1]:8080", want: "http://[::1]:8080"},
+		{addr: "http://[0:0::1]:8080/", want: "http://[::1]:8080"},
+		{addr: "http://[2001:DB8::1]", want: "http://[2001:db8::1]"},
+		{addr: "http://[2001:db8::1]:80", want: "http://[2001:db8::1]"},
+		{addr: "tcp://[::1]:5432", want: "tcp://[::1]:5432"},
+		{addr: "http://user:pass@[::1]:8080", want: "http://user:pass@[::1]:8080"},
+		{addr: "http://::1:8080", err: "must be in brackets"},
+		{addr: "http://2001:db8::1/users", err: "must be in brackets"},
+		{addr: "http://fe80::1%25eth0:8080", err: "must be in brackets"},
+	}
+	for _, tt := range tests {
+		u, err := parseServerURL(tt.addr)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseServerURL(%q): %v, want an error containing %q", tt.addr, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || u.String() != tt.want {
+			t.Errorf("parseServerURL(%q) = %v, %v, want %v", tt.addr, u, err, tt.want)
+		}
+	}
+}
+
+// listenIPv6 listens on the IPv6 loopback address, skipping the test if the
+// host has none.
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return ln
+}
+
+func TestIPv6EndToEnd(t *testing.T) {
+	var client string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			io.WriteString(w, "pong")
+			return
+		}
+		client = r.Header.Get("X-Forwarded-For")
+		io.WriteString(w, r.URL.Path)
+	}))
+	srv.Listener.Close()
+	srv.Listener = listenIPv6(t)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		proxy bool;
+	}{
+		{proxy: false},
+		{proxy: true},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: tt.proxy}
+		proxy := httptest.NewUnstartedServer(fairplex.SetupRouter())
+		proxy.Listener.Close()
+		proxy.Listener = listenIPv6(t)
+		proxy.Start()
+		t.Cleanup(proxy.Close)
+		postServer(t, proxy.Config.Handler, url.Values{"addr": {srv.URL}})
+
+		if !tt.proxy {
+			client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			}}
+			resp, err := client.Get(proxy.URL + "/users")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("Location"); got != srv.URL+"/users" {
+				t.Errorf("redirected to %q, want %q", got, srv.URL+"/users")
+			}
+			continue
+		}
+		code, body := send(t, http.MethodGet, proxy.URL+"/users", nil)
+		if code != http.StatusOK || body != "/users" {
+			t.Errorf("proxied request got %d %q, want 200 /users", code, body)
+		}
+		if client != "::1" {
+			t.Errorf("server saw the client as %q, want ::1", client)
+		}
+	}
+}
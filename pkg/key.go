@@ -0,0 +1,67 @@
+package fairplex
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The separator between header values in a KeyHeaders hash key when
+// KeyHeaderSeparator is unset.
+const defaultKeyHeaderSeparator = "|"
+
+// KeyFallback is what stands in for a header of KeyHeaders that a request
+// doesn't have.
+type KeyFallback int
+
+const (
+	// KeyFallbackClient uses the client's IP (or certificate subject, with
+	// ClientCertIdentity), so a client missing a header still keeps to the
+	// same server. This is the default.
+	KeyFallbackClient KeyFallback = iota
+	// KeyFallbackPath uses the request's path, so requests for the same
+	// path missing a header go to the same server whichever client sends
+	// them.
+	KeyFallbackPath
+	// KeyFallbackEmpty uses nothing, so every request missing a header is
+	// hashed by the headers it does have alone.
+	KeyFallbackEmpty
+)
+
+func (f KeyFallback) String() string {
+	switch f {
+	case KeyFallbackClient:
+		return "client"
+	case KeyFallbackPath:
+		return "path"
+	case KeyFallbackEmpty:
+		return "empty"
+	}
+	return fmt.Sprintf("KeyFallback(%d)", int(f))
+}
+
+// hashKey returns the string hashed to place `req` for `path` on the ring:
+// the values of KeyHeaders if set, or else the client and routingKey.
+func (fairplex *Fairplex) hashKey(req *http.Request, path string) string {
+	if len(fairplex.KeyHeaders) == 0 {
+		return fairplex.clientID(req) + fairplex.routingKey(path, req.URL)
+	}
+	separator := fairplex.KeyHeaderSeparator
+	if separator == "" {
+		separator = defaultKeyHeaderSeparator
+	}
+	values := make([]string, len(fairplex.KeyHeaders))
+	for i, name := range fairplex.KeyHeaders {
+		values[i] = req.Header.Get(name)
+		if values[i] != "" {
+			continue
+		}
+		switch fairplex.KeyHeaderFallback {
+		case KeyFallbackClient:
+			values[i] = fairplex.clientID(req)
+		case KeyFallbackPath:
+			values[i] = path
+		}
+	}
+	return strings.Join(values, separator)
+}
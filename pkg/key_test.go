@@ -0,0 +1,71 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHashKeyFromHeaders(t *testing.T) {
+	tests := []struct {
+		name string;
+		fallback KeyFallback;
+		separator string;
+		headers map[string]string;
+		key string;
+	}{
+		{name: "all present", headers: map[string]string{"X-Tenant": "acme", "X-Region": "eu"}, key: "acme|eu"},
+		{name: "all present, separator", separator: "/", headers: map[string]string{"X-Tenant": "acme", "X-Region": "eu"}, key: "acme/eu"},
+		{name: "some missing, client", fallback: KeyFallbackClient, headers: map[string]string{"X-Tenant": "acme"}, key: "acme|192.0.2.1"},
+		{name: "some missing, path", fallback: KeyFallbackPath, headers: map[string]string{"X-Region": "eu"}, key: "users|eu"},
+		{name: "some missing, empty", fallback: KeyFallbackEmpty, headers: map[string]string{"X-Tenant": "acme"}, key: "acme|"},
+		{name: "all missing, client", fallback: KeyFallbackClient, key: "192.0.2.1|192.0.2.1"},
+		{name: "all missing, path", fallback: KeyFallbackPath, key: "users|users"},
+		{name: "all missing, empty", fallback: KeyFallbackEmpty, key: "|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{KeyHeaders: []string{"X-Tenant", "X-Region"}, KeyHeaderFallback: tt.fallback, KeyHeaderSeparator: tt.separator}
+			req := httptest.NewRequest(http.MethodGet, "/users?page=2", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := fairplex.hashKey(req, "users"); got != tt.key {
+				t.Errorf("got key %q, want %q", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestRoutingOnHeaders(t *testing.T) {
+	fairplex := &Fairplex{KeyHeaders: []string{"X-Tenant", "X-Region"}, VirtualNodes: 10}
+	r := fairplex.SetupRouter()
+	for _, addr := range []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.4:8080"} {
+		register(t, fairplex, addr)
+	}
+	want := fairplex.selectServer(saltedKey(fairplex.HashSalt, "acme|eu"), nil).url.Host
+
+	// A tenant in a region goes to one server whoever asks and for what.
+	tests := []struct {
+		path string;
+		client string;
+	}{
+		{path: "/users", client: "192.0.2.1:1234"},
+		{path: "/items", client: "192.0.2.1:1234"},
+		{path: "/orders", client: "198.51.100.7:4321"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = tt.client
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Region", "eu")
+		r.ServeHTTP(w, req)
+		location, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusTemporaryRedirect || err != nil || location.Host != want {
+			t.Errorf("GET %v from %v: got %d to %q, want 307 to %v", tt.path, tt.client, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
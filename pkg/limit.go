@@ -0,0 +1,191 @@
+package fairplex
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/didip/tollbooth"
+	"github.com/didip/tollbooth/limiter"
+	"github.com/gin-gonic/gin"
+)
+
+// The rate used in place of a negative RequestsPerMinute.
+const defaultRequestsPerMinute = 100
+
+// checkLimit returns `rpm` if it is usable as a rate limit. Zero is allowed
+// and disables limiting; negative values are logged and replaced with
+// defaultRequestsPerMinute.
+func checkLimit(rpm float64, what string) float64 {
+	if rpm < 0 {
+		errorf("%v is %v, it must not be negative; using %v instead\n", what, rpm, defaultRequestsPerMinute)
+		return defaultRequestsPerMinute
+	}
+	return rpm
+}
+
+// RateLimitResponse is the body of the 429 for rate limited requests to a
+// route, see Fairplex.RateLimitResponses.
+type RateLimitResponse struct {
+	Body string;
+	// Defaults to "application/json; charset=utf-8".
+	ContentType string;
+}
+
+// rateLimitResponse returns the 429 for `c`'s route from
+// RateLimitResponses, or false if it has none.
+func (fairplex *Fairplex) rateLimitResponse(c *gin.Context) (RateLimitResponse, bool) {
+	if len(fairplex.RateLimitResponses) == 0 {
+		return RateLimitResponse{}, false
+	}
+	route := c.FullPath()
+	if route == "/" || route == "/:path" {
+		route = "*"
+	} else {
+		route = strings.TrimPrefix(route, fairplex.AdminPrefix)
+	}
+	resp, ok := fairplex.RateLimitResponses[c.Request.Method+" "+route]
+	if !ok {
+		resp, ok = fairplex.RateLimitResponses[route]
+	}
+	if ok && resp.ContentType == "" {
+		resp.ContentType = "application/json; charset=utf-8"
+	}
+	return resp, ok
+}
+
+// newLimiter creates a limiter allowing `rpm` requests a minute with
+// fairplex's standard JSON rejection message.
+func newLimiter(rpm float64) *limiter.Limiter {
+	lmt := tollbooth.NewLimiter(rpm/60, &limiter.ExpirableOptions{DefaultExpirationTTL: time.Minute})
+	lmt.SetBurst(int(math.Max(1, rpm)))
+	lmt.SetMessage(`{"error": "too many requests"}`)
+	lmt.SetMessageContentType("application/json; charset=utf-8")
+	return lmt
+}
+
+// newMethodLimiter creates a limiter allowing `rpm` requests of `method`.
+func newMethodLimiter(method string, rpm float64) *limiter.Limiter {
+	return newLimiter(rpm).SetMethods([]string{method})
+}
+
+// setLimit changes the rate of `lmt` to `rpm` requests a minute. tollbooth
+// counts its max per second, so the bucket refills at rpm/60 a second and
+// holds up to a minute's worth of requests. Only token buckets created
+// after this point see the new rate; existing ones are replaced as they
+// expire.
+func setLimit(lmt *limiter.Limiter, rpm float64) {
+	lmt.SetMax(rpm / 60).SetBurst(int(math.Max(1, rpm)))
+}
+
+// setupLimiters creates the default limiter and one per client class and method.
+func (fairplex *Fairplex) setupLimiters() {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	fairplex.RequestsPerMinute = checkLimit(fairplex.RequestsPerMinute, "RequestsPerMinute")
+	fairplex.limiter = newLimiter(fairplex.RequestsPerMinute)
+	fairplex.classLimiters = make(map[string]*limiter.Limiter)
+	for class, rpm := range fairplex.ClassRequestsPerMinute {
+		rpm = checkLimit(rpm, "requests per minute for class "+class)
+		fairplex.ClassRequestsPerMinute[class] = rpm
+		fairplex.classLimiters[class] = newLimiter(rpm)
+	}
+	fairplex.methodLimiters = make(map[string]*limiter.Limiter)
+	fairplex.setMethodLimits(fairplex.MethodRequestsPerMinute)
+}
+
+// setClassLimits replaces the per-class limits, adjusting the limiters of
+// classes that still exist and creating or dropping the rest.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) setClassLimits(limits map[string]float64) {
+	fairplex.ClassRequestsPerMinute = limits
+	if fairplex.classLimiters == nil {
+		return
+	}
+	for class := range fairplex.classLimiters {
+		if _, ok := limits[class]; !ok {
+			delete(fairplex.classLimiters, class)
+		}
+	}
+	for class, rpm := range limits {
+		rpm = checkLimit(rpm, "requests per minute for class "+class)
+		limits[class] = rpm
+		if lmt, ok := fairplex.classLimiters[class]; ok {
+			setLimit(lmt, rpm)
+		} else {
+			fairplex.classLimiters[class] = newLimiter(rpm)
+		}
+	}
+}
+
+// setMethodLimits replaces the per-method limits, adjusting the limiters of
+// methods that still have a limit and creating or dropping the rest.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) setMethodLimits(limits map[string]float64) {
+	normalized := make(map[string]float64, len(limits))
+	for method, rpm := range limits {
+		normalized[strings.ToUpper(method)] = checkLimit(rpm, "requests per minute for "+method)
+	}
+	fairplex.MethodRequestsPerMinute = normalized
+	if fairplex.methodLimiters == nil {
+		return
+	}
+	for method := range fairplex.methodLimiters {
+		if _, ok := normalized[method]; !ok {
+			delete(fairplex.methodLimiters, method)
+		}
+	}
+	for method, rpm := range normalized {
+		if lmt, ok := fairplex.methodLimiters[method]; ok {
+			setLimit(lmt, rpm)
+		} else {
+			fairplex.methodLimiters[method] = newMethodLimiter(method, rpm)
+		}
+	}
+}
+
+// limitersFor returns the limiters the request must pass: the one for its
+// client class (or the default limiter for unknown or missing classes),
+// and the one for its method if it has a limit of its own.
+func (fairplex *Fairplex) limitersFor(c *gin.Context) []*limiter.Limiter {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	lmt := fairplex.limiter
+	if fairplex.ClassHeader != "" {
+		if class_lmt, ok := fairplex.classLimiters[c.GetHeader(fairplex.ClassHeader)]; ok {
+			lmt = class_lmt
+		}
+	}
+	if method_lmt, ok := fairplex.methodLimiters[c.Request.Method]; ok {
+		return []*limiter.Limiter{lmt, method_lmt}
+	}
+	return []*limiter.Limiter{lmt}
+}
+
+// limitHandler rate-limits the request with the limiters of its client
+// class and method, counting rejections in the stats. A limit of zero lets
+// every request through. It runs on every route, admin and balanced alike,
+// and counts a client's requests together whatever their path, so a client
+// can't get around its limit by varying the path.
+func (fairplex *Fairplex) limitHandler(c *gin.Context) {
+	client := []string{fairplex.clientID(c.Request)}
+	for _, lmt := range fairplex.limitersFor(c) {
+		if lmt.GetMax() == 0 {
+			continue
+		}
+		httpError := tollbooth.LimitByKeys(lmt, client)
+		if httpError != nil {
+			fairplex.stats.recordRateLimited(client[0])
+			if resp, ok := fairplex.rateLimitResponse(c); ok {
+				c.Data(httpError.StatusCode, resp.ContentType, []byte(resp.Body))
+			} else {
+				c.Data(httpError.StatusCode, lmt.GetMessageContentType(), []byte(httpError.Message))
+			}
+			c.Abort()
+			return
+		}
+	}
+	c.Next()
+}
@@ -0,0 +1,223 @@
+package fairplex
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewLimiterRate(t *testing.T) {
+	tests := []struct {
+		rpm float64;
+		max float64;
+		burst int;
+	}{
+		{rpm: 0, max: 0, burst: 1},
+		{rpm: 30, max: 0.5, burst: 30},
+		{rpm: 60, max: 1, burst: 60},
+		{rpm: 600, max: 10, burst: 600},
+	}
+	for _, tt := range tests {
+		lmt := newLimiter(tt.rpm)
+		if lmt.GetMax() != tt.max || lmt.GetBurst() != tt.burst {
+			t.Errorf("newLimiter(%v): max %v, burst %v; want %v, %v", tt.rpm, lmt.GetMax(), lmt.GetBurst(), tt.max, tt.burst)
+		}
+		setLimit(lmt, tt.rpm*2)
+		if lmt.GetMax() != tt.max*2 {
+			t.Errorf("setLimit(%v): max %v, want %v", tt.rpm*2, lmt.GetMax(), tt.max*2)
+		}
+	}
+}
+
+func TestRequestsPerMinute(t *testing.T) {
+	fairplex := &Fairplex{RequestsPerMinute: 60}
+	r := fairplex.SetupRouter()
+	for i := 0; i < 60; i++ {
+		if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d, want 200", i+1, w.Code)
+		}
+	}
+	if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request 61: got %d, want 429", w.Code)
+	}
+	// At 60 a minute a token comes back every second, not every 1/60s.
+	time.Sleep(100 * time.Millisecond)
+	if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request after 100ms: got %d, want 429", w.Code)
+	}
+}
+
+func TestClassAndMethodLimits(t *testing.T) {
+	fairplex := &Fairplex{
+		RequestsPerMinute: 1000,
+		ClassHeader: "X-Plan",
+		ClassRequestsPerMinute: map[string]float64{"free": 2},
+		MethodRequestsPerMinute: map[string]float64{"delete": 3},
+	}
+	r := fairplex.SetupRouter()
+	tests := []struct {
+		name string;
+		method string;
+		class string;
+		client string;
+		allowed int;
+	}{
+		{name: "class", method: http.MethodGet, class: "free", client: "192.0.2.10:1234", allowed: 2},
+		{name: "method", method: http.MethodDelete, client: "192.0.2.11:1234", allowed: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send := func() int {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(tt.method, "/servers", nil)
+				req.RemoteAddr = tt.client
+				if tt.class != "" {
+					req.Header.Set("X-Plan", tt.class)
+				}
+				r.ServeHTTP(w, req)
+				return w.Code
+			}
+			for i := 0; i < tt.allowed; i++ {
+				if code := send(); code == http.StatusTooManyRequests {
+					t.Fatalf("request %d was rate limited", i+1)
+				}
+			}
+			if code := send(); code != http.StatusTooManyRequests {
+				t.Fatalf("request %d: got %d, want 429", tt.allowed+1, code)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if code := send(); code != http.StatusTooManyRequests {
+				t.Fatalf("request after 100ms: got %d, want 429", code)
+			}
+		})
+	}
+
+	// Reloaded limits keep counting per minute.
+	fairplex.mu.Lock()
+	fairplex.setMethodLimits(map[string]float64{"DELETE": 120})
+	got := fairplex.methodLimiters[http.MethodDelete].GetMax()
+	fairplex.mu.Unlock()
+	if got != 2 {
+		t.Errorf("DELETE limiter max after setMethodLimits is %v, want 2 a second", got)
+	}
+}
+
+func TestRequestsPerMinuteValues(t *testing.T) {
+	tests := []struct {
+		name string;
+		rpm float64;
+		allowed int;
+		invalid bool;
+	}{
+		{name: "negative", rpm: -5, invalid: true},
+		{name: "zero disables limiting", rpm: 0, allowed: 200},
+		{name: "positive", rpm: 5, allowed: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{RequestsPerMinute: tt.rpm}
+			if tt.invalid {
+				if fairplex.Validate() == nil {
+					t.Fatal("Validate passed")
+				}
+				return
+			}
+			r := fairplex.SetupRouter()
+			for i := 0; i < tt.allowed; i++ {
+				if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusOK {
+					t.Fatalf("request %d: got %d, want 200", i+1, w.Code)
+				}
+			}
+			if tt.rpm == 0 {
+				return
+			}
+			w := serve(r, http.MethodGet, "/ping", nil)
+			if w.Code != http.StatusTooManyRequests || w.Body.String() != `{"error": "too many requests"}` {
+				t.Errorf("request %d: got %d %q, want 429", tt.allowed+1, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestDataPlaneRateLimited(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	tests := []struct {
+		method string;
+		path string;
+	}{
+		{method: http.MethodGet, path: "/users"},
+		{method: http.MethodPost, path: "/items"},
+		{method: http.MethodDelete, path: "/items"},
+		{method: http.MethodGet, path: "/"},
+		{method: http.MethodGet, path: "/servers"},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{RequestsPerMinute: 3}
+		r := fairplex.SetupRouter()
+		register(t, fairplex, backend.URL)
+		for i := 0; i < 3; i++ {
+			if w := serve(r, tt.method, tt.path, nil); w.Code == http.StatusTooManyRequests {
+				t.Fatalf("%v %v: request %d was rate limited", tt.method, tt.path, i+1)
+			}
+		}
+		if w := serve(r, tt.method, tt.path, nil); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%v %v: request 4 got %d, want 429", tt.method, tt.path, w.Code)
+		}
+	}
+
+	// Varying the path doesn't get a client more requests.
+	fairplex := &Fairplex{RequestsPerMinute: 3}
+	r := fairplex.SetupRouter()
+	register(t, fairplex, backend.URL)
+	for i := 0; i < 3; i++ {
+		serve(r, http.MethodGet, fmt.Sprintf("/path%d", i), nil)
+	}
+	if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a fourth request on another path got %d, want 429", w.Code)
+	}
+}
+
+func TestRateLimitResponses(t *testing.T) {
+	fairplex := &Fairplex{
+		RequestsPerMinute: 1,
+		AdminPrefix: "/admin",
+		RateLimitResponses: map[string]RateLimitResponse{
+			"POST /servers": {Body: `{"error": "registering too often"}`},
+			"/servers": {Body: "slow down listing servers", ContentType: "text/plain; charset=utf-8"},
+			"*": {Body: `{"error": "too many requests for the data plane"}`},
+		},
+	}
+	r := fairplex.SetupRouter()
+	tests := []struct {
+		method string;
+		path string;
+		body string;
+		content_type string;
+	}{
+		{method: http.MethodPost, path: "/admin/servers", body: `{"error": "registering too often"}`, content_type: "application/json; charset=utf-8"},
+		{method: http.MethodGet, path: "/admin/servers", body: "slow down listing servers", content_type: "text/plain; charset=utf-8"},
+		{method: http.MethodDelete, path: "/admin/servers", body: "slow down listing servers", content_type: "text/plain; charset=utf-8"},
+		{method: http.MethodGet, path: "/users", body: `{"error": "too many requests for the data plane"}`, content_type: "application/json; charset=utf-8"},
+		{method: http.MethodGet, path: "/", body: `{"error": "too many requests for the data plane"}`, content_type: "application/json; charset=utf-8"},
+		{method: http.MethodGet, path: "/admin/stats", body: `{"error": "too many requests"}`, content_type: "application/json; charset=utf-8"},
+	}
+	for i, tt := range tests {
+		send := func() *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			// A client of its own, so only the second request is limited.
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i+1)
+			r.ServeHTTP(w, req)
+			return w
+		}
+		if w := send(); w.Code == http.StatusTooManyRequests {
+			t.Fatalf("%v %v: first request was rate limited", tt.method, tt.path)
+		}
+		w := send()
+		if w.Code != http.StatusTooManyRequests || w.Body.String() != tt.body || w.Header().Get("Content-Type") != tt.content_type {
+			t.Errorf("%v %v: got %d %q as %v, want 429 %q as %v", tt.method, tt.path, w.Code, w.Body, w.Header().Get("Content-Type"), tt.body, tt.content_type)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	var backend_url string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/absolute":
+			w.Header().Set("Location", backend_url+"/login?next=%2F")
+		case "/relative":
+			w.Header().Set("Location", "/login")
+		case "/elsewhere":
+			w.Header().Set("Location", "http://example.com/login")
+		}
+		w.WriteHeader(http.StatusFound)
+	}))
+	t.Cleanup(srv.Close)
+	backend_url = srv.URL
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	tests := []struct {
+		rewrite bool;
+		path string;
+		want string; // "{proxy}" stands for fairplex's own address
+	}{
+		{rewrite: false, path: "/absolute", want: backend_url + "/login?next=%2F"},
+		{rewrite: true, path: "/absolute", want: "{proxy}/login?next=%2F"},
+		{rewrite: true, path: "/relative", want: "/login"},
+		{rewrite: true, path: "/elsewhere", want: "http://example.com/login"},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Proxy: true, RewriteLocation: tt.rewrite}
+		proxy := startProxy(t, fairplex)
+		register(t, fairplex, srv.URL)
+
+		resp, err := client.Get(proxy.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := strings.Replace(tt.want, "{proxy}", proxy.URL, 1)
+		if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || got != want {
+			t.Errorf("rewrite %v, %v: got %d Location %q, want 302 %q", tt.rewrite, tt.path, resp.StatusCode, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package fairplex
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelError
+)
+
+// The current log level. Messages below this level are dropped.
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(levelInfo)
+}
+
+// setLogLevel sets the log level from its name ("debug", "info" or "error").
+// An empty name selects "info". Unknown names are logged and ignored.
+func setLogLevel(name string) {
+	switch strings.ToLower(name) {
+	case "debug":
+		logLevel.Store(levelDebug)
+	case "", "info":
+		logLevel.Store(levelInfo)
+	case "error":
+		logLevel.Store(levelError)
+	default:
+		log.Printf("unknown log level %q, keeping current level\n", name)
+	}
+}
+
+func debugf(format string, v ...any) {
+	if logLevel.Load() <= levelDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func infof(format string, v ...any) {
+	if logLevel.Load() <= levelInfo {
+		log.Printf(format, v...)
+	}
+}
+
+func errorf(format string, v ...any) {
+	if logLevel.Load() <= levelError {
+		log.Printf(format, v...)
+	}
+}
+
+// Whether the access log only has requests answered with a 4xx or 5xx.
+var accessLogErrors atomic.Bool
+
+// setAccessLog sets which requests are logged from its name ("all" or
+// "errors"). An empty name selects "all". Unknown names are logged and
+// ignored.
+func setAccessLog(name string) {
+	switch strings.ToLower(name) {
+	case "", "all":
+		accessLogErrors.Store(false)
+	case "errors":
+		accessLogErrors.Store(true)
+	default:
+		log.Printf("unknown access log mode %q, keeping current mode\n", name)
+	}
+}
+
+// The fraction of successful requests in the access log, as float64 bits.
+// Zero bits, the default, log every one.
+var accessLogSampleRate atomic.Uint64
+
+// setAccessLogSampleRate sets the fraction of successful requests logged.
+// Zero logs them all. Rates outside 0 to 1 are logged and ignored.
+func setAccessLogSampleRate(rate float64) {
+	if !(rate >= 0 && rate <= 1) {
+		log.Printf("access log sample rate %v isn't between 0 and 1, keeping current rate\n", rate)
+		return
+	}
+	accessLogSampleRate.Store(math.Float64bits(rate))
+}
+
+// sampled reports whether a successful request makes it into the access
+// log, per the sample rate.
+func sampled() bool {
+	rate := math.Float64frombits(accessLogSampleRate.Load())
+	return rate == 0 || rand.Float64() < rate
+}
+
+// formatAccessLog formats a request for gin's logger, like its default
+// formatter without the colours, or skips it if it succeeded and either
+// the access log is only for errors or it wasn't sampled. Errors are always
+// logged.
+func formatAccessLog(param gin.LogFormatterParams) string {
+	if param.StatusCode < 400 && (accessLogErrors.Load() || !sampled()) {
+		return ""
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		param.ErrorMessage,
+	)
+}
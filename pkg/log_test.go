@@ -0,0 +1,95 @@
+package fairplex
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessLogErrorsOnly(t *testing.T) {
+	tests := []struct {
+		mode string;
+		method string;
+		path string;
+		code int;
+		logged bool;
+	}{
+		{mode: "all", method: http.MethodGet, path: "/ping", code: http.StatusOK, logged: true},
+		{mode: "errors", method: http.MethodGet, path: "/ping", code: http.StatusOK, logged: false},
+		{mode: "errors", method: http.MethodGet, path: "/users", code: http.StatusServiceUnavailable, logged: true},
+		{mode: "errors", method: http.MethodGet, path: "/a/b", code: http.StatusNotFound, logged: true},
+		{mode: "errors", method: http.MethodPost, path: "/servers", code: http.StatusBadRequest, logged: true},
+	}
+	t.Cleanup(func() {
+		gin.DefaultWriter = io.Discard
+		setAccessLog("")
+	})
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		// The logger takes its writer when the router is set up.
+		gin.DefaultWriter = &buf
+		fairplex := &Fairplex{AccessLog: tt.mode}
+		r := fairplex.SetupRouter()
+		if w := serve(r, tt.method, tt.path, nil); w.Code != tt.code {
+			t.Fatalf("%v %v: got %d, want %d", tt.method, tt.path, w.Code, tt.code)
+		}
+		logged := strings.Contains(buf.String(), tt.path)
+		if logged != tt.logged {
+			t.Errorf("access log %v, %v %v answered %d: logged %v, want %v (%q)", tt.mode, tt.method, tt.path, tt.code, logged, tt.logged, buf.String())
+		}
+	}
+
+	// Rate limited requests are errors too.
+	var buf bytes.Buffer
+	gin.DefaultWriter = &buf
+	fairplex := &Fairplex{AccessLog: "errors", RequestsPerMinute: 1}
+	r := fairplex.SetupRouter()
+	serve(r, http.MethodGet, "/ping", nil)
+	if buf.Len() != 0 {
+		t.Errorf("allowed request logged: %q", buf.String())
+	}
+	if w := serve(r, http.MethodGet, "/ping", nil); w.Code != http.StatusTooManyRequests || !strings.Contains(buf.String(), "429") {
+		t.Errorf("rate limited request got %d and logged %q, want a logged 429", w.Code, buf.String())
+	}
+}
+
+func TestAccessLogSampleRate(t *testing.T) {
+	const requests = 1000
+	tests := []struct {
+		rate float64;
+		path string;
+		code int;
+		min int;
+		max int;
+	}{
+		{rate: 0, path: "/ping", code: http.StatusOK, min: requests, max: requests},
+		{rate: 1, path: "/ping", code: http.StatusOK, min: requests, max: requests},
+		{rate: 0.25, path: "/ping", code: http.StatusOK, min: 180, max: 320},
+		{rate: 0.05, path: "/ping", code: http.StatusOK, min: 20, max: 85},
+		// Errors are logged whatever the rate.
+		{rate: 0.05, path: "/a/b", code: http.StatusNotFound, min: requests, max: requests},
+	}
+	t.Cleanup(func() {
+		gin.DefaultWriter = io.Discard
+		setAccessLogSampleRate(0)
+	})
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		gin.DefaultWriter = &buf
+		fairplex := &Fairplex{AccessLogSampleRate: tt.rate}
+		r := fairplex.SetupRouter()
+		for i := 0; i < requests; i++ {
+			if w := serve(r, http.MethodGet, tt.path, nil); w.Code != tt.code {
+				t.Fatalf("GET %v: got %d, want %d", tt.path, w.Code, tt.code)
+			}
+		}
+		logged := strings.Count(buf.String(), tt.path)
+		if logged < tt.min || logged > tt.max {
+			t.Errorf("sample rate %v, %d requests answered %d: %d logged, want %d to %d", tt.rate, requests, tt.code, logged, tt.min, tt.max)
+		}
+	}
+}
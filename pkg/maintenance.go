@@ -0,0 +1,101 @@
+package fairplex
+
+import (
+	"fmt"
+	"time"
+)
+
+// parseMaintenance parses the RFC 3339 start and end of a maintenance
+// window. Both are empty for no window; the start may be in the past, for a
+// window that's already under way, but the end must be in the future.
+func parseMaintenance(start, end string, now time.Time) (time.Time, time.Time, error) {
+	if start == "" && end == "" {
+		return time.Time{}, time.Time{}, nil
+	}
+	if start == "" || end == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance_start and maintenance_end must be given together")
+	}
+	from, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance_start must be an RFC 3339 time")
+	}
+	until, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance_end must be an RFC 3339 time")
+	}
+	if !until.After(from) || !until.After(now) {
+		return time.Time{}, time.Time{}, fmt.Errorf("maintenance_end must be after maintenance_start and in the future")
+	}
+	return from, until, nil
+}
+
+// scheduleMaintenance takes `b` out of its ring from `start` until `end`,
+// putting it back afterwards (warming it up, with a SlowStartDuration). It
+// gives up if `b` is removed or replaced in the meantime.
+func (fairplex *Fairplex) scheduleMaintenance(b *backend, start, end time.Time) {
+	go func() {
+		time.Sleep(time.Until(start))
+		fairplex.mu.Lock()
+		if fairplex.backends[b.url.String()] != b {
+			fairplex.mu.Unlock()
+			return
+		}
+		b.maintenance = true
+		b.warmUps++
+		fairplex.setNodes(b, 0)
+		fairplex.mu.Unlock()
+		infof("server %v is down for maintenance until %v\n", b.url.String(), end)
+
+		time.Sleep(time.Until(end))
+		fairplex.mu.Lock()
+		defer fairplex.mu.Unlock()
+		b.maintenance = false
+		if fairplex.backends[b.url.String()] != b {
+			return
+		}
+		if fairplex.SlowStartDuration > 0 {
+			fairplex.startWarmUp(b)
+		} else {
+			fairplex.setNodes(b, fairplex.nodesFor(b))
+		}
+		infof("server %v is back from maintenance\n", b.url.String())
+	}()
+}
+
+// drainAll empties both rings at once, so no server gets any more requests,
+// while leaving every server registered and health checked. Servers
+// registered in the meantime stay out as well. It returns the number of
+// servers drained.
+func (fairplex *Fairplex) drainAll() int {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	fairplex.drained = true
+	for _, b := range fairplex.backends {
+		// Ends any warm-up.
+		b.warmUps++
+		b.nodes = 0
+	}
+	fairplex.ring = newRing(fairplex.HashSalt)
+	fairplex.standbyRing = newRing(fairplex.HashSalt)
+	infof("drained all %v servers\n", len(fairplex.backends))
+	return len(fairplex.backends)
+}
+
+// isDrained reports whether the servers are drained.
+func (fairplex *Fairplex) isDrained() bool {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	return fairplex.drained
+}
+
+// undrainAll puts every server back into its ring at once, with its full
+// share, except those down for maintenance. It returns the number of
+// servers registered.
+func (fairplex *Fairplex) undrainAll() int {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	fairplex.drained = false
+	fairplex.rebuildRingLocked()
+	infof("undrained all %v servers\n", len(fairplex.backends))
+	return len(fairplex.backends)
+}
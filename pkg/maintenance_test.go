@@ -0,0 +1,77 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenance(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		start string;
+		end string;
+		ok bool;
+	}{
+		{start: "", end: "", ok: true},
+		{start: "2024-01-01T13:00:00Z", end: "2024-01-01T14:00:00Z", ok: true},
+		{start: "2024-01-01T11:00:00Z", end: "2024-01-01T13:00:00Z", ok: true},
+		{start: "2024-01-01T13:00:00Z", end: "", ok: false},
+		{start: "", end: "2024-01-01T13:00:00Z", ok: false},
+		{start: "tomorrow", end: "2024-01-01T14:00:00Z", ok: false},
+		{start: "2024-01-01T14:00:00Z", end: "2024-01-01T13:00:00Z", ok: false},
+		{start: "2024-01-01T10:00:00Z", end: "2024-01-01T11:00:00Z", ok: false},
+	}
+	for _, tt := range tests {
+		if _, _, err := parseMaintenance(tt.start, tt.end, now); (err == nil) != tt.ok {
+			t.Errorf("parseMaintenance(%q, %q): %v, want ok %v", tt.start, tt.end, err, tt.ok)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	other := newTestBackend(t, "b")
+	fairplex := &Fairplex{VirtualNodes: 10}
+	r := fairplex.SetupRouter()
+	postServer(t, r, url.Values{"addr": {other.URL}})
+
+	start := time.Now().Add(300 * time.Millisecond)
+	end := start.Add(300 * time.Millisecond)
+	postServer(t, r, url.Values{
+		"addr": {backend.URL},
+		"maintenance_start": {start.Format(time.RFC3339Nano)},
+		"maintenance_end": {end.Format(time.RFC3339Nano)},
+	})
+	nodes := func() int {
+		n := 0
+		for _, node := range fairplex.RingSnapshot() {
+			if node.Server == backend.URL {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		at time.Time;
+		nodes int;
+	}{
+		{at: start.Add(-150 * time.Millisecond), nodes: 10},
+		{at: start.Add(150 * time.Millisecond), nodes: 0},
+		{at: end.Add(150 * time.Millisecond), nodes: 10},
+	}
+	for _, tt := range tests {
+		time.Sleep(time.Until(tt.at))
+		if got := nodes(); got != tt.nodes {
+			t.Errorf("%v after the window's start: server has %d nodes, want %d", tt.at.Sub(start).Round(time.Millisecond), got, tt.nodes)
+		}
+	}
+
+	// Bad windows are refused.
+	w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {backend.URL}, "maintenance_start": {start.Format(time.RFC3339Nano)}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("registering with only maintenance_start: got %d, want 400", w.Code)
+	}
+}
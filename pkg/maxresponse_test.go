@@ -0,0 +1,52 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxResponseBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		body := strings.Repeat("a", n)
+		if r.URL.Query().Get("chunked") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(n))
+			w.Write([]byte(body))
+			return
+		}
+		// Flushing before the end leaves the length unknown.
+		w.Write([]byte(body[:n/2]))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(body[n/2:]))
+	}))
+	t.Cleanup(srv.Close)
+	fairplex := &Fairplex{Proxy: true, MaxResponseBytes: 100}
+	proxy := startProxy(t, fairplex)
+	register(t, fairplex, srv.URL)
+
+	tests := []struct {
+		name string;
+		query string;
+		code int;
+		length int;
+	}{
+		{name: "under", query: "n=10", code: http.StatusOK, length: 10},
+		{name: "at the limit", query: "n=100", code: http.StatusOK, length: 100},
+		{name: "over", query: "n=101", code: http.StatusBadGateway},
+		{name: "unknown length under", query: "n=100&chunked=1", code: http.StatusOK, length: 100},
+		{name: "unknown length over", query: "n=5000&chunked=1", code: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		code, body := send(t, http.MethodGet, proxy.URL+"/data?"+tt.query, nil)
+		if code != tt.code {
+			t.Errorf("%v: got %d, want %d", tt.name, code, tt.code)
+			continue
+		}
+		if tt.code == http.StatusOK && len(body) != tt.length {
+			t.Errorf("%v: got %d bytes, want %d", tt.name, len(body), tt.length)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMethodRouting(t *testing.T) {
+	replica, primary := newTestBackend(t, "replica"), newTestBackend(t, "primary")
+	tests := []struct {
+		name string;
+		servers []url.Values;
+		method string;
+		want int;
+		to string;
+	}{
+		{name: "read to replica", servers: []url.Values{{"addr": {replica.URL}, "methods": {"get,head"}}}, method: http.MethodGet, want: http.StatusTemporaryRedirect, to: replica.URL},
+		{name: "write skips replica", servers: []url.Values{{"addr": {replica.URL}, "methods": {"GET,HEAD"}}, {"addr": {primary.URL}}}, method: http.MethodPost, want: http.StatusTemporaryRedirect, to: primary.URL},
+		{name: "write to read-only pool", servers: []url.Values{{"addr": {replica.URL}, "methods": {"GET,HEAD"}}}, method: http.MethodDelete, want: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{}
+			r := fairplex.SetupRouter()
+			for _, form := range tt.servers {
+				postServer(t, r, form)
+			}
+			// Enough paths that some would land on each server.
+			for i := 0; i < 20; i++ {
+				w := serve(r, tt.method, "/"+strings.Repeat("k", i+1), nil)
+				if w.Code != tt.want {
+					t.Fatalf("got %d, want %d: %v", w.Code, tt.want, w.Body)
+				}
+				if tt.to != "" && !strings.HasPrefix(w.Header().Get("Location"), tt.to) {
+					t.Fatalf("sent to %v, want %v", w.Header().Get("Location"), tt.to)
+				}
+				if tt.want == http.StatusBadGateway && !strings.Contains(w.Body.String(), "no server accepts DELETE requests") {
+					t.Fatalf("got %q", w.Body)
+				}
+			}
+		})
+	}
+}
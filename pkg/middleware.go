@@ -0,0 +1,63 @@
+package fairplex
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// timeoutMiddleware bounds the whole handling of a request, selection and
+// any backend round trips included, by RequestTimeout. Handlers see the
+// deadline through the request context; if it passes before anything was
+// written, the client gets a 504.
+func (fairplex *Fairplex) timeoutMiddleware(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), fairplex.RequestTimeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+		errorf("request for %v timed out after %v\n", c.Request.URL.Path, fairplex.RequestTimeout)
+		c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"status": "error", "reason": "request timed out"})
+	}
+}
+
+// pathLengthMiddleware rejects requests whose path is longer than
+// MaxPathLength with 414 URI Too Long. It runs ahead of the request logger,
+// so an oversized path is neither hashed nor logged.
+func (fairplex *Fairplex) pathLengthMiddleware(c *gin.Context) {
+	if n := len(c.Request.URL.EscapedPath()); n > fairplex.MaxPathLength {
+		errorf("rejected request with a %v byte path from %v\n", n, c.Request.RemoteAddr)
+		c.AbortWithStatusJSON(http.StatusRequestURITooLong, gin.H{"status": "error", "reason": "path too long"})
+	}
+}
+
+// serverListGuard protects GET /servers and the other routes revealing the
+// addresses of every server, such as /stats and /metrics: it answers 404
+// when HideServerList is set and, when ServerListToken is set, requires it
+// as a bearer token.
+func (fairplex *Fairplex) serverListGuard(c *gin.Context) {
+	if fairplex.HideServerList {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"status": "error", "reason": "not found"})
+		return
+	}
+	requireBearer(c, fairplex.ServerListToken)
+}
+
+// requireBearer answers 401 unless the request carries `token` as a bearer
+// token, if `token` is set.
+func requireBearer(c *gin.Context, token string) {
+	if token == "" {
+		return
+	}
+	given, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"status": "error", "reason": "unauthorized"})
+	}
+}
@@ -0,0 +1,49 @@
+package fairplex
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestReregisterName(t *testing.T) {
+	tests := []struct {
+		name string;
+		again url.Values;
+		weight float64;
+		tags []string;
+		limited bool;
+	}{
+		{name: "settings carry over", again: url.Values{}, weight: 2, tags: []string{"canary"}, limited: true},
+		{name: "settings given again", again: url.Values{"weight": {"3"}, "tags": {"stable"}}, weight: 3, tags: []string{"stable"}, limited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{VirtualNodes: 10}
+			r := fairplex.SetupRouter()
+			old, moved := newTestBackend(t, "old"), newTestBackend(t, "moved")
+			postServer(t, r, url.Values{"addr": {old.URL}, "name": {"api"}, "weight": {"2"}, "tags": {"canary"}, "rate": {"5"}})
+			tt.again.Set("addr", moved.URL)
+			tt.again.Set("name", "api")
+			postServer(t, r, tt.again)
+
+			fairplex.mu.Lock()
+			defer fairplex.mu.Unlock()
+			if len(fairplex.backends) != 1 {
+				t.Fatalf("%d servers registered, want 1", len(fairplex.backends))
+			}
+			b := fairplex.backends[moved.URL]
+			if b == nil {
+				t.Fatalf("%v isn't registered", moved.URL)
+			}
+			if b.weight != tt.weight || !slices.Equal(b.tags, tt.tags) || (b.limiter != nil) != tt.limited {
+				t.Errorf("got weight %v, tags %v, limited %v; want %v, %v, %v", b.weight, b.tags, b.limiter != nil, tt.weight, tt.tags, tt.limited)
+			}
+			for _, n := range fairplex.ring.nodes {
+				if n.server.url.String() == old.URL {
+					t.Fatalf("ring still has a node of %v", old.URL)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package fairplex
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestServerURLsNormalized(t *testing.T) {
+	tests := []struct {
+		canonical string;
+		forms []string;
+	}{
+		{canonical: "http://backend.example:8080", forms: []string{"http://backend.example:8080/", "http://Backend.Example:8080", "HTTP://BACKEND.EXAMPLE:8080/"}},
+		{canonical: "http://backend.example", forms: []string{"http://backend.example/", "http://backend.example:80", "http://BACKEND.example:80/"}},
+		{canonical: "https://backend.example", forms: []string{"https://backend.example:443", "https://backend.example:443/"}},
+		{canonical: "http://[::1]:8080", forms: []string{"http://[::1]:8080/", "http://[0:0:0:0:0:0:0:1]:8080"}},
+		// Only a lone slash goes; a path is the server's own.
+		{canonical: "http://backend.example/api/", forms: []string{"http://BACKEND.example:80/api/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.canonical, func(t *testing.T) {
+			// The ring the canonical form alone makes.
+			want := &Fairplex{VirtualNodes: 10}
+			want.SetupRouter()
+			register(t, want, "http://10.0.0.1:8080")
+			register(t, want, tt.canonical)
+
+			fairplex := &Fairplex{VirtualNodes: 10}
+			fairplex.SetupRouter()
+			register(t, fairplex, "http://10.0.0.1:8080")
+			for _, form := range append([]string{tt.canonical}, tt.forms...) {
+				if b := register(t, fairplex, form); b.url.String() != tt.canonical {
+					t.Errorf("%v registered as %v, want %v", form, b.url, tt.canonical)
+				}
+			}
+			if n := len(fairplex.Servers); n != 2 {
+				t.Errorf("%d servers registered, want 2: %v", n, fairplex.Servers)
+			}
+			if got := fairplex.RingSnapshot(); !slices.Equal(got, want.RingSnapshot()) {
+				t.Errorf("ring differs from one with just %v: %v", tt.canonical, got)
+			}
+		})
+	}
+}
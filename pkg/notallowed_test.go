@@ -0,0 +1,72 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method string;
+		path string;
+		want int;
+		allow []string;
+		reason string;
+	}{
+		{method: http.MethodPatch, path: "/servers", want: http.StatusMethodNotAllowed, allow: []string{"GET", "POST", "PUT", "DELETE"}, reason: "method not allowed"},
+		{method: http.MethodPut, path: "/ping", want: http.StatusMethodNotAllowed, allow: []string{"GET"}, reason: "method not allowed"},
+		{method: http.MethodDelete, path: "/stats", want: http.StatusMethodNotAllowed, allow: []string{"GET"}, reason: "method not allowed"},
+		{method: "TRACE", path: "/anything", want: http.StatusMethodNotAllowed, allow: balancedMethods, reason: "method not allowed"},
+		{method: http.MethodGet, path: "/two/segments", want: http.StatusNotFound, reason: "not found"},
+	}
+	fairplex := &Fairplex{}
+	r := fairplex.SetupRouter()
+	for _, tt := range tests {
+		w := serve(r, tt.method, tt.path, nil)
+		if w.Code != tt.want {
+			t.Errorf("%v %v: got %d, want %d", tt.method, tt.path, w.Code, tt.want)
+			continue
+		}
+		for _, method := range tt.allow {
+			if !strings.Contains(w.Header().Get("Allow"), method) {
+				t.Errorf("%v %v: Allow is %q, want it to list %v", tt.method, tt.path, w.Header().Get("Allow"), method)
+			}
+		}
+		var body struct {
+			Status string `json:"status"`;
+			Reason string `json:"reason"`;
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Status != "error" || body.Reason != tt.reason {
+			t.Errorf("%v %v: body %q, want a JSON error %q", tt.method, tt.path, w.Body, tt.reason)
+		}
+	}
+}
+
+func TestUnmatchedRequestsAnswerJSON(t *testing.T) {
+	tests := []struct {
+		name string;
+		engine *gin.Engine;
+		method string;
+		path string;
+		code int;
+		body string;
+	}{
+		{name: "unknown route", method: http.MethodGet, path: "/a/b/c", code: http.StatusNotFound, body: `{"reason":"not found","status":"error"}`},
+		{name: "unknown admin subroute", method: http.MethodGet, path: "/servers/x/y", code: http.StatusNotFound, body: `{"reason":"not found","status":"error"}`},
+		{name: "unsupported method", method: "PROPFIND", path: "/users", code: http.StatusMethodNotAllowed, body: `{"reason":"method not allowed","status":"error"}`},
+		{name: "own engine, unknown route", engine: gin.New(), method: http.MethodGet, path: "/a/b/c", code: http.StatusNotFound, body: `{"reason":"not found","status":"error"}`},
+		{name: "own engine, unsupported method", engine: gin.New(), method: "PROPFIND", path: "/users", code: http.StatusMethodNotAllowed, body: `{"reason":"method not allowed","status":"error"}`},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{Engine: tt.engine}
+		r := fairplex.SetupRouter()
+		w := serve(r, tt.method, tt.path, nil)
+		if w.Code != tt.code || w.Body.String() != tt.body || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Errorf("%v: got %d %v %q, want %d JSON %q", tt.name, w.Code, w.Header().Get("Content-Type"), w.Body, tt.code, tt.body)
+		}
+	}
+}
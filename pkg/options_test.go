@@ -0,0 +1,46 @@
+package fairplex
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAnswerOptions(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	tests := []struct {
+		answer bool;
+		path string;
+		code int;
+	}{
+		{answer: true, path: "/", code: http.StatusNoContent},
+		{answer: true, path: "/users", code: http.StatusNoContent},
+		{answer: false, path: "/", code: http.StatusTemporaryRedirect},
+		{answer: false, path: "/users", code: http.StatusTemporaryRedirect},
+	}
+	for _, tt := range tests {
+		fairplex := &Fairplex{AnswerOptions: tt.answer}
+		r := fairplex.SetupRouter()
+		register(t, fairplex, backend.URL)
+
+		w := serve(r, http.MethodOptions, tt.path, nil)
+		if w.Code != tt.code {
+			t.Fatalf("answer %v, OPTIONS %v: got %d, want %d", tt.answer, tt.path, w.Code, tt.code)
+		}
+		allow := w.Header().Get("Allow")
+		if tt.answer && allow != strings.Join(balancedMethods, ", ") {
+			t.Errorf("answer %v, OPTIONS %v: Allow is %q", tt.answer, tt.path, allow)
+		}
+		if !tt.answer && w.Header().Get("Location") != backend.URL+tt.path {
+			t.Errorf("answer %v, OPTIONS %v: redirected to %q, want %q", tt.answer, tt.path, w.Header().Get("Location"), backend.URL+tt.path)
+		}
+	}
+
+	// Other methods are balanced as usual.
+	fairplex := &Fairplex{AnswerOptions: true}
+	r := fairplex.SetupRouter()
+	register(t, fairplex, backend.URL)
+	if w := serve(r, http.MethodGet, "/users", nil); w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("GET /users: got %d, want 307", w.Code)
+	}
+}
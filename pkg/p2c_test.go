@@ -0,0 +1,81 @@
+package fairplex
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestP2CPicksLessLoaded(t *testing.T) {
+	fairplex := &Fairplex{Strategy: StrategyP2C}
+	fairplex.SetupRouter()
+	busy := register(t, fairplex, "http://10.0.0.1:8080")
+	idle := register(t, fairplex, "http://10.0.0.2:8080")
+	busy.inFlight.Store(5)
+	for i := 0; i < 100; i++ {
+		if b := fairplex.selectP2C(nil); b != idle {
+			t.Fatalf("pick %d went to %v, want the idle server", i, b.url)
+		}
+	}
+	// A server that can't be picked leaves the busy one.
+	if b := fairplex.selectP2C(func(b *backend) bool { return b != idle }); b != busy {
+		t.Errorf("with the idle server refused, got %v", b)
+	}
+}
+
+// Requests mostly finish in a tick but now and then take 50. Round robin
+// keeps sending its share to a server stuck on long requests, while P2C
+// steers around it, so the most loaded server stays closer to the least.
+func TestP2CEvensLoad(t *testing.T) {
+	const servers, ticks, per_tick = 8, 5000, 4
+	spread := func(pick func(fairplex *Fairplex, n int) *backend) float64 {
+		rng := rand.New(rand.NewSource(1))
+		fairplex := &Fairplex{Strategy: StrategyP2C}
+		fairplex.SetupRouter()
+		var pool []*backend
+		for i := 0; i < servers; i++ {
+			pool = append(pool, register(t, fairplex, fmt.Sprintf("http://10.0.0.%d:8080", i+1)))
+		}
+		finishing := map[int][]*backend{}
+		total := 0
+		n := 0
+		for tick := 0; tick < ticks; tick++ {
+			for _, b := range finishing[tick] {
+				b.inFlight.Add(-1)
+			}
+			delete(finishing, tick)
+			for i := 0; i < per_tick; i++ {
+				b := pick(fairplex, n)
+				n++
+				b.inFlight.Add(1)
+				duration := 1
+				if rng.Intn(10) == 0 {
+					duration = 50
+				}
+				finishing[tick+duration] = append(finishing[tick+duration], b)
+			}
+			lo, hi := pool[0].inFlight.Load(), pool[0].inFlight.Load()
+			for _, b := range pool {
+				lo, hi = min(lo, b.inFlight.Load()), max(hi, b.inFlight.Load())
+			}
+			total += int(hi - lo)
+		}
+		return float64(total) / ticks
+	}
+
+	round_robin := spread(func(fairplex *Fairplex, n int) *backend {
+		servers := fairplex.p2cCandidates(false)
+		// p2cCandidates comes from a map, so put it in a fixed order.
+		slices.SortFunc(servers, func(a, b *backend) int { return strings.Compare(a.url.String(), b.url.String()) })
+		return servers[n%len(servers)]
+	})
+	p2c := spread(func(fairplex *Fairplex, n int) *backend {
+		return fairplex.selectP2C(nil)
+	})
+	t.Logf("mean spread between most and least loaded: round robin %.2f, p2c %.2f", round_robin, p2c)
+	if p2c >= round_robin*0.75 {
+		t.Errorf("p2c spread %.2f isn't clearly below round robin's %.2f", p2c, round_robin)
+	}
+}
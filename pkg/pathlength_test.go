@@ -0,0 +1,43 @@
+package fairplex
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMaxPathLength(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	tests := []struct {
+		name string;
+		engine bool;
+		path string;
+		code int;
+	}{
+		{name: "at the limit", path: "/" + strings.Repeat("a", 63), code: http.StatusTemporaryRedirect},
+		{name: "over the limit", path: "/" + strings.Repeat("a", 64), code: http.StatusRequestURITooLong},
+		{name: "escapes count", path: "/" + strings.Repeat("%20", 22), code: http.StatusRequestURITooLong},
+		{name: "oversized", path: "/" + strings.Repeat("a", 1<<20), code: http.StatusRequestURITooLong},
+		{name: "own engine", engine: true, path: "/" + strings.Repeat("a", 64), code: http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{MaxPathLength: 64}
+			if tt.engine {
+				fairplex.Engine = gin.New()
+			}
+			r := fairplex.SetupRouter()
+			register(t, fairplex, backend.URL)
+
+			w := serve(r, http.MethodGet, tt.path, nil)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusRequestURITooLong && w.Body.String() != `{"reason":"path too long","status":"error"}` {
+				t.Errorf("body is %v", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPingReportsRing(t *testing.T) {
+	fairplex := &Fairplex{VirtualNodes: 5}
+	r := fairplex.SetupRouter()
+	register(t, fairplex, "http://127.0.0.1:1")
+	down := register(t, fairplex, "http://127.0.0.1:2")
+	down.healthy.Store(false)
+
+	tests := []struct {
+		accept string;
+		content_type string;
+	}{
+		{accept: "", content_type: "text/plain; charset=utf-8"},
+		{accept: "application/json", content_type: "application/json; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tt.content_type {
+			t.Fatalf("Accept %q: got %d %v, want 200 %v", tt.accept, w.Code, w.Header().Get("Content-Type"), tt.content_type)
+		}
+		if got := w.Header().Get("X-Fairplex-Backends"); got != "1" {
+			t.Errorf("X-Fairplex-Backends is %q, want 1", got)
+		}
+		if got := w.Header().Get("X-Fairplex-Ring-Size"); got != "10" {
+			t.Errorf("X-Fairplex-Ring-Size is %q, want 10", got)
+		}
+		if tt.accept == "" {
+			if w.Body.String() != "pong" {
+				t.Errorf("body is %q, want pong", w.Body)
+			}
+			continue
+		}
+		var body struct {
+			Status string `json:"status"`;
+			Backends int `json:"backends"`;
+			RingSize int `json:"ring_size"`;
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Status != "ok" || body.Backends != 1 || body.RingSize != 10 {
+			t.Errorf("got %+v, want ok with 1 backend and 10 nodes", body)
+		}
+	}
+}
+
+func TestPingNegotiatesFormat(t *testing.T) {
+	fairplex := &Fairplex{}
+	r := fairplex.SetupRouter()
+	tests := []struct {
+		accept string;
+		body string;
+	}{
+		{accept: "", body: "pong"},
+		{accept: "text/plain", body: "pong"},
+		{accept: "*/*", body: "pong"},
+		{accept: "application/json", body: `{"backends":0,"ring_size":0,"status":"ok"}`},
+		{accept: "text/html, application/json", body: `{"backends":0,"ring_size":0,"status":"ok"}`},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.Header.Set("Accept", tt.accept)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Body.String() != tt.body {
+			t.Errorf("Accept %q: got %d %q, want 200 %q", tt.accept, w.Code, w.Body, tt.body)
+		}
+	}
+}
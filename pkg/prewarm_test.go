@@ -0,0 +1,59 @@
+package fairplex
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPrewarmOnAdd(t *testing.T) {
+	tests := []struct {
+		prewarm bool;
+		// Connections opened by registering, counting the probe's.
+		registered int64;
+		// Connections opened by the first proxied request.
+		first int64;
+	}{
+		{prewarm: false, registered: 1, first: 1},
+		{prewarm: true, registered: 2, first: 0},
+	}
+	for _, tt := range tests {
+		var conns atomic.Int64
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "pong")
+		}))
+		srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.Start()
+		t.Cleanup(srv.Close)
+		fairplex := &Fairplex{Proxy: true, PrewarmOnAdd: tt.prewarm}
+		proxy := startProxy(t, fairplex)
+		postServer(t, proxy.Config.Handler, url.Values{"addr": {srv.URL}})
+
+		// Prewarming happens in the background.
+		deadline := time.Now().Add(time.Second)
+		for conns.Load() < tt.registered && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := conns.Load(); got != tt.registered {
+			t.Errorf("prewarm %v: registering opened %d connections, want %d", tt.prewarm, got, tt.registered)
+		}
+
+		before := conns.Load()
+		if code, _ := send(t, http.MethodGet, proxy.URL+"/users", nil); code != http.StatusOK {
+			t.Fatalf("prewarm %v: proxied request got %d", tt.prewarm, code)
+		}
+		if got := conns.Load() - before; got != tt.first {
+			t.Errorf("prewarm %v: first request opened %d connections, want %d", tt.prewarm, got, tt.first)
+		}
+	}
+}
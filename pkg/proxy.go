@@ -0,0 +1,432 @@
+package fairplex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a proxied request carrying "Expect: 100-continue" waits for the
+// server's 100 Continue before its body is sent anyway.
+const expectContinueTimeout = 1 * time.Second
+
+// newTransport creates the transport a server's requests are proxied with.
+//
+// Expect: 100-continue is forwarded to the server as is, and the transport
+// holds the body back until the server answers. The client's body is only
+// read, and so its 100 Continue only sent, once the server has asked for
+// it; a server that rejects the request outright has its response relayed
+// without the client ever sending the body.
+func (fairplex *Fairplex) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ExpectContinueTimeout = expectContinueTimeout
+	if fairplex.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: fairplex.DialTimeout, KeepAlive: 30 * time.Second}
+		t.DialContext = dialer.DialContext
+	}
+	if fairplex.clientTLS != nil {
+		t.TLSClientConfig = fairplex.clientTLS.Clone()
+	}
+	return t
+}
+
+// attempt is a failed try at proxying a request to a server.
+type attempt struct {
+	server *backend;
+	err error;
+}
+
+// respondError answers the request with `status` and the JSON `body`, or
+// leaves it to ErrorHandler if that's set.
+func (fairplex *Fairplex) respondError(c *gin.Context, status int, body gin.H) {
+	if fairplex.ErrorHandler != nil {
+		fairplex.ErrorHandler(c, status)
+		return
+	}
+	c.JSON(status, body)
+}
+
+// badGateway answers a request that couldn't be proxied with a 502. With
+// VerboseErrors set, the servers tried and their errors are included.
+func (fairplex *Fairplex) badGateway(c *gin.Context, attempts []attempt) {
+	body := gin.H{"status": "error", "reason": "bad gateway"}
+	if fairplex.VerboseErrors {
+		tried := make([]gin.H, 0, len(attempts))
+		for _, a := range attempts {
+			tried = append(tried, gin.H{"server": a.server.url.String(), "error": a.err.Error()})
+		}
+		body["attempts"] = tried
+	}
+	fairplex.respondError(c, http.StatusBadGateway, body)
+}
+
+// proxyRequest forwards the request to the server `b`, rewriting its path
+// to `path`, and relays the response back to the client. If `can_retry` is
+// set and the request fails in a way canFailOver allows retrying, nothing is
+// written and the error is returned, so the request can be sent elsewhere.
+// Likewise, if `check_miss` is set and the response is a cache miss,
+// errCacheMiss is returned instead of relaying it. `prior` lists
+// the servers tried before, for the 502 given if `b` fails as well.
+func (fairplex *Fairplex) proxyRequest(c *gin.Context, b *backend, path string, can_retry, check_miss bool, prior []attempt) error {
+	var retry_err error
+	target := b.target(path, fairplex.RawPath)
+	headers := fairplex.headersFor(b)
+	start := time.Now()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = target.Path
+			req.URL.RawPath = target.RawPath
+			if !fairplex.PreserveHost {
+				req.Host = target.Host
+			}
+			// Hop-by-hop headers are removed by the ReverseProxy itself.
+			for _, name := range fairplex.StripRequestHeaders {
+				req.Header.Del(name)
+			}
+			for name, values := range headers {
+				req.Header[name] = append([]string(nil), values...)
+			}
+			fairplex.injectTrace(req)
+		},
+		Transport: b.transport,
+		ModifyResponse: func(resp *http.Response) error {
+			b.latency.record(time.Since(start))
+			b.coolDown(resp, time.Now())
+			if check_miss && fairplex.isMiss(resp) {
+				return errCacheMiss
+			}
+			return fairplex.modifyResponse(c, b, resp)
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			if errors.Is(err, errCacheMiss) {
+				debugf("cache miss on %v for %v\n", b.url.String(), req.URL.Path)
+				retry_err = err
+				return
+			}
+			errorf("error proxying to %v: %v\n", b.url.String(), err)
+			if can_retry && fairplex.canFailOver(req.Method, err) && c.Request.Context().Err() == nil {
+				retry_err = err
+				return
+			}
+			// A server that couldn't be connected to in DialTimeout is
+			// unreachable, which is a 502, not a 504.
+			if errors.Is(err, context.DeadlineExceeded) && !isDialError(err) {
+				fairplex.respondError(c, http.StatusGatewayTimeout, gin.H{"status": "error", "reason": "backend timed out"})
+				return
+			}
+			fairplex.badGateway(c, append(prior, attempt{b, err}))
+		},
+	}
+	proxy.ServeHTTP(c.Writer, c.Request)
+	return retry_err
+}
+
+// modifyResponse applies the response settings, such as MaxResponseBytes,
+// the header changes and Compress, to `resp` from `b` before it's relayed
+// to the client as the answer to `c`.
+func (fairplex *Fairplex) modifyResponse(c *gin.Context, b *backend, resp *http.Response) error {
+	if fairplex.Decompress {
+		decompressResponse(resp, c.Request)
+	}
+	if fairplex.MaxResponseBytes > 0 {
+		if err := limitResponse(resp, fairplex.MaxResponseBytes); err != nil {
+			return err
+		}
+	}
+	if fairplex.ServedByHeader != "" {
+		echoServedBy(resp, b, fairplex.ServedByHeader)
+	}
+	for _, name := range fairplex.StripResponseHeaders {
+		resp.Header.Del(name)
+	}
+	for name, value := range fairplex.AddResponseHeaders {
+		resp.Header.Set(name, value)
+	}
+	if fairplex.RewriteLocation {
+		rewriteLocation(resp, b, c.Request)
+	}
+	if isStream(resp) {
+		fairplex.startStream(c, resp)
+	}
+	if fairplex.Compress {
+		compressResponse(resp, c.Request)
+	}
+	return nil
+}
+
+// isDialError reports whether `err` is a failure to connect to a server,
+// as opposed to one once the request was under way.
+func isDialError(err error) bool {
+	var op_err *net.OpError
+	return errors.As(err, &op_err) && op_err.Op == "dial"
+}
+
+// RetryPolicy is when requests that aren't idempotent, POST and PATCH, are
+// failed over to another server. Not retrying them gives at-most-once
+// delivery: a client seeing an error can't tell whether its request took
+// effect. Retrying after the request was sent gives at-least-once delivery:
+// it takes effect, but a server may see it twice. Either way, a request is
+// never failed over once any of a response has reached the client.
+type RetryPolicy int
+
+const (
+	// RetryNever leaves failures of non-idempotent requests to the client.
+	// This is the default.
+	RetryNever RetryPolicy = iota
+	// RetryOnConnectError fails them over when the server can't be
+	// connected to, as for other methods. The request was never sent, so
+	// this is still at-most-once.
+	RetryOnConnectError
+	// RetryAlways also fails them over when the request fails once sent,
+	// e.g. when the connection drops before a response comes back, and
+	// does the same for every other method. The first server may have
+	// acted on the request, however.
+	RetryAlways
+)
+
+func (p RetryPolicy) String() string {
+	switch p {
+	case RetryNever:
+		return "never"
+	case RetryOnConnectError:
+		return "on_connect_error"
+	case RetryAlways:
+		return "always"
+	}
+	return fmt.Sprintf("RetryPolicy(%d)", int(p))
+}
+
+// isIdempotent reports whether repeating a request with `method` has the
+// same effect as making it once.
+func isIdempotent(method string) bool {
+	return method != http.MethodPost && method != http.MethodPatch
+}
+
+// canFailOver reports whether a request with `method` that failed with `err`
+// may be tried on another server, per NonIdempotentRetry for POST and PATCH.
+// RetryAlways applies to the other methods as well, so none is retried less
+// than POST.
+func (fairplex *Fairplex) canFailOver(method string, err error) bool {
+	if isDialError(err) {
+		return isIdempotent(method) || fairplex.NonIdempotentRetry != RetryNever
+	}
+	// Not once the response has been rejected, though.
+	return fairplex.NonIdempotentRetry == RetryAlways && !errors.Is(err, errResponseTooLarge)
+}
+
+// The number of servers a request is tried on when MaxFailoverAttempts is unset.
+const defaultMaxFailoverAttempts = 3
+
+func (fairplex *Fairplex) maxFailoverAttempts() int {
+	if fairplex.MaxFailoverAttempts <= 0 {
+		return defaultMaxFailoverAttempts
+	}
+	return fairplex.MaxFailoverAttempts
+}
+
+// The largest request body buffered when MaxBufferedBodyBytes is unset.
+const defaultMaxBufferedBodyBytes = 1 << 20
+
+func (fairplex *Fairplex) maxBufferedBodyBytes() int64 {
+	if fairplex.MaxBufferedBodyBytes <= 0 {
+		return defaultMaxBufferedBodyBytes
+	}
+	return fairplex.MaxBufferedBodyBytes
+}
+
+// hasBody reports whether `req` has a body, of known length or chunked.
+func hasBody(req *http.Request) bool {
+	return req.ContentLength != 0 || len(req.TransferEncoding) > 0
+}
+
+// expectsContinue reports whether `req` carries "Expect: 100-continue", so
+// its body mustn't be read before the server asks for it.
+func expectsContinue(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// bufferBody reads the body of `req` into memory, up to
+// MaxBufferedBodyBytes, and reports whether all of it fit. If it did, the
+// body is replaced by the buffered copy; if not, what was read is put back
+// in front of the rest, so the request can still be sent once.
+func (fairplex *Fairplex) bufferBody(req *http.Request) ([]byte, bool) {
+	max := fairplex.maxBufferedBodyBytes()
+	body, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil || int64(len(body)) > max {
+		req.Body = struct {
+			io.Reader;
+			io.Closer;
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	setBody(req, body)
+	return body, true
+}
+
+// setBody makes `body` the body of `req`, to be read from the start.
+func setBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// proxyWithFailover proxies the request to `b`. If `b` can't be connected
+// to, the request moves on to the next server the strategy picks, up to
+// MaxFailoverAttempts servers in all, after which the client gets a 502.
+// POST and PATCH requests are failed over as NonIdempotentRetry allows. A
+// body is buffered to be sent again, so a request whose body is over
+// MaxBufferedBodyBytes is only tried once, as is one with "Expect:
+// 100-continue", whose body mustn't be read before the server asks for it.
+// A read that's a cache miss moves on to the next server as well, up to
+// ReadFanOut servers, as long as there is a next server to try.
+func (fairplex *Fairplex) proxyWithFailover(c *gin.Context, b *backend, path string, key ringKey, accept func(*backend) bool) {
+	retryable := true
+	var body []byte
+	if hasBody(c.Request) {
+		if !expectsContinue(c.Request) && fairplex.maxFailoverAttempts() > 1 && (isIdempotent(c.Request.Method) || fairplex.NonIdempotentRetry != RetryNever) {
+			body, retryable = fairplex.bufferBody(c.Request)
+		} else {
+			retryable = false
+		}
+	}
+	fans_out := retryable && fairplex.fansOut(c.Request)
+	tried := []*backend{b}
+	var attempts []attempt
+	misses := 0
+	for {
+		can_retry := retryable && len(tried) < fairplex.maxFailoverAttempts()
+		// Misses are only checked for if another server could be asked,
+		// since a miss's response is gone once it's been passed over.
+		check_miss := fans_out && misses+1 < fairplex.ReadFanOut && fairplex.hasNext(key, tried, c.Request.Method)
+		if body != nil {
+			// The last attempt may have read some or all of it.
+			setBody(c.Request, body)
+		}
+		b.inFlight.Add(1)
+		err := fairplex.proxyRequest(c, b, path, can_retry, check_miss, attempts)
+		b.inFlight.Add(-1)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errCacheMiss) {
+			misses++
+		} else {
+			attempts = append(attempts, attempt{b, err})
+			// The request is degraded from its first failure on, unless
+			// it already was.
+			if len(attempts) == 1 && !fairplex.isDegraded(tried[0]) {
+				fairplex.stats.degraded.Add(1)
+			}
+		}
+
+		untried := func(s *backend) bool {
+			return !slices.Contains(tried, s) && accept(s)
+		}
+		if fairplex.Strategy == StrategyP2C {
+			b = fairplex.selectP2C(untried)
+		} else {
+			b = fairplex.selectServer(key, untried)
+		}
+		if b == nil {
+			errorf("no reachable server for %v after %v attempts\n", path, len(tried))
+			fairplex.badGateway(c, attempts)
+			return
+		}
+		infof("failing over to %v for %v\n", b.url.String(), path)
+		b.routed(time.Now())
+		tried = append(tried, b)
+	}
+}
+
+// errResponseTooLarge is returned for responses over MaxResponseBytes.
+var errResponseTooLarge = errors.New("response exceeds MaxResponseBytes")
+
+// readLimited reads all of `r`, failing with errResponseTooLarge if it holds
+// more than `max` bytes.
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err == nil && int64(len(body)) > max {
+		err = errResponseTooLarge
+	}
+	return body, err
+}
+
+// limitResponse fails for a response declaring a body of over `max` bytes.
+// A response of unknown length is read into memory, up to `max` bytes, so
+// one that turns out too large can still be answered with an error rather
+// than cut off partway.
+func limitResponse(resp *http.Response, max int64) error {
+	if resp.ContentLength > max {
+		return errResponseTooLarge
+	}
+	if resp.ContentLength >= 0 {
+		return nil
+	}
+	body, err := readLimited(resp.Body, max)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// The response header carrying the ServedByHeader of the server's response.
+const servedByHeader = "X-Fairplex-Served-By"
+
+// echoServedBy copies the server's own `name` response header, identifying
+// the instance that handled the request, into servedByHeader and the log.
+func echoServedBy(resp *http.Response, b *backend, name string) {
+	served_by := resp.Header.Get(name)
+	if served_by == "" {
+		return
+	}
+	resp.Header.Set(servedByHeader, served_by)
+	infof("request to %v served by %v\n", b.url.String(), served_by)
+}
+
+// rewriteLocation points a redirect to the server `b` back at fairplex, as
+// the client addressed it in `req`, so the server's own address doesn't leak
+// out. Redirects elsewhere are left alone.
+func rewriteLocation(resp *http.Response, b *backend, req *http.Request) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil || (u.Host != "" && !strings.EqualFold(u.Host, b.url.Host)) {
+		return
+	}
+
+	if u.Host != "" {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+		u.Host = req.Host
+	}
+	// Fairplex serves the server's paths from its root, so drop the path
+	// the server was registered under.
+	if prefix := strings.TrimSuffix(b.url.Path, "/"); prefix != "" && strings.HasPrefix(u.Path, prefix+"/") {
+		u.Path = strings.TrimPrefix(u.Path, prefix)
+		u.RawPath = ""
+	}
+	resp.Header.Set("Location", u.String())
+}
@@ -0,0 +1,36 @@
+package fairplex
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRoutingKeyQuery(t *testing.T) {
+	tests := []struct {
+		name string;
+		fairplex *Fairplex;
+		a string;
+		b string;
+		same bool;
+	}{
+		{name: "query not hashed", fairplex: &Fairplex{}, a: "/users?id=1", b: "/users?id=2", same: true},
+		{name: "query hashed", fairplex: &Fairplex{HashQuery: true}, a: "/users?id=1", b: "/users?id=2", same: false},
+		{name: "tracking params hashed", fairplex: &Fairplex{HashQuery: true}, a: "/users?id=1", b: "/users?id=1&utm_source=x", same: false},
+		{name: "tracking params ignored", fairplex: &Fairplex{HashQuery: true, IgnoreQueryParams: []string{"utm_source", "utm_medium"}}, a: "/users?id=1", b: "/users?utm_medium=y&id=1&utm_source=x", same: true},
+		{name: "other params still hashed", fairplex: &Fairplex{HashQuery: true, IgnoreQueryParams: []string{"utm_source"}}, a: "/users?id=1&utm_source=x", b: "/users?id=2&utm_source=x", same: false},
+		{name: "order doesn't matter", fairplex: &Fairplex{HashQuery: true}, a: "/users?a=1&b=2", b: "/users?b=2&a=1", same: true},
+		{name: "only ignored params", fairplex: &Fairplex{HashQuery: true, IgnoreQueryParams: []string{"utm_source"}}, a: "/users", b: "/users?utm_source=x", same: true},
+	}
+	for _, tt := range tests {
+		key := func(target string) string {
+			u, err := url.Parse(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return tt.fairplex.routingKey("users", u)
+		}
+		if same := key(tt.a) == key(tt.b); same != tt.same {
+			t.Errorf("%v: keys for %v and %v are %q and %q, same is %v, want %v", tt.name, tt.a, tt.b, key(tt.a), key(tt.b), same, tt.same)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEncodedSlashes(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RequestURI)
+	}))
+	defer echo.Close()
+	tests := []struct {
+		raw bool;
+		path string;
+		want string;
+	}{
+		{raw: false, path: "/a%2Fb", want: "/a/b"},
+		{raw: false, path: "/100%25", want: "/100%25"},
+		{raw: false, path: "/x%20y", want: "/x%20y"},
+		{raw: false, path: "/plain", want: "/plain"},
+		{raw: true, path: "/a%2Fb", want: "/a%2Fb"},
+		{raw: true, path: "/a%2fb", want: "/a%2fb"},
+		{raw: true, path: "/100%25", want: "/100%25"},
+		{raw: true, path: "/plain", want: "/plain"},
+	}
+	proxies := map[bool]string{}
+	for _, raw := range []bool{false, true} {
+		fairplex := &Fairplex{Proxy: true, RawPath: raw}
+		proxies[raw] = startProxy(t, fairplex).URL
+		register(t, fairplex, echo.URL)
+	}
+	for _, tt := range tests {
+		status, got := send(t, http.MethodGet, proxies[tt.raw]+tt.path, nil)
+		if status != http.StatusOK || got != tt.want {
+			t.Errorf("RawPath %v, %v: server got %d %q, want %q", tt.raw, tt.path, status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistrationFailureReasons(t *testing.T) {
+	timeout := healthCheckTimeout
+	healthCheckTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { healthCheckTimeout = timeout })
+
+	// Each case registers the server under a path of its own, which decides
+	// how its /ping answers.
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow/ping":
+			<-release
+		case "/failing/ping":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/other/ping":
+			io.WriteString(w, "not the body")
+			return
+		}
+		io.WriteString(w, "pong")
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+	as := func(kind string) string {
+		return srv.URL + "/" + kind
+	}
+
+	tests := []struct {
+		name string;
+		addr string;
+		code int;
+		reason string;
+	}{
+		{name: "parse error", addr: "foobar", code: http.StatusNotAcceptable, reason: "parse_error"},
+		{name: "bad scheme", addr: "ftp://127.0.0.1:21", code: http.StatusNotAcceptable, reason: "parse_error"},
+		{name: "unreachable", addr: deadAddr(t), code: http.StatusNotAcceptable, reason: "unreachable"},
+		{name: "timeout", addr: as("slow"), code: http.StatusNotAcceptable, reason: "timeout"},
+		{name: "bad status", addr: as("failing"), code: http.StatusNotAcceptable, reason: "bad_status"},
+		{name: "bad body", addr: as("other"), code: http.StatusNotAcceptable, reason: "bad_body"},
+		{name: "valid", addr: as("ok"), code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{HealthCheckExpectBody: "pong"}
+			r := fairplex.SetupRouter()
+			w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {tt.addr}})
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, w.Body)
+			}
+			if tt.reason == "" {
+				return
+			}
+			var body struct {
+				Status string `json:"status"`;
+				Reason string `json:"reason"`;
+				Detail string `json:"detail"`;
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != "error" || body.Reason != tt.reason || body.Detail == "" {
+				t.Errorf("got %+v, want an error with reason %v and a detail", body, tt.reason)
+			}
+		})
+	}
+}
+
+func TestRegisterRejectsURLsWithoutHost(t *testing.T) {
+	fairplex := &Fairplex{}
+	r := fairplex.SetupRouter()
+	tests := []struct {
+		addr string;
+		detail string;
+	}{
+		{addr: "foobar", detail: "scheme must be http, https or tcp"},
+		{addr: "just-a-path/users", detail: "scheme must be http, https or tcp"},
+		{addr: "/users", detail: "scheme must be http, https or tcp"},
+		{addr: "http://", detail: "missing host"},
+		{addr: "http:///users", detail: "missing host"},
+		{addr: "tcp://127.0.0.1", detail: "tcp servers need a port"},
+	}
+	for _, tt := range tests {
+		w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {tt.addr}})
+		var body struct {
+			Reason string `json:"reason"`;
+			Detail string `json:"detail"`;
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusNotAcceptable || body.Reason != "parse_error" || body.Detail != tt.detail {
+			t.Errorf("registering %q: got %d %v, want 406 parse_error %q", tt.addr, w.Code, w.Body, tt.detail)
+		}
+	}
+	if n := len(fairplex.RingSnapshot()); n != 0 {
+		t.Errorf("rejected servers left %d nodes on the ring", n)
+	}
+}
+
+func TestRegisterRequiresAddr(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	fairplex := &Fairplex{}
+	r := fairplex.SetupRouter()
+	tests := []struct {
+		name string;
+		form url.Values;
+		code int;
+	}{
+		{name: "missing", form: url.Values{}, code: http.StatusBadRequest},
+		{name: "empty", form: url.Values{"addr": {""}}, code: http.StatusBadRequest},
+		{name: "spaces", form: url.Values{"addr": {"   "}}, code: http.StatusBadRequest},
+		{name: "whitespace", form: url.Values{"addr": {" \t\n "}}, code: http.StatusBadRequest},
+		{name: "padded", form: url.Values{"addr": {"  " + backend.URL + "\n"}}, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveForm(r, http.MethodPost, "/servers", tt.form)
+			if w.Code != tt.code {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.code, w.Body)
+			}
+			if tt.code == http.StatusOK {
+				return
+			}
+			var body struct {
+				Status string `json:"status"`;
+				Reason string `json:"reason"`;
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Status != "error" || body.Reason != "addr is required" {
+				t.Errorf("got %v, want addr is required", w.Body)
+			}
+		})
+	}
+
+	// Only the padded address was registered, without its padding.
+	var servers []url.URL
+	json.Unmarshal(serve(r, http.MethodGet, "/servers", nil).Body.Bytes(), &servers)
+	if len(servers) != 1 || servers[0].String() != backend.URL {
+		t.Errorf("GET /servers lists %v, want just %v", servers, backend.URL)
+	}
+}
+
+// Run with -race.
+func TestConcurrentRegistrationOfOneServer(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	fairplex := &Fairplex{VirtualNodes: 25}
+	r := fairplex.SetupRouter()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := serveForm(r, http.MethodPost, "/servers", url.Values{"addr": {backend.URL}}); w.Code != http.StatusOK {
+				t.Errorf("registering got %d: %v", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fairplex.mu.Lock()
+	servers, backends := len(fairplex.Servers), len(fairplex.backends)
+	fairplex.mu.Unlock()
+	if servers != 1 || backends != 1 {
+		t.Errorf("%d servers and %d backends after 50 registrations of one, want 1", servers, backends)
+	}
+	if n := len(fairplex.RingSnapshot()); n != 25 {
+		t.Errorf("ring has %d nodes, want 25", n)
+	}
+}
@@ -0,0 +1,62 @@
+package fairplex
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoveServerClosesConnections(t *testing.T) {
+	tests := []struct {
+		name string;
+		remove bool;
+		conns int32;
+	}{
+		{name: "kept", remove: false, conns: 1},
+		{name: "removed and re-added", remove: true, conns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns, closed atomic.Int32
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				switch state {
+				case http.StateNew:
+					conns.Add(1)
+				case http.StateClosed:
+					closed.Add(1)
+				}
+			}
+			server.Start()
+			defer server.Close()
+			fairplex := &Fairplex{Proxy: true}
+			srv := startProxy(t, fairplex)
+			register(t, fairplex, server.URL)
+			send(t, http.MethodGet, srv.URL+"/x", nil)
+			send(t, http.MethodGet, srv.URL+"/x", nil)
+
+			if tt.remove {
+				if status, body := send(t, http.MethodDelete, srv.URL+"/servers?addr="+url.QueryEscape(server.URL), nil); status != http.StatusOK {
+					t.Fatalf("DELETE /servers: got %d %v", status, body)
+				}
+				// The idle connection to it is closed rather than left in its pool.
+				deadline := time.Now().Add(time.Second)
+				for closed.Load() == 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if closed.Load() == 0 {
+					t.Fatal("idle connection still open after removal")
+				}
+				register(t, fairplex, server.URL)
+			}
+			send(t, http.MethodGet, srv.URL+"/x", nil)
+			if got := conns.Load(); got != tt.conns {
+				t.Errorf("server saw %d connections, want %d", got, tt.conns)
+			}
+		})
+	}
+}
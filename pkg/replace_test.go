@@ -0,0 +1,75 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReplaceServers(t *testing.T) {
+	const a, b, c, d = "http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.4:8080"
+	fairplex := &Fairplex{ControlPlaneToken: "push"}
+	r := fairplex.SetupRouter()
+	register(t, fairplex, a).weight = 2
+	register(t, fairplex, b)
+
+	tests := []struct {
+		name string;
+		token string;
+		body string;
+		code int;
+		added int;
+		removed int;
+		primary []string;
+		standby []string;
+	}{
+		{name: "add only", token: "push", body: `{"primary": ["` + a + `", "` + b + `", "` + c + `"]}`, code: http.StatusOK, added: 1, removed: 0, primary: []string{a, b, c}},
+		{name: "remove only", token: "push", body: `{"primary": ["` + a + `", "` + c + `"]}`, code: http.StatusOK, added: 0, removed: 1, primary: []string{a, c}},
+		{name: "mixed", token: "push", body: `{"primary": ["` + a + `", "` + d + `"], "standby": ["` + c + `"]}`, code: http.StatusOK, added: 2, removed: 1, primary: []string{a, d}, standby: []string{c}},
+		{name: "no token", body: `{"primary": []}`, code: http.StatusUnauthorized, primary: []string{a, d}, standby: []string{c}},
+		{name: "invalid url", token: "push", body: `{"primary": ["` + a + `", "foobar"]}`, code: http.StatusBadRequest, primary: []string{a, d}, standby: []string{c}},
+		{name: "duplicate", token: "push", body: `{"primary": ["` + a + `"], "standby": ["` + a + `"]}`, code: http.StatusBadRequest, primary: []string{a, d}, standby: []string{c}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/servers", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Fatalf("%v: got %d, want %d: %v", tt.name, w.Code, tt.code, w.Body)
+		}
+		if tt.code == http.StatusOK {
+			var summary struct {
+				Added int `json:"added"`;
+				Removed int `json:"removed"`;
+			}
+			json.Unmarshal(w.Body.Bytes(), &summary)
+			if summary.Added != tt.added || summary.Removed != tt.removed {
+				t.Errorf("%v: added %d and removed %d, want %d and %d", tt.name, summary.Added, summary.Removed, tt.added, tt.removed)
+			}
+		}
+
+		fairplex.mu.Lock()
+		var primary, standby []string
+		for _, u := range fairplex.Servers {
+			primary = append(primary, u.String())
+		}
+		for _, u := range fairplex.StandbyServers {
+			standby = append(standby, u.String())
+		}
+		weight := fairplex.backends[a].weight
+		fairplex.mu.Unlock()
+		if !slices.Equal(primary, tt.primary) || !slices.Equal(standby, tt.standby) {
+			t.Errorf("%v: servers are %v and standby %v, want %v and %v", tt.name, primary, standby, tt.primary, tt.standby)
+		}
+		if weight != 2 {
+			t.Errorf("%v: kept server's weight is %v, want 2", tt.name, weight)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package fairplex
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isWrite reports whether requests with `method` are replicated when
+// ReplicationFactor is set.
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Hop-by-hop headers, which apply to a single connection and so aren't
+// passed on to the servers a request is replicated to.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from `h`, both the
+// standard ones and any named in its Connection header (RFC 7230 6.1).
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// replica is the outcome of sending a replicated request to one server.
+type replica struct {
+	server *backend;
+	resp *http.Response;
+	body []byte;
+	err error;
+}
+
+func (r *replica) ok() bool {
+	return r.err == nil && r.resp.StatusCode < 300
+}
+
+// replicateRequest sends the request to every server in `servers` at once.
+// If they all succeed, the first server's response is relayed, modified as
+// a proxied response would be. Otherwise the client gets the status of
+// each server, with a 200 if a majority of ReplicationFactor succeeded and
+// a 502 if not. A body over MaxBufferedBodyBytes gets a 413.
+func (fairplex *Fairplex) replicateRequest(c *gin.Context, servers []*backend, path string) {
+	// Every server needs its own copy of the body.
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, fairplex.maxBufferedBodyBytes()))
+	if err != nil {
+		var too_large *http.MaxBytesError
+		if errors.As(err, &too_large) {
+			errorf("request body for %v is over %v bytes, not replicating it\n", path, too_large.Limit)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"status": "error", "reason": "request body too large"})
+			return
+		}
+		errorf("error reading request body: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "could not read request body"})
+		return
+	}
+
+	replicas := make([]replica, len(servers))
+	var wg sync.WaitGroup
+	for i, b := range servers {
+		wg.Add(1)
+		go func(r *replica, b *backend) {
+			defer wg.Done()
+			r.server = b
+			b.inFlight.Add(1)
+			defer b.inFlight.Add(-1)
+			start := time.Now()
+			r.resp, r.err = b.transport.RoundTrip(fairplex.replicaRequest(c, b, path, body))
+			if r.err != nil {
+				errorf("error replicating to %v: %v\n", b.url.String(), r.err)
+				return
+			}
+			b.latency.record(time.Since(start))
+			b.coolDown(r.resp, time.Now())
+			defer r.resp.Body.Close()
+			if fairplex.MaxResponseBytes > 0 {
+				r.body, r.err = readLimited(r.resp.Body, fairplex.MaxResponseBytes)
+			} else {
+				r.body, r.err = io.ReadAll(r.resp.Body)
+			}
+			if r.err != nil {
+				errorf("error reading response from %v: %v\n", b.url.String(), r.err)
+			}
+		}(&replicas[i], b)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i := range replicas {
+		if replicas[i].ok() {
+			succeeded++
+		}
+	}
+
+	if succeeded == len(replicas) {
+		first := replicas[0]
+		first.resp.Body = io.NopCloser(bytes.NewReader(first.body))
+		first.resp.ContentLength = int64(len(first.body))
+		if err := fairplex.modifyResponse(c, first.server, first.resp); err != nil {
+			errorf("error relaying response from %v: %v\n", first.server.url.String(), err)
+			fairplex.badGateway(c, []attempt{{first.server, err}})
+			return
+		}
+		defer first.resp.Body.Close()
+		header := c.Writer.Header()
+		for name, values := range first.resp.Header {
+			header[name] = values
+		}
+		removeHopHeaders(header)
+		c.Status(first.resp.StatusCode)
+		io.Copy(c.Writer, first.resp.Body)
+		return
+	}
+
+	statuses := make([]gin.H, 0, len(replicas))
+	for _, r := range replicas {
+		s := gin.H{"server": r.server.url.String()}
+		if r.err != nil {
+			s["error"] = "bad gateway"
+		} else {
+			s["status"] = r.resp.StatusCode
+		}
+		statuses = append(statuses, s)
+	}
+	quorum := fairplex.ReplicationFactor/2 + 1
+	if succeeded >= quorum {
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "replicas": statuses})
+		return
+	}
+	errorf("only %v of %v replicas succeeded, %v needed\n", succeeded, len(replicas), quorum)
+	fairplex.respondError(c, http.StatusBadGateway, gin.H{"status": "error", "reason": "no quorum", "replicas": statuses})
+}
+
+// replicaRequest makes the copy of the client's request sent to `b`, with
+// `body` as its body.
+func (fairplex *Fairplex) replicaRequest(c *gin.Context, b *backend, path string, body []byte) *http.Request {
+	req := c.Request.Clone(c.Request.Context())
+	req.RequestURI = ""
+	// A client's Connection: close is about its own connection; the one to
+	// the server goes back to the pool, as the ReverseProxy does.
+	req.Close = false
+	req.URL = b.target(path, fairplex.RawPath)
+	req.URL.RawQuery = c.Request.URL.RawQuery
+	if !fairplex.PreserveHost {
+		req.Host = req.URL.Host
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	removeHopHeaders(req.Header)
+	for _, name := range fairplex.StripRequestHeaders {
+		req.Header.Del(name)
+	}
+	if host, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			host = strings.Join(prior, ", ") + ", " + host
+		}
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	for name, values := range fairplex.headersFor(b) {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	fairplex.injectTrace(req)
+	return req
+}
@@ -0,0 +1,117 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newReplicaBackend starts a server answering with `status`, echoing the
+// request body and naming itself in X-Instance.
+func newReplicaBackend(t *testing.T, name string, status int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Instance", name)
+		w.Header().Set("X-Secret", "internal")
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReplicateQuorum(t *testing.T) {
+	tests := []struct {
+		name string;
+		statuses []int;
+		want int;
+		reason string;
+	}{
+		{name: "all succeed", statuses: []int{200, 200, 200}, want: http.StatusOK},
+		{name: "majority", statuses: []int{200, 500, 200}, want: http.StatusOK},
+		{name: "minority", statuses: []int{500, 200, 503}, want: http.StatusBadGateway, reason: "no quorum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{Proxy: true, ReplicationFactor: 3}
+			r := fairplex.SetupRouter()
+			for i, status := range tt.statuses {
+				register(t, fairplex, newReplicaBackend(t, string(rune('a'+i)), status).URL)
+			}
+			w := serve(r, http.MethodPut, "/x", strings.NewReader("payload"))
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.want, w.Body)
+			}
+			if tt.reason == "" {
+				return
+			}
+			var body struct {
+				Reason string `json:"reason"`;
+				Replicas []map[string]any `json:"replicas"`;
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Reason != tt.reason || len(body.Replicas) != len(tt.statuses) {
+				t.Errorf("got reason %q and %d replicas, want %q and %d", body.Reason, len(body.Replicas), tt.reason, len(tt.statuses))
+			}
+		})
+	}
+}
+
+func TestReplicateModifiesResponse(t *testing.T) {
+	fairplex := &Fairplex{
+		Proxy: true,
+		ReplicationFactor: 2,
+		ServedByHeader: "X-Instance",
+		StripResponseHeaders: []string{"X-Secret"},
+		AddResponseHeaders: map[string]string{"X-Added": "yes"},
+	}
+	r := fairplex.SetupRouter()
+	register(t, fairplex, newReplicaBackend(t, "a", http.StatusOK).URL)
+	register(t, fairplex, newReplicaBackend(t, "b", http.StatusOK).URL)
+
+	w := serve(r, http.MethodPost, "/x", strings.NewReader("payload"))
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Fatalf("got %d %q, want 200 \"payload\"", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{"X-Secret": "", "X-Added": "yes"} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%v is %q, want %q", name, got, want)
+		}
+	}
+	if served_by := w.Header().Get(servedByHeader); served_by != "a" && served_by != "b" {
+		t.Errorf("%v is %q, want a or b", servedByHeader, served_by)
+	}
+}
+
+func TestReplicateBodyLimit(t *testing.T) {
+	tests := []struct {
+		body string;
+		want int;
+	}{
+		{body: "1234", want: http.StatusOK},
+		{body: "12345", want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		// The 413 is the client's error, not a gateway error for the
+		// ErrorHandler.
+		handled := false
+		fairplex := &Fairplex{Proxy: true, ReplicationFactor: 2, MaxBufferedBodyBytes: 4, ErrorHandler: func(c *gin.Context, status int) {
+			handled = true
+			c.String(status, "handled")
+		}}
+		r := fairplex.SetupRouter()
+		register(t, fairplex, newReplicaBackend(t, "a", http.StatusOK).URL)
+		register(t, fairplex, newReplicaBackend(t, "b", http.StatusOK).URL)
+		if w := serve(r, http.MethodPut, "/x", strings.NewReader(tt.body)); w.Code != tt.want || handled {
+			t.Errorf("%d byte body: got %d %q, want %d without the ErrorHandler", len(tt.body), w.Code, w.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "internal/1.0")
+		w.Header().Set("X-Powered-By", "php")
+		w.Header().Set("X-Debug-Trace", "abc")
+		w.Header().Set("X-Content-Type-Options", "sniff")
+		w.Header().Set("X-Kept", "1")
+	}))
+	t.Cleanup(srv.Close)
+	fairplex := &Fairplex{
+		Proxy: true,
+		StripResponseHeaders: []string{"Server", "x-powered-by", "X-Debug-Trace"},
+		AddResponseHeaders: map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "DENY"},
+	}
+	proxy := startProxy(t, fairplex)
+	register(t, fairplex, srv.URL)
+
+	resp, err := http.Get(proxy.URL + "/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	tests := []struct {
+		header string;
+		want string;
+	}{
+		{header: "Server", want: ""},
+		{header: "X-Powered-By", want: ""},
+		{header: "X-Debug-Trace", want: ""},
+		{header: "X-Kept", want: "1"},
+		// Added headers replace the server's own.
+		{header: "X-Content-Type-Options", want: "nosniff"},
+		{header: "X-Frame-Options", want: "DENY"},
+	}
+	for _, tt := range tests {
+		if got := resp.Header.Values(tt.header); (tt.want == "" && len(got) != 0) || (tt.want != "" && (len(got) != 1 || got[0] != tt.want)) {
+			t.Errorf("%v is %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCoolDown(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		code int;
+		retry_after string;
+		want time.Duration;
+	}{
+		{code: http.StatusServiceUnavailable, retry_after: "120", want: 2 * time.Minute},
+		{code: http.StatusServiceUnavailable, retry_after: now.Add(time.Minute).Format(http.TimeFormat), want: time.Minute},
+		{code: http.StatusServiceUnavailable, retry_after: "86400", want: maxRetryAfter},
+		{code: http.StatusServiceUnavailable, retry_after: "0", want: 0},
+		{code: http.StatusServiceUnavailable, retry_after: now.Add(-time.Minute).Format(http.TimeFormat), want: 0},
+		{code: http.StatusServiceUnavailable, retry_after: "soon", want: 0},
+		{code: http.StatusServiceUnavailable, retry_after: "", want: 0},
+		{code: http.StatusTooManyRequests, retry_after: "120", want: 0},
+	}
+	for _, tt := range tests {
+		b := testBackend(t, "http://a:8080")
+		resp := &http.Response{StatusCode: tt.code, Header: http.Header{}}
+		if tt.retry_after != "" {
+			resp.Header.Set("Retry-After", tt.retry_after)
+		}
+		b.coolDown(resp, now)
+		if b.cooling(now.Add(tt.want-time.Millisecond)) != (tt.want > 0) || b.cooling(now.Add(tt.want)) {
+			t.Errorf("%d with Retry-After %q: want a %v pause", tt.code, tt.retry_after, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterTakesServerOutOfSelection(t *testing.T) {
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "busy")
+	}))
+	t.Cleanup(busy.Close)
+	other := newTestBackend(t, "other")
+
+	fairplex := &Fairplex{Proxy: true, KeyHeaders: []string{"X-Key"}}
+	proxy := startProxy(t, fairplex)
+	b := register(t, fairplex, busy.URL)
+	register(t, fairplex, other.URL)
+	key := keyFor(t, fairplex, b)
+
+	get := func() (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+		req.Header.Set("X-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	// The 503 itself is relayed, then the server is passed over.
+	if code, body := get(); code != http.StatusServiceUnavailable || body != "busy" {
+		t.Fatalf("first request: got %d %q, want 503 busy", code, body)
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := get(); code != http.StatusOK || body != "other" {
+			t.Fatalf("request %d after the 503: got %d %q, want 200 other", i+2, code, body)
+		}
+	}
+
+	b.coolingUntil.Store(0)
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("after the pause: got %d, want the server's 503", code)
+	}
+}
@@ -0,0 +1,775 @@
+package fairplex
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The number of virtual nodes given to each server when VirtualNodes is unset.
+const defaultVirtualNodes = 4
+
+// The most virtual nodes a server can have. Past a few thousand, more barely
+// evens out the load any further, but each one still takes memory and time
+// to hash and insert, some of it with every request waiting on the ring.
+const maxVirtualNodes = 10000
+
+// checkVirtualNodes returns `n` if it is usable as VirtualNodes; values
+// over maxVirtualNodes are logged and capped.
+func checkVirtualNodes(n int) int {
+	if n > maxVirtualNodes {
+		errorf("virtual_nodes is %v, using the maximum of %v instead\n", n, maxVirtualNodes)
+		return maxVirtualNodes
+	}
+	return n
+}
+
+func (fairplex *Fairplex) virtualNodes() int {
+	if fairplex.VirtualNodes <= 0 {
+		return defaultVirtualNodes
+	}
+	return fairplex.VirtualNodes
+}
+
+// nodesFor returns the number of virtual nodes `b` has at full strength:
+// VirtualNodes scaled by its weight, but at least one and at most
+// maxVirtualNodes. Callers must hold fairplex.mu.
+func (fairplex *Fairplex) nodesFor(b *backend) int {
+	if b.weight == 0 {
+		return fairplex.virtualNodes()
+	}
+	return min(max(int(math.Round(float64(fairplex.virtualNodes())*b.weight)), 1), maxVirtualNodes)
+}
+
+// ringKeyFormat is how a server's URL and virtual node index are combined
+// before hashing. Changing it moves every virtual node, so it's part of the
+// ring's stable format.
+const ringKeyFormat = "%s#%d"
+
+// RingKey returns the ring position of virtual node `replica` (counting from
+// zero) of the server with URL `serverID`: the hex SHA-1 digest of
+// "<serverID>#<replica>", e.g. of "http://a:8080#0". External tools can use
+// it to reproduce the ring. With a HashSalt, the digest is instead taken of
+// the salt, a NUL byte and then "<serverID>#<replica>".
+func RingKey(serverID string, replica int) string {
+	return hash(fmt.Sprintf(ringKeyFormat, serverID, replica))
+}
+
+// ringKey is a position on the ring, the SHA-1 digest RingKey gives the hex
+// form of. Keys are sha1.Size bytes wide and big-endian, so they compare
+// bytewise in the order of their numeric values and the ring's order never
+// depends on how digests are printed. A digest of another width, from a
+// ring's sum, is taken as a fraction of the way round the ring like SHA-1's
+// is, see digestKey.
+type ringKey [sha1.Size]byte
+
+func (k ringKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// digestKey returns the ring position of the big-endian digest `d`: a
+// narrower digest is padded with zeros on the right, and a wider one cut to
+// the width of a ringKey. Either way digests of one width keep their
+// numeric order, and the first bytes, which ringShare measures by, still
+// say how far round the ring a key is.
+func digestKey(d []byte) ringKey {
+	var k ringKey
+	copy(k[:], d)
+	return k
+}
+
+// saltedKey returns the ring position of `s`, mixed with `salt` unless it's
+// empty.
+func saltedKey(salt, s string) ringKey {
+	if salt != "" {
+		s = salt + "\x00" + s
+	}
+	return sha1.Sum([]byte(s))
+}
+
+// key returns the ring position of `s`, as saltedKey does but with the
+// ring's sum if it has one.
+func (r *ring) key(s string) ringKey {
+	if r.sum == nil {
+		return saltedKey(r.salt, s)
+	}
+	if r.salt != "" {
+		s = r.salt + "\x00" + s
+	}
+	return digestKey(r.sum([]byte(s)))
+}
+
+// nodeKey returns the ring position of the `i`th virtual node of `b`.
+func (r *ring) nodeKey(b *backend, i int) ringKey {
+	return r.key(fmt.Sprintf(ringKeyFormat, b.url.String(), i))
+}
+
+// vnode is a virtual node: a position on the ring and the server holding it.
+type vnode struct {
+	key ringKey;
+	server *backend;
+}
+
+func compareVnodes(a, b vnode) int {
+	return bytes.Compare(a.key[:], b.key[:])
+}
+
+// ring is a consistent hash ring: the virtual nodes of its servers, sorted
+// by position. Looking up a key is a binary search. Nodes are added and
+// removed a server at a time, each costing a single pass over the ring.
+type ring struct {
+	nodes []vnode;
+	// Servers whose virtual node collided with another server's, by
+	// position. The server with the smallest URL holds a contested position
+	// and the others wait here, so the ring's contents don't depend on the
+	// order servers were added in.
+	shadowed map[ringKey][]*backend;
+	// Mixed into every virtual node hash, see Fairplex.HashSalt.
+	salt string;
+	// The hash function positions are the digests of, of any width. Nil
+	// means SHA-1, which fairplex's rings always use, since requests are
+	// looked up with saltedKey.
+	sum func([]byte) []byte;
+}
+
+func newRing(salt string) *ring {
+	return &ring{shadowed: make(map[ringKey][]*backend), salt: salt}
+}
+
+// insert places the virtual nodes `added`, merging them into the ring.
+// They're sorted first, which is cheap if they already are.
+// Where positions collide, the server with the smallest URL holds the
+// position and the others wait in r.shadowed.
+func (r *ring) insert(added []vnode) {
+	if len(added) == 0 {
+		return
+	}
+	slices.SortFunc(added, compareVnodes)
+
+	// Merge from the back, a block of the ring at a time, so the ring's left
+	// where it is and only the nodes after each insertion point are moved.
+	end := len(r.nodes)
+	r.nodes = slices.Grow(r.nodes, len(added))[:end+len(added)]
+	collided := false
+	for j := len(added) - 1; j >= 0; j-- {
+		// The first node after added[j]; any at the same position stay first.
+		p := sort.Search(end, func(i int) bool {
+			return compareVnodes(r.nodes[i], added[j]) > 0
+		})
+		copy(r.nodes[p+j+1:end+j+1], r.nodes[p:end])
+		r.nodes[p+j] = added[j]
+		end = p
+		collided = collided || (p > 0 && r.nodes[p-1].key == added[j].key) || (j > 0 && added[j-1].key == added[j].key)
+	}
+	if !collided {
+		return
+	}
+
+	// Settle collisions, keeping the first node of each position.
+	kept := r.nodes[:0]
+	for _, n := range r.nodes {
+		last := len(kept) - 1
+		if last < 0 || kept[last].key != n.key {
+			kept = append(kept, n)
+			continue
+		}
+		if kept[last].server == n.server {
+			continue
+		}
+		if n.server.url.String() < kept[last].server.url.String() {
+			kept[last].server, n.server = n.server, kept[last].server
+		}
+		r.shadowed[n.key] = append(r.shadowed[n.key], n.server)
+	}
+	clear(r.nodes[len(kept):])
+	r.nodes = kept
+}
+
+// delete takes `b` off the positions `keys`, handing each position to the
+// next server in line if there was a collision.
+func (r *ring) delete(b *backend, keys []ringKey) {
+	var removed []int
+	for _, key := range keys {
+		waiting := r.shadowed[key]
+		if i := slices.Index(waiting, b); i >= 0 {
+			if waiting = slices.Delete(waiting, i, i+1); len(waiting) == 0 {
+				delete(r.shadowed, key)
+			} else {
+				r.shadowed[key] = waiting
+			}
+			continue
+		}
+		i := sort.Search(len(r.nodes), func(i int) bool {
+			return bytes.Compare(r.nodes[i].key[:], key[:]) >= 0
+		})
+		if i == len(r.nodes) || r.nodes[i].key != key || r.nodes[i].server != b {
+			continue
+		}
+		if len(waiting) == 0 {
+			removed = append(removed, i)
+			continue
+		}
+		next := 0
+		for i, w := range waiting {
+			if w.url.String() < waiting[next].url.String() {
+				next = i
+			}
+		}
+		r.nodes[i].server = waiting[next]
+		if waiting = slices.Delete(waiting, next, next+1); len(waiting) == 0 {
+			delete(r.shadowed, key)
+		} else {
+			r.shadowed[key] = waiting
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	// Close the gaps, moving each block between them down only once.
+	slices.Sort(removed)
+	kept := removed[0]
+	for k, i := range removed {
+		end := len(r.nodes)
+		if k+1 < len(removed) {
+			end = removed[k+1]
+		}
+		kept += copy(r.nodes[kept:], r.nodes[i+1:end])
+	}
+	clear(r.nodes[kept:])
+	r.nodes = r.nodes[:kept]
+}
+
+// vnodes returns virtual nodes `from` up to but not including `to` of `b`.
+func (r *ring) vnodes(b *backend, from, to int) []vnode {
+	nodes := make([]vnode, 0, max(to-from, 0))
+	for i := from; i < to; i++ {
+		nodes = append(nodes, vnode{r.nodeKey(b, i), b})
+	}
+	return nodes
+}
+
+// add inserts vnodes(b) virtual nodes for each server b of `servers`, all
+// in one pass.
+func (r *ring) add(vnodes func(*backend) int, servers ...*backend) {
+	var added []vnode
+	for _, b := range servers {
+		n := vnodes(b)
+		added = append(added, r.vnodes(b, 0, n)...)
+		b.nodes = n
+	}
+	r.insert(added)
+}
+
+// walk calls `visit` with the owner of every virtual node, in ring order
+// starting from the first node at or after `key` and wrapping around,
+// until it returns false.
+func (r *ring) walk(key ringKey, visit func(*backend) bool) {
+	start := sort.Search(len(r.nodes), func(i int) bool {
+		return bytes.Compare(r.nodes[i].key[:], key[:]) >= 0
+	})
+	for i := range r.nodes {
+		if !visit(r.nodes[(start+i)%len(r.nodes)].server) {
+			return
+		}
+	}
+}
+
+// eligible reports whether `b` is healthy, not cooling down after a
+// Retry-After, and accepted by `accept`, which may be nil to accept every
+// server.
+func eligible(b *backend, accept func(*backend) bool) bool {
+	return b.healthy.Load() && !b.cooling(time.Now()) && (accept == nil || accept(b))
+}
+
+// lookup returns the server owning `key`: the one with the first virtual
+// node at or after it, wrapping around to the start of the ring. Servers
+// that are unhealthy or cooling down, or for which `accept` (if not nil)
+// returns false, are skipped in favour of their successors. It returns nil
+// when no server in the ring is healthy and accepted.
+func (r *ring) lookup(key ringKey, accept func(*backend) bool) *backend {
+	var owner *backend
+	r.walk(key, func(b *backend) bool {
+		if eligible(b, accept) {
+			owner = b
+		}
+		return owner == nil
+	})
+	return owner
+}
+
+// successors appends to `taken` the distinct servers following `key`,
+// as lookup would pick them, until it holds `n` servers or the ring runs out.
+func (r *ring) successors(key ringKey, n int, accept func(*backend) bool, taken []*backend) []*backend {
+	r.walk(key, func(b *backend) bool {
+		if len(taken) >= n {
+			return false
+		}
+		// Check for duplicates first, accept may take a rate limit token.
+		if !slices.Contains(taken, b) && eligible(b, accept) {
+			taken = append(taken, b)
+		}
+		return true
+	})
+	return taken
+}
+
+// ringFor returns the ring of the pool `b` belongs to.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) ringFor(b *backend) *ring {
+	if b.standby {
+		return fairplex.standbyRing
+	}
+	return fairplex.ring
+}
+
+// ringShare returns the fraction of the hash space owned by the virtual
+// nodes of `b` in its ring, healthy or not: the share of keys it gets while
+// every server is up. Callers must hold fairplex.mu.
+func (fairplex *Fairplex) ringShare(b *backend) float64 {
+	nodes := fairplex.ringFor(b).nodes
+	if len(nodes) == 1 && nodes[0].server == b {
+		return 1
+	}
+	share := 0.0
+	for i, n := range nodes {
+		if n.server != b {
+			continue
+		}
+		// A node owns the keys after the one before it, wrapping around;
+		// the top 64 bits of the keys are plenty to measure that by.
+		prev := nodes[(i+len(nodes)-1)%len(nodes)]
+		arc := binary.BigEndian.Uint64(n.key[:8]) - binary.BigEndian.Uint64(prev.key[:8])
+		share += float64(arc) / math.Exp2(64)
+	}
+	return share
+}
+
+// setNodes grows or shrinks the number of virtual nodes `b` has in its ring
+// to `vnodes`, or to none while the servers are drained. Callers must hold
+// fairplex.mu.
+func (fairplex *Fairplex) setNodes(b *backend, vnodes int) {
+	if fairplex.drained {
+		vnodes = 0
+	}
+	r := fairplex.ringFor(b)
+	if vnodes > b.nodes {
+		r.insert(r.vnodes(b, b.nodes, vnodes))
+	} else {
+		var keys []ringKey
+		for _, n := range r.vnodes(b, vnodes, b.nodes) {
+			keys = append(keys, n.key)
+		}
+		r.delete(b, keys)
+	}
+	b.nodes = vnodes
+}
+
+// inheritSettings copies the settings `b` wasn't registered with, such as
+// its weight, tags and rate limit, from the server it replaces, if any, so
+// a server re-registered under its name after moving keeps them.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) inheritSettings(b *backend) {
+	for _, old := range fairplex.backends {
+		if old == b || (old.url.String() != b.url.String() && (b.name == "" || old.name != b.name)) {
+			continue
+		}
+		if b.weight == 0 {
+			b.weight = old.weight
+		}
+		if len(b.tags) == 0 {
+			b.tags = old.tags
+		}
+		if b.limiter == nil {
+			b.limiter = old.limiter
+		}
+		if len(b.headers) == 0 {
+			b.headers = old.headers
+		}
+		if len(b.methods) == 0 {
+			b.methods = old.methods
+		}
+		if b.zone == "" {
+			b.zone = old.zone
+		}
+		return
+	}
+}
+
+// addServer registers `b` and inserts it into its pool's ring. A server
+// already registered with the same URL, or with the name `b` has, is
+// replaced, and `b` takes on the settings it wasn't given from it;
+// checking and inserting under one lock keeps concurrent registrations of
+// a server from both being added.
+func (fairplex *Fairplex) addServer(b *backend) {
+	// Hashing and sorting the virtual nodes is most of the work of adding a
+	// server, so it's done before taking the lock the ring is read under.
+	fairplex.mu.Lock()
+	fairplex.inheritSettings(b)
+	vnodes := fairplex.nodesFor(b)
+	fairplex.mu.Unlock()
+	var added []vnode
+	if fairplex.SlowStartDuration <= 0 {
+		added = newRing(fairplex.HashSalt).vnodes(b, 0, vnodes)
+		slices.SortFunc(added, compareVnodes)
+	}
+
+	fairplex.mu.Lock()
+	var replaced []*backend
+	for _, old := range fairplex.backends {
+		if old != b && (old.url.String() == b.url.String() || (b.name != "" && old.name == b.name)) {
+			replaced = append(replaced, old)
+		}
+	}
+	for _, old := range replaced {
+		fairplex.removeLocked(old)
+	}
+
+	if b.standby {
+		fairplex.StandbyServers = append(fairplex.StandbyServers, b.url)
+	} else {
+		fairplex.Servers = append(fairplex.Servers, b.url)
+	}
+	fairplex.backends[b.url.String()] = b
+	b.transport = fairplex.newTransport()
+	if fairplex.drained {
+		// It joins the ring with the others once they're undrained.
+	} else if fairplex.SlowStartDuration > 0 {
+		fairplex.startWarmUp(b)
+	} else if vnodes == fairplex.nodesFor(b) {
+		fairplex.ringFor(b).insert(added)
+		b.nodes = vnodes
+	} else {
+		// VirtualNodes changed in the meantime.
+		fairplex.ringFor(b).add(fairplex.nodesFor, b)
+	}
+	fairplex.mu.Unlock()
+
+	for _, old := range replaced {
+		if old.transport != nil {
+			old.transport.CloseIdleConnections()
+		}
+		if old.url.String() != b.url.String() {
+			infof("server %v moved from %v to %v\n", b.name, old.url.String(), b.url.String())
+		}
+	}
+}
+
+// RemoveServer takes the server `addr` out of its ring and the registry,
+// closing any idle connections held to it, and reports whether it was
+// registered. Its keys move to their ring successors and no other key
+// changes server: with N servers only about 1/N of the keys are remapped.
+// Positions it shared with other servers go to whichever would have held
+// them had it never been added, so removal also undoes any collision.
+func (fairplex *Fairplex) RemoveServer(addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	normalizeURL(u)
+
+	fairplex.mu.Lock()
+	b, ok := fairplex.backends[u.String()]
+	if ok {
+		fairplex.removeLocked(b)
+	}
+	fairplex.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+	infof("removed server %v\n", u.String())
+	return true
+}
+
+// serverUpdate is a change PUT /servers makes to a server. Nil fields are
+// left as they are.
+type serverUpdate struct {
+	weight *float64;
+	tags []string;
+	headers http.Header;
+}
+
+// updateServer applies `update` to the registered server `addr` in place,
+// and reports whether it was registered. A new weight adds or removes just
+// the difference in virtual nodes, so the server keeps the keys it has
+// wherever it keeps its share; any warm-up is cut short, and a server down
+// for maintenance gets its new share when it's back.
+func (fairplex *Fairplex) updateServer(addr string, update serverUpdate) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	normalizeURL(u)
+
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	b, ok := fairplex.backends[u.String()]
+	if !ok {
+		return false
+	}
+	if update.tags != nil {
+		b.tags = update.tags
+	}
+	if update.headers != nil {
+		b.headers = update.headers
+	}
+	if update.weight != nil {
+		b.weight = *update.weight
+		if !b.maintenance {
+			b.warmUps++
+			fairplex.setNodes(b, fairplex.nodesFor(b))
+		}
+	}
+	infof("updated server %v\n", u.String())
+	return true
+}
+
+// headersFor returns the headers added to requests proxied to `b`.
+func (fairplex *Fairplex) headersFor(b *backend) http.Header {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	return b.headers
+}
+
+// removeLocked takes `b` out of its ring and the registry. Callers must hold
+// fairplex.mu, and close b's idle connections once they've released it.
+func (fairplex *Fairplex) removeLocked(b *backend) {
+	b.warmUps++
+	fairplex.setNodes(b, 0)
+	delete(fairplex.backends, b.url.String())
+	fairplex.Servers = removeURL(fairplex.Servers, b.url)
+	fairplex.StandbyServers = removeURL(fairplex.StandbyServers, b.url)
+}
+
+// removeURL returns `urls` without any URL equal to `u`.
+func removeURL(urls []*url.URL, u *url.URL) []*url.URL {
+	kept := urls[:0]
+	for _, v := range urls {
+		if v.String() != u.String() {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// rebuildRing builds fresh rings from fairplex.Servers and
+// fairplex.StandbyServers off to the side and swaps them in, so requests
+// never observe a partially built ring. Every server gets its full share of
+// virtual nodes, ending any warm-up in progress, except those down for
+// maintenance, and all of them while they're drained.
+func (fairplex *Fairplex) rebuildRing() {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+	fairplex.rebuildRingLocked()
+}
+
+// rebuildRingLocked is rebuildRing for callers already holding fairplex.mu.
+func (fairplex *Fairplex) rebuildRingLocked() {
+	if fairplex.backends == nil {
+		fairplex.backends = make(map[string]*backend)
+	}
+	primary := newRing(fairplex.HashSalt)
+	standby := newRing(fairplex.HashSalt)
+	var primary_servers, standby_servers []*backend
+	for _, u := range fairplex.Servers {
+		b, ok := fairplex.backends[u.String()]
+		if !ok {
+			b = newBackend(u, false)
+			b.transport = fairplex.newTransport()
+			fairplex.backends[u.String()] = b
+		}
+		b.warmUps++
+		if b.maintenance || fairplex.drained {
+			b.nodes = 0
+			continue
+		}
+		primary_servers = append(primary_servers, b)
+	}
+	for _, u := range fairplex.StandbyServers {
+		b, ok := fairplex.backends[u.String()]
+		if !ok {
+			b = newBackend(u, true)
+			b.transport = fairplex.newTransport()
+			fairplex.backends[u.String()] = b
+		}
+		b.warmUps++
+		if b.maintenance || fairplex.drained {
+			b.nodes = 0
+			continue
+		}
+		standby_servers = append(standby_servers, b)
+	}
+	primary.add(fairplex.nodesFor, primary_servers...)
+	standby.add(fairplex.nodesFor, standby_servers...)
+	fairplex.ring = primary
+	fairplex.standbyRing = standby
+}
+
+// SetServers replaces both pools in one step: requests see either the old
+// servers or the new ones, never a mix. Servers that stay in the same pool
+// keep their settings and counters; servers that are dropped have their
+// idle connections closed. Servers moving between pools start afresh.
+func (fairplex *Fairplex) SetServers(primary, standby []*url.URL) {
+	fairplex.setServers(primary, standby)
+}
+
+// setServers is SetServers, returning how many servers were added and how
+// many removed. A server moving between pools counts as both.
+func (fairplex *Fairplex) setServers(primary, standby []*url.URL) (int, int) {
+	wanted := make(map[string]bool, len(primary)+len(standby))
+	for _, u := range primary {
+		wanted[u.String()] = false
+	}
+	for _, u := range standby {
+		wanted[u.String()] = true
+	}
+
+	fairplex.mu.Lock()
+	var dropped []*backend
+	for addr, b := range fairplex.backends {
+		if is_standby, ok := wanted[addr]; !ok || is_standby != b.standby {
+			b.warmUps++
+			dropped = append(dropped, b)
+			delete(fairplex.backends, addr)
+		}
+	}
+	kept := len(fairplex.backends)
+	fairplex.Servers = append([]*url.URL(nil), primary...)
+	fairplex.StandbyServers = append([]*url.URL(nil), standby...)
+	fairplex.rebuildRingLocked()
+	added := len(fairplex.backends) - kept
+	fairplex.mu.Unlock()
+
+	for _, b := range dropped {
+		if b.transport != nil {
+			b.transport.CloseIdleConnections()
+		}
+	}
+	infof("servers set to %v primary and %v standby\n", len(primary), len(standby))
+	return added, len(dropped)
+}
+
+// serverList is the body of a JSON PUT /servers: every server fairplex
+// should have, in each pool.
+type serverList struct {
+	Primary []string `json:"primary"`;
+	Standby []string `json:"standby"`;
+}
+
+// replaceServersHandler serves a JSON PUT /servers, replacing the servers
+// with those in the body in one step, as SetServers does. A control plane
+// holding the full list can push it as is, rather than working out what to
+// register and remove. The servers aren't checked first; the health checker
+// takes care of any that are down. Nothing changes if any URL is invalid.
+func (fairplex *Fairplex) replaceServersHandler(c *gin.Context) {
+	var list serverList
+	if err := c.ShouldBindJSON(&list); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "body must be a JSON object with primary and standby lists"})
+		return
+	}
+	pools := [2][]*url.URL{}
+	seen := map[string]bool{}
+	for i, addrs := range [][]string{list.Primary, list.Standby} {
+		for _, addr := range addrs {
+			u, err := parseServerURL(addr)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "parse_error", "detail": err.Error()})
+				return
+			}
+			if seen[u.String()] {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "error", "reason": "duplicate server " + u.String()})
+				return
+			}
+			seen[u.String()] = true
+			pools[i] = append(pools[i], u)
+		}
+	}
+	added, removed := fairplex.setServers(pools[0], pools[1])
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "added": added, "removed": removed})
+}
+
+// selectServer returns the server owning `key` in the active pool,
+// falling back to the other pool if none of the active pool's servers are
+// healthy and accepted by `accept` (which may be nil). Within each pool,
+// servers in fairplex's Zone come first. It returns nil when there's no
+// such server at all.
+func (fairplex *Fairplex) selectServer(key ringKey, accept func(*backend) bool) *backend {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	active, other := fairplex.ring, fairplex.standbyRing
+	if fairplex.standbyActive {
+		active, other = other, active
+	}
+
+	for _, r := range []*ring{active, other} {
+		if fairplex.Zone != "" {
+			if b := r.lookup(key, fairplex.inZone(accept)); b != nil {
+				return b
+			}
+		}
+		if b := r.lookup(key, accept); b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// selectServers returns up to `n` distinct servers for `key`, the first
+// being the one selectServer would return and the rest its ring successors,
+// topping up from the other pool if the active one has too few.
+func (fairplex *Fairplex) selectServers(key ringKey, n int, accept func(*backend) bool) []*backend {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	active, other := fairplex.ring, fairplex.standbyRing
+	if fairplex.standbyActive {
+		active, other = other, active
+	}
+
+	servers := active.successors(key, n, accept, nil)
+	return other.successors(key, n, accept, servers)
+}
+
+// RingNode is a virtual node on the ring, as returned by RingSnapshot.
+type RingNode struct {
+	// Position of the node on the ring, see RingKey.
+	Hash string `json:"hash"`;
+	// URL of the server owning the node.
+	Server string `json:"server"`;
+	// Whether the node is on the standby pool's ring.
+	Standby bool `json:"standby"`;
+}
+
+// RingSnapshot returns a copy of every virtual node currently on the rings:
+// the primary pool's sorted by hash, followed by the standby pool's sorted
+// by hash. Positions lost to a collision aren't listed.
+func (fairplex *Fairplex) RingSnapshot() []RingNode {
+	fairplex.mu.Lock()
+	defer fairplex.mu.Unlock()
+
+	var nodes []RingNode
+	for _, r := range []*ring{fairplex.ring, fairplex.standbyRing} {
+		if r == nil {
+			continue
+		}
+		for _, n := range r.nodes {
+			nodes = append(nodes, RingNode{Hash: n.key.String(), Server: n.server.url.String(), Standby: r == fairplex.standbyRing})
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,447 @@
+package fairplex
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math/big"
+	"net/url"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend returns an unregistered backend for `addr`, for building rings
+// directly.
+func testBackend(t testing.TB, addr string) *backend {
+	t.Helper()
+	u, err := url.Parse(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newBackend(u, false)
+}
+
+func TestRingCollisions(t *testing.T) {
+	a, b, c := testBackend(t, "http://a:80"), testBackend(t, "http://b:80"), testBackend(t, "http://c:80")
+	key := saltedKey("", "contested")
+	tests := []struct {
+		name string;
+		order []*backend;
+		remove []*backend;
+		owner *backend;
+		waiting int;
+	}{
+		{name: "smallest url wins", order: []*backend{b, a}, owner: a, waiting: 1},
+		{name: "order doesn't matter", order: []*backend{a, b}, owner: a, waiting: 1},
+		{name: "three way", order: []*backend{c, b, a}, owner: a, waiting: 2},
+		{name: "owner removed", order: []*backend{c, b, a}, remove: []*backend{a}, owner: b, waiting: 1},
+		{name: "waiting removed", order: []*backend{c, b, a}, remove: []*backend{b}, owner: a, waiting: 1},
+		{name: "all but one removed", order: []*backend{c, b, a}, remove: []*backend{a, c}, owner: b, waiting: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing("")
+			for _, s := range tt.order {
+				r.insert([]vnode{{key, s}})
+			}
+			for _, s := range tt.remove {
+				r.delete(s, []ringKey{key})
+			}
+			if len(r.nodes) != 1 {
+				t.Fatalf("ring has %d nodes for one position, want 1", len(r.nodes))
+			}
+			if got := r.lookup(key, nil); got != tt.owner {
+				t.Errorf("position held by %v, want %v", got.url, tt.owner.url)
+			}
+			if got := len(r.shadowed[key]); got != tt.waiting {
+				t.Errorf("%d servers waiting for the position, want %d", got, tt.waiting)
+			}
+			if tt.waiting == 0 {
+				if _, ok := r.shadowed[key]; ok {
+					t.Error("empty shadowed entry left behind")
+				}
+			}
+		})
+	}
+}
+
+// newTestRing returns a Fairplex with `servers` primary servers of `vnodes`
+// virtual nodes each on its ring, without serving anything.
+func TestRingKeyWidths(t *testing.T) {
+	tests := []struct {
+		name string;
+		sum func([]byte) []byte;
+	}{
+		{name: "crc32", sum: func(b []byte) []byte { return binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(b)) }},
+		{name: "fnv-64", sum: func(b []byte) []byte { h := fnv.New64a(); h.Write(b); return h.Sum(nil) }},
+		{name: "sha-1", sum: func(b []byte) []byte { d := sha1.Sum(b); return d[:] }},
+		{name: "sha-256", sum: func(b []byte) []byte { d := sha256.Sum256(b); return d[:] }},
+	}
+	servers := make([]*backend, 20)
+	for i := range servers {
+		servers[i] = testBackend(t, fmt.Sprintf("http://10.0.0.%d:8080", i))
+	}
+	const vnodes = 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRing("pepper")
+			r.sum = tt.sum
+			r.add(func(*backend) int { return vnodes }, servers...)
+
+			// Every virtual node's digest as a number, in the order
+			// consistent hashing needs.
+			type position struct {
+				n *big.Int;
+				server *backend;
+			}
+			digest := func(s string) *big.Int {
+				return new(big.Int).SetBytes(tt.sum([]byte("pepper\x00" + s)))
+			}
+			var positions []position
+			for _, b := range servers {
+				for i := 0; i < vnodes; i++ {
+					positions = append(positions, position{digest(fmt.Sprintf(ringKeyFormat, b.url.String(), i)), b})
+				}
+			}
+			slices.SortFunc(positions, func(a, b position) int { return a.n.Cmp(b.n) })
+			if len(r.nodes) != len(positions) {
+				t.Fatalf("ring has %d nodes, want %d", len(r.nodes), len(positions))
+			}
+			for i, p := range positions {
+				if r.nodes[i].server != p.server {
+					t.Fatalf("node %d belongs to %v, want %v: the ring isn't in numeric order", i, r.nodes[i].server.url, p.server.url)
+				}
+			}
+
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("10.1.0.%d/path-%d", i%256, i)
+				n := digest(key)
+				want := positions[0].server
+				for _, p := range positions {
+					if p.n.Cmp(n) >= 0 {
+						want = p.server
+						break
+					}
+				}
+				if got := r.lookup(r.key(key), nil); got != want {
+					t.Errorf("%v went to %v, want %v", key, got.url, want.url)
+				}
+			}
+		})
+	}
+}
+
+func newTestRing(t testing.TB, servers, vnodes int) *Fairplex {
+	t.Helper()
+	fairplex := &Fairplex{VirtualNodes: vnodes}
+	for i := 0; i < servers; i++ {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.%d.%d:8080", i/256, i%256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fairplex.Servers = append(fairplex.Servers, u)
+	}
+	fairplex.rebuildRing()
+	return fairplex
+}
+
+// testKeys returns `n` distinct hash keys.
+func testKeys(n int) []ringKey {
+	keys := make([]ringKey, n)
+	for i := range keys {
+		keys[i] = saltedKey("", fmt.Sprintf("10.1.%d.%d/path-%d", i/256%256, i%256, i))
+	}
+	return keys
+}
+
+func TestRemoveServerRemapsItsShare(t *testing.T) {
+	tests := []struct {
+		servers int;
+		vnodes int;
+	}{
+		{servers: 3, vnodes: 100},
+		{servers: 5, vnodes: 100},
+		{servers: 10, vnodes: 200},
+		{servers: 20, vnodes: 200},
+	}
+	keys := testKeys(20000)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("servers=%d", tt.servers), func(t *testing.T) {
+			fairplex := newTestRing(t, tt.servers, tt.vnodes)
+			before := make([]*backend, len(keys))
+			for i, key := range keys {
+				before[i] = fairplex.selectServer(key, nil)
+			}
+			removed := fairplex.Servers[tt.servers/2].String()
+			if !fairplex.RemoveServer(removed) {
+				t.Fatalf("%v wasn't registered", removed)
+			}
+
+			moved := 0
+			for i, key := range keys {
+				after := fairplex.selectServer(key, nil)
+				if after.url.String() == removed {
+					t.Fatalf("key %d still maps to the removed server", i)
+				}
+				if after == before[i] {
+					continue
+				}
+				if before[i].url.String() != removed {
+					t.Fatalf("key %d moved from %v to %v, though that server stayed", i, before[i].url, after.url)
+				}
+				moved++
+			}
+			// 1/N, give or take the unevenness of the ring.
+			fraction, want := float64(moved)/float64(len(keys)), 1/float64(tt.servers)
+			if fraction < want/2 || fraction > want*2 {
+				t.Errorf("%.3f of keys moved, want about %.3f", fraction, want)
+			}
+		})
+	}
+}
+
+func BenchmarkSelectServer(b *testing.B) {
+	keys := testKeys(1 << 12)
+	for _, servers := range []int{10, 100, 1000} {
+		for _, vnodes := range []int{4, 40, 160} {
+			fairplex := newTestRing(b, servers, vnodes)
+			name := fmt.Sprintf("servers=%d/vnodes=%d", servers, vnodes)
+			b.Run(name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					fairplex.selectServer(keys[i%len(keys)], nil)
+				}
+			})
+			// Every lookup takes fairplex.mu, so this shows the contention.
+			b.Run(name+"/parallel", func(b *testing.B) {
+				b.ReportAllocs()
+				b.RunParallel(func(pb *testing.PB) {
+					i := 0
+					for pb.Next() {
+						fairplex.selectServer(keys[i%len(keys)], nil)
+						i++
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkRingStorage compares the ring as it's stored, raw digests in a
+// sorted slice, with a sorted slice of the hex strings positions used to
+// be kept as, building a ring of each and hashing and looking up keys.
+func BenchmarkRingStorage(b *testing.B) {
+	requests := make([]string, 1<<12)
+	for i := range requests {
+		requests[i] = fmt.Sprintf("10.1.%d.%d/path-%d", i/256, i%256, i)
+	}
+	for _, size := range []struct {
+		servers int;
+		vnodes int;
+	}{{100, 100}, {1000, 100}, {1000, 400}} {
+		servers := make([]*backend, size.servers)
+		for i := range servers {
+			servers[i] = testBackend(b, fmt.Sprintf("http://10.0.%d.%d:8080", i/256, i%256))
+		}
+		nodes := size.servers * size.vnodes
+		vnodes := func(*backend) int { return size.vnodes }
+		buildHex := func() []string {
+			keys := make([]string, 0, nodes)
+			for _, s := range servers {
+				for i := 0; i < size.vnodes; i++ {
+					keys = append(keys, RingKey(s.url.String(), i))
+				}
+			}
+			sort.Strings(keys)
+			return keys
+		}
+		buildDigest := func() any {
+			r := newRing("")
+			r.add(vnodes, servers...)
+			return r
+		}
+		// Builds `N` rings with `build`, reporting the heap a ring holds on
+		// to per virtual node as B/node; B/op counts garbage as well.
+		measure := func(b *testing.B, build func() any) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				build()
+			}
+			b.StopTimer()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			kept := build()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(kept)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(nodes), "B/node")
+		}
+
+		name := fmt.Sprintf("servers=%d/vnodes=%d", size.servers, size.vnodes)
+		b.Run(name+"/digest/build", func(b *testing.B) {
+			measure(b, buildDigest)
+		})
+		b.Run(name+"/hex/build", func(b *testing.B) {
+			measure(b, func() any { return buildHex() })
+		})
+
+		r := buildDigest().(*ring)
+		b.Run(name+"/digest/lookup", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.lookup(saltedKey("", requests[i%len(requests)]), nil)
+			}
+		})
+		hex_keys := buildHex()
+		b.Run(name+"/hex/lookup", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sort.SearchStrings(hex_keys, hash(requests[i%len(requests)]))
+			}
+		})
+	}
+}
+
+// BenchmarkAddServerLatency registers servers with maxVirtualNodes nodes
+// each, on a ring that already has twenty such servers, while other
+// goroutines keep looking keys up the way requests do. Besides the time to
+// add a server, it reports the worst and the 99th percentile lookup, which
+// show how long requests wait on the ring lock during a registration.
+func BenchmarkAddServerLatency(b *testing.B) {
+	fairplex := newTestRing(b, 20, maxVirtualNodes)
+	keys := testKeys(1 << 12)
+	stop := make(chan struct{})
+	samples := make([][]time.Duration, 4)
+	var wg sync.WaitGroup
+	for g := range samples {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				fairplex.selectServer(keys[i%len(keys)], nil)
+				samples[g] = append(samples[g], time.Since(start))
+			}
+		}(g)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fairplex.addServer(testBackend(b, fmt.Sprintf("http://10.2.%d.%d:8080", i/256%256, i%256)))
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+
+	var lookups []time.Duration
+	for _, s := range samples {
+		lookups = append(lookups, s...)
+	}
+	slices.Sort(lookups)
+	if len(lookups) > 0 {
+		b.ReportMetric(float64(lookups[len(lookups)-1].Nanoseconds()), "max-lookup-ns")
+		b.ReportMetric(float64(lookups[len(lookups)*99/100].Nanoseconds()), "p99-lookup-ns")
+	}
+}
+
+func TestRingOrderIndependent(t *testing.T) {
+	addrs := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.4:8080"}
+	orders := [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}, {1, 3, 0, 2}}
+	keys := testKeys(2000)
+	var want_snapshot []RingNode
+	var want []string
+	for _, order := range orders {
+		fairplex := &Fairplex{VirtualNodes: 50}
+		fairplex.rebuildRing()
+		for _, i := range order {
+			register(t, fairplex, addrs[i])
+		}
+		snapshot := fairplex.RingSnapshot()
+		got := make([]string, len(keys))
+		for i, key := range keys {
+			got[i] = fairplex.selectServer(key, nil).url.String()
+		}
+		if want == nil {
+			want_snapshot, want = snapshot, got
+			continue
+		}
+		if !slices.Equal(snapshot, want_snapshot) {
+			t.Errorf("registering in order %v gives a different ring", order)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("registering in order %v routes keys differently", order)
+		}
+	}
+}
+
+func TestRingWrapsAround(t *testing.T) {
+	fairplex := newTestRing(t, 3, 10)
+	nodes := fairplex.ring.nodes
+	var past_end ringKey
+	for i := range past_end {
+		past_end[i] = 0xff
+	}
+	if got, first := fairplex.selectServer(past_end, nil), nodes[0].server; got != first {
+		t.Errorf("key past the last node went to %v, want the first node's %v", got.url, first.url)
+	}
+	if got, last := fairplex.selectServer(nodes[len(nodes)-1].key, nil), nodes[len(nodes)-1].server; got != last {
+		t.Errorf("the last node's own key went to %v, want %v", got.url, last.url)
+	}
+}
+
+func TestRingSnapshot(t *testing.T) {
+	fairplex := &Fairplex{VirtualNodes: 10}
+	fairplex.rebuildRing()
+	register(t, fairplex, "http://10.0.0.1:8080")
+	register(t, fairplex, "http://10.0.0.2:8080")
+	u, _ := url.Parse("http://10.0.1.1:8080")
+	standby := newBackend(u, true)
+	fairplex.addServer(standby)
+
+	snapshot := fairplex.RingSnapshot()
+	tests := []struct {
+		standby bool;
+		nodes int;
+	}{
+		{standby: false, nodes: 20},
+		{standby: true, nodes: 10},
+	}
+	for _, tt := range tests {
+		var pool []RingNode
+		for _, n := range snapshot {
+			if n.Standby == tt.standby {
+				pool = append(pool, n)
+			}
+		}
+		if len(pool) != tt.nodes {
+			t.Errorf("standby %v: %d nodes, want %d", tt.standby, len(pool), tt.nodes)
+		}
+		if !slices.IsSortedFunc(pool, func(a, b RingNode) int { return strings.Compare(a.Hash, b.Hash) }) {
+			t.Errorf("standby %v: nodes aren't sorted by hash", tt.standby)
+		}
+	}
+	if snapshot[len(snapshot)-1].Server != standby.url.String() {
+		t.Errorf("standby pool isn't listed last")
+	}
+
+	// The snapshot is a copy.
+	snapshot[0].Server = "http://changed:8080"
+	if fairplex.RingSnapshot()[0].Server == "http://changed:8080" {
+		t.Error("changing a snapshot changed the ring")
+	}
+}
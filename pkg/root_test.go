@@ -0,0 +1,50 @@
+package fairplex
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRootPath(t *testing.T) {
+	backend := newTestBackend(t, "a")
+	status_page := func(c *gin.Context) { c.String(http.StatusOK, "status page") }
+	tests := []struct {
+		name string;
+		fairplex *Fairplex;
+		code int;
+		body string;
+		location string;
+	}{
+		{name: "balanced", fairplex: &Fairplex{}, code: http.StatusTemporaryRedirect, location: backend.URL + "/"},
+		{name: "root handler", fairplex: &Fairplex{RootHandler: status_page}, code: http.StatusOK, body: "status page"},
+		{name: "engine route", fairplex: &Fairplex{Engine: engineWithRoot()}, code: http.StatusOK, body: "engine root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.fairplex.SetupRouter()
+			register(t, tt.fairplex, backend.URL)
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				w := serve(r, method, "/", nil)
+				if w.Code != tt.code {
+					t.Fatalf("%v /: got %d, want %d", method, w.Code, tt.code)
+				}
+				if tt.body != "" && w.Body.String() != tt.body {
+					t.Errorf("%v /: body is %q, want %q", method, w.Body, tt.body)
+				}
+				if got := w.Header().Get("Location"); tt.location != "" && got != tt.location {
+					t.Errorf("%v /: redirected to %q, want %q", method, got, tt.location)
+				}
+			}
+		})
+	}
+}
+
+// engineWithRoot returns an Engine that already serves GET and POST /.
+func engineWithRoot() *gin.Engine {
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "engine root") })
+	r.POST("/", func(c *gin.Context) { c.String(http.StatusOK, "engine root") })
+	return r
+}
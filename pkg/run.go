@@ -0,0 +1,159 @@
+package fairplex
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Listener defaults, used when the corresponding Fairplex field is zero.
+const (
+	// Long enough for slow clients uploading a body, short enough to shed slowloris.
+	defaultReadTimeout = 30 * time.Second
+	// Covers proxying a response from a slow backend.
+	defaultWriteTimeout = 60 * time.Second
+	// How long an idle keep-alive client connection is kept open.
+	defaultIdleTimeout = 120 * time.Second
+	// Same as net/http's default.
+	defaultMaxHeaderBytes = http.DefaultMaxHeaderBytes
+	// Long enough for a proxied request to a slow backend to finish.
+	defaultShutdownGracePeriod = 30 * time.Second
+)
+
+// orDefault returns `d` when `v` is zero, and no timeout when `v` is negative.
+func orDefault(v, d time.Duration) time.Duration {
+	if v == 0 {
+		return d
+	}
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// newServer creates the http.Server Run and RunTLS serve with.
+func (fairplex *Fairplex) newServer(addr string) *http.Server {
+	max_header_bytes := fairplex.MaxHeaderBytes
+	if max_header_bytes <= 0 {
+		max_header_bytes = defaultMaxHeaderBytes
+	}
+	return &http.Server{
+		Addr:           addr,
+		Handler:        fairplex.SetupRouter(),
+		ReadTimeout:    orDefault(fairplex.ReadTimeout, defaultReadTimeout),
+		WriteTimeout:   orDefault(fairplex.WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:    orDefault(fairplex.IdleTimeout, defaultIdleTimeout),
+		MaxHeaderBytes: max_header_bytes,
+	}
+}
+
+// Run loads ConfigFile (if set), sets up the router and serves on `addr`
+// until the server is closed. An addr given in the config file takes
+// precedence over `addr`. While running, SIGHUP reloads the config file.
+func (fairplex *Fairplex) Run(addr string) error {
+	return fairplex.run(addr, func(srv *http.Server) error {
+		return srv.ListenAndServe()
+	})
+}
+
+// RunTLS is like Run, but serves HTTPS using the given certificate and key
+// files. With a ClientCAFile, clients may present certificates as well.
+func (fairplex *Fairplex) RunTLS(addr, certFile, keyFile string) error {
+	return fairplex.run(addr, func(srv *http.Server) error {
+		cfg, err := fairplex.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = cfg
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	})
+}
+
+func (fairplex *Fairplex) run(addr string, listen func(*http.Server) error) error {
+	if fairplex.ConfigFile != "" {
+		cfg, err := LoadConfig(fairplex.ConfigFile)
+		if err != nil {
+			return err
+		}
+		if err := fairplex.applyConfig(cfg); err != nil {
+			return err
+		}
+		if cfg.Addr != "" {
+			addr = cfg.Addr
+		}
+	}
+	fairplex.addr = addr
+	if err := fairplex.Validate(); err != nil {
+		return err
+	}
+
+	srv := fairplex.newServer(addr)
+	fairplex.mu.Lock()
+	fairplex.server = srv
+	fairplex.mu.Unlock()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(hup)
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-hup:
+				if err := fairplex.Reload(); err != nil {
+					errorf("failed to reload config: %v\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	infof("listening on %v\n", addr)
+	err := listen(srv)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown gracefully stops a fairplex started with Run or RunTLS, making
+// it return. The health checker is stopped and the listener closed right
+// away, then in-flight requests get ShutdownGracePeriod to finish before
+// their connections are closed. RunTCP returns as well, but leaves its
+// connections open until either end closes them.
+func (fairplex *Fairplex) Shutdown() error {
+	fairplex.stopHealthChecks()
+
+	fairplex.mu.Lock()
+	srv := fairplex.server
+	tcp_listener := fairplex.tcpListener
+	fairplex.mu.Unlock()
+	if tcp_listener != nil {
+		tcp_listener.Close()
+	}
+	if srv == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	if grace := orDefault(fairplex.ShutdownGracePeriod, defaultShutdownGracePeriod); grace > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, grace)
+		defer cancel()
+	}
+	infof("shutting down, waiting for in-flight requests\n")
+	err := srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		errorf("in-flight requests didn't finish in time, closing their connections\n")
+		return srv.Close()
+	}
+	return err
+}
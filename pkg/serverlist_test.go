@@ -0,0 +1,47 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerListGuard(t *testing.T) {
+	const addr = "http://10.9.9.9:8080"
+	tests := []struct {
+		name string;
+		hide bool;
+		token string;
+		given string;
+		code int;
+	}{
+		{name: "open", code: http.StatusOK},
+		{name: "hidden", hide: true, code: http.StatusNotFound},
+		{name: "hidden, even with the token", hide: true, token: "s3cret", given: "s3cret", code: http.StatusNotFound},
+		{name: "no token", token: "s3cret", code: http.StatusUnauthorized},
+		{name: "wrong token", token: "s3cret", given: "guess", code: http.StatusUnauthorized},
+		{name: "token", token: "s3cret", given: "s3cret", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{HideServerList: tt.hide, ServerListToken: tt.token}
+			r := fairplex.SetupRouter()
+			register(t, fairplex, addr)
+			for _, path := range []string{"/servers", "/stats", "/metrics"} {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				if tt.given != "" {
+					req.Header.Set("Authorization", "Bearer "+tt.given)
+				}
+				r.ServeHTTP(w, req)
+				if w.Code != tt.code {
+					t.Errorf("GET %v: got %d, want %d", path, w.Code, tt.code)
+				}
+				if leaked := strings.Contains(w.Body.String(), "10.9.9.9"); leaked != (tt.code == http.StatusOK) {
+					t.Errorf("GET %v answered %d and named the server: %v", path, w.Code, leaked)
+				}
+			}
+		})
+	}
+}
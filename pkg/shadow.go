@@ -0,0 +1,53 @@
+package fairplex
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How long a mirrored request may take. It runs on after the client's
+// request is done, so it can't inherit its deadline.
+const shadowTimeout = 30 * time.Second
+
+// shouldMirror decides whether a request is copied to the shadow server.
+func (fairplex *Fairplex) shouldMirror() bool {
+	return fairplex.shadow != nil && rand.Float64()*100 < fairplex.ShadowPercent
+}
+
+// mirrorRequest sends a copy of the request to the shadow server in the
+// background, discarding its response. The body is read up front, and put
+// back for the real request to use; a request whose body is over
+// MaxBufferedBodyBytes isn't mirrored, nor is one with "Expect:
+// 100-continue", whose body is for the real server to ask for. Failures
+// are only logged, so the client never notices the shadow.
+func (fairplex *Fairplex) mirrorRequest(c *gin.Context, path string) {
+	if expectsContinue(c.Request) {
+		debugf("not mirroring %v, it expects 100-continue\n", path)
+		return
+	}
+	body, ok := fairplex.bufferBody(c.Request)
+	if !ok {
+		debugf("not mirroring %v, its body is over %v bytes or unreadable\n", path, fairplex.maxBufferedBodyBytes())
+		return
+	}
+
+	shadow := fairplex.shadow
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	// Built now, as the gin.Context is reused once the handler returns.
+	req := fairplex.replicaRequest(c, shadow, path, body).WithContext(ctx)
+	go func() {
+		defer cancel()
+		resp, err := shadow.transport.RoundTrip(req)
+		if err != nil {
+			debugf("error mirroring to %v: %v\n", shadow.url.String(), err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		debugf("mirrored %v to %v: %v\n", path, shadow.url.String(), resp.Status)
+	}()
+}
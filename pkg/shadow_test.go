@@ -0,0 +1,80 @@
+package fairplex
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBodyRecorder starts a server that sends every request body it gets
+// on `bodies`.
+func newBodyRecorder(t *testing.T, bodies chan<- string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMirrorBodyLimit(t *testing.T) {
+	tests := []struct {
+		name string;
+		body string;
+		expect_continue bool;
+		mirrored bool;
+	}{
+		{name: "no body", mirrored: true},
+		{name: "under limit", body: "1234", mirrored: true},
+		{name: "over limit", body: "12345", mirrored: false},
+		// Its body is only read once the server asks for it.
+		{name: "expects continue", body: "1234", expect_continue: true, mirrored: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, shadowed := make(chan string, 1), make(chan string, 1)
+			shadow_url, _ := url.Parse(newBodyRecorder(t, shadowed).URL)
+			fairplex := &Fairplex{
+				Proxy: true,
+				ShadowBackend: shadow_url,
+				ShadowPercent: 100,
+				MaxBufferedBodyBytes: 4,
+			}
+			srv := startProxy(t, fairplex)
+			register(t, fairplex, newBodyRecorder(t, primary).URL)
+
+			req, _ := http.NewRequest(http.MethodPut, srv.URL+"/x", strings.NewReader(tt.body))
+			if tt.expect_continue {
+				req.Header.Set("Expect", "100-continue")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got %d, want 200", resp.StatusCode)
+			}
+			if got := <-primary; got != tt.body {
+				t.Errorf("server got %q, want %q", got, tt.body)
+			}
+			select {
+			case got := <-shadowed:
+				if !tt.mirrored {
+					t.Errorf("mirrored a request that shouldn't have been")
+				} else if got != tt.body {
+					t.Errorf("shadow got %q, want %q", got, tt.body)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.mirrored {
+					t.Errorf("request wasn't mirrored")
+				}
+			}
+		})
+	}
+}
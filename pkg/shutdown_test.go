@@ -0,0 +1,94 @@
+package fairplex
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	tests := []struct {
+		name string;
+		grace time.Duration;
+		completes bool;
+	}{
+		{name: "within the grace period", grace: 5 * time.Second, completes: true},
+		{name: "past the grace period", grace: 50 * time.Millisecond, completes: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					close(started)
+					time.Sleep(300 * time.Millisecond)
+				}
+				io.WriteString(w, "done")
+			}))
+			t.Cleanup(srv.Close)
+
+			fairplex := &Fairplex{Proxy: true, ShutdownGracePeriod: tt.grace}
+			addr := freeAddr(t)
+			stopped := make(chan error, 1)
+			go func() { stopped <- fairplex.Run(addr) }()
+			for i := 0; ; i++ {
+				if resp, err := http.Get("http://" + addr + "/ping"); err == nil {
+					resp.Body.Close()
+					break
+				}
+				if i == 100 {
+					t.Fatal("fairplex didn't start listening")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			register(t, fairplex, srv.URL)
+
+			type result struct {
+				code int;
+				body string;
+				err error;
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + addr + "/slow")
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				results <- result{resp.StatusCode, string(body), err}
+			}()
+			<-started
+			if err := fairplex.Shutdown(); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+			if err := <-stopped; err != nil {
+				t.Errorf("Run returned %v", err)
+			}
+
+			res := <-results
+			completed := res.err == nil && res.code == http.StatusOK && res.body == "done"
+			if completed != tt.completes {
+				t.Errorf("in-flight request completed: %v, want %v (%d %q %v)", completed, tt.completes, res.code, res.body, res.err)
+			}
+			if _, err := http.Get("http://" + addr + "/ping"); err == nil {
+				t.Error("fairplex still accepts requests after Shutdown")
+			}
+		})
+	}
+}
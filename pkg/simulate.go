@@ -0,0 +1,43 @@
+package fairplex
+
+import (
+	"bufio"
+	"io"
+)
+
+// Simulate routes each key read from `keys`, one per line, the way fairplex
+// would with its Servers, StandbyServers, VirtualNodes and HashSalt, and
+// returns how many keys each server got, by URL. A key is the string hashed
+// for a request: the client's IP followed by the path without its leading
+// slash, e.g. "10.0.0.1users" for a request for /users from 10.0.0.1.
+// `weights` gives servers' weights by URL, with 1 for those left out. No
+// server is contacted and all are taken to be healthy, so Simulate is for
+// trying out virtual node counts and weights offline, on a Fairplex that
+// isn't serving.
+func (fairplex *Fairplex) Simulate(keys io.Reader, weights map[string]float64) (map[string]int, error) {
+	fairplex.VirtualNodes = checkVirtualNodes(fairplex.VirtualNodes)
+	fairplex.mu.Lock()
+	fairplex.backends = make(map[string]*backend)
+	for _, u := range fairplex.Servers {
+		fairplex.backends[u.String()] = newBackend(u, false)
+	}
+	for _, u := range fairplex.StandbyServers {
+		fairplex.backends[u.String()] = newBackend(u, true)
+	}
+	for addr, weight := range weights {
+		if b, ok := fairplex.backends[addr]; ok {
+			b.weight = weight
+		}
+	}
+	fairplex.rebuildRingLocked()
+	fairplex.mu.Unlock()
+
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(keys)
+	for scanner.Scan() {
+		if b := fairplex.selectServer(saltedKey(fairplex.HashSalt, scanner.Text()), nil); b != nil {
+			counts[b.url.String()]++
+		}
+	}
+	return counts, scanner.Err()
+}
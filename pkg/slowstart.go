@@ -0,0 +1,43 @@
+package fairplex
+
+import (
+	"time"
+)
+
+// The number of steps a warm-up ramps a server's virtual nodes up in.
+const warmUpSteps = 10
+
+// startWarmUp gives `b` a single virtual node and then ramps it up to its
+// full share over SlowStartDuration, so a cold server isn't handed all of
+// its traffic at once. Servers down for maintenance are left alone.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) startWarmUp(b *backend) {
+	if b.maintenance {
+		return
+	}
+	b.warmUps++
+	warm_up := b.warmUps
+	duration := fairplex.SlowStartDuration
+	fairplex.setNodes(b, 1)
+	infof("warming up server %v over %v\n", b.url.String(), duration)
+
+	go func() {
+		for step := 1; step <= warmUpSteps; step++ {
+			time.Sleep(duration / warmUpSteps)
+
+			fairplex.mu.Lock()
+			if b.warmUps != warm_up {
+				fairplex.mu.Unlock()
+				return
+			}
+			full := fairplex.nodesFor(b)
+			vnodes := (full*step + warmUpSteps - 1) / warmUpSteps
+			if vnodes < 1 {
+				vnodes = 1
+			}
+			fairplex.setNodes(b, vnodes)
+			fairplex.mu.Unlock()
+		}
+		debugf("server %v is warmed up\n", b.url.String())
+	}()
+}
@@ -0,0 +1,43 @@
+package fairplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowStartRampsShare(t *testing.T) {
+	const duration = 200 * time.Millisecond
+	fairplex := &Fairplex{VirtualNodes: 100, SlowStartDuration: duration}
+	fairplex.SetupRouter()
+	register(t, fairplex, "http://10.0.0.1:8080")
+	time.Sleep(duration + 50*time.Millisecond)
+
+	keys := testKeys(4000)
+	share := func(b *backend) float64 {
+		n := 0
+		for _, key := range keys {
+			if fairplex.selectServer(key, nil) == b {
+				n++
+			}
+		}
+		return float64(n) / float64(len(keys))
+	}
+	warming := register(t, fairplex, "http://10.0.0.2:8080")
+	var shares []float64
+	for i := 0; i < 8; i++ {
+		shares = append(shares, share(warming))
+		time.Sleep(duration / 6)
+	}
+
+	if shares[0] > 0.1 {
+		t.Errorf("new server started with %.2f of keys, want a small share: %.2f", shares[0], shares)
+	}
+	for i := 1; i < len(shares); i++ {
+		if shares[i] < shares[i-1] {
+			t.Errorf("share fell from %.2f to %.2f while warming up: %.2f", shares[i-1], shares[i], shares)
+		}
+	}
+	if last := shares[len(shares)-1]; last < 0.35 {
+		t.Errorf("new server ended with %.2f of keys, want about half: %.2f", last, shares)
+	}
+}
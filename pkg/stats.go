@@ -0,0 +1,374 @@
+package fairplex
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The maximum number of distinct clients whose rejections are counted
+// individually. Past this, rejections only count towards the total.
+const maxTrackedClients = 1000
+
+// stats holds the counters behind /stats and /metrics.
+type stats struct {
+	mu sync.Mutex;
+	// Number of requests rejected by the rate limiter.
+	rateLimited uint64;
+	// Number of requests rejected by the rate limiter, by client IP.
+	rateLimitedByClient map[string]uint64;
+	// Time spent choosing a server and setting up the request to it.
+	routing latencyStats;
+	// Number of balanced requests given a server, and how many of those
+	// were degraded: sent to a standby or fallback server, or failed over.
+	// Not guarded by mu.
+	routed atomic.Uint64;
+	degraded atomic.Uint64;
+}
+
+// isDegraded reports whether sending a request to `b` degrades it: `b` is
+// a standby server or the FallbackBackend.
+func (fairplex *Fairplex) isDegraded(b *backend) bool {
+	return b.standby || b == fairplex.fallback
+}
+
+// recordRouted counts a balanced request sent to `b`, as degraded if
+// isDegraded.
+func (fairplex *Fairplex) recordRouted(b *backend) {
+	fairplex.stats.routed.Add(1)
+	if fairplex.isDegraded(b) {
+		fairplex.stats.degraded.Add(1)
+	}
+}
+
+// degradedRatio returns the fraction of routed requests that were degraded,
+// or zero if none were routed yet.
+func (s *stats) degradedRatio() float64 {
+	routed := s.routed.Load()
+	if routed == 0 {
+		return 0
+	}
+	return float64(s.degraded.Load()) / float64(routed)
+}
+
+func (s *stats) recordRateLimited(client string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimited++
+	if s.rateLimitedByClient == nil {
+		s.rateLimitedByClient = make(map[string]uint64)
+	}
+	if _, ok := s.rateLimitedByClient[client]; ok || len(s.rateLimitedByClient) < maxTrackedClients {
+		s.rateLimitedByClient[client]++
+	}
+}
+
+// The upper bounds, in seconds, of the routing latency histogram's buckets.
+var latencyBuckets = [...]float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025}
+
+// The number of most recent samples routing latency percentiles are taken from.
+const latencySamples = 1024
+
+// latencyStats is a histogram of latencies, plus a window of the most
+// recent ones to take percentiles from.
+type latencyStats struct {
+	mu sync.Mutex;
+	// Samples per bucket of latencyBuckets, not cumulative; the last one
+	// counts those above every bound.
+	buckets [len(latencyBuckets) + 1]uint64;
+	count uint64;
+	sum time.Duration;
+	recent [latencySamples]time.Duration;
+}
+
+func (l *latencyStats) record(d time.Duration) {
+	i := sort.SearchFloat64s(latencyBuckets[:], d.Seconds())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent[l.count%latencySamples] = d
+	l.buckets[i]++
+	l.count++
+	l.sum += d
+}
+
+// percentiles returns the given percentiles of the recent samples, in
+// milliseconds, or nothing if there are none.
+func (l *latencyStats) percentiles(ps ...float64) []float64 {
+	l.mu.Lock()
+	samples := make([]time.Duration, min(l.count, latencySamples))
+	copy(samples, l.recent[:])
+	l.mu.Unlock()
+	if len(samples) == 0 {
+		return nil
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	values := make([]float64, len(ps))
+	for i, p := range ps {
+		rank := int(math.Ceil(p/100*float64(len(samples)))) - 1
+		values[i] = float64(samples[max(rank, 0)]) / float64(time.Millisecond)
+	}
+	return values
+}
+
+// writeHistogram writes the histogram as the Prometheus metric `name`.
+func (l *latencyStats) writeHistogram(w io.Writer, name, help string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	metricHeader(w, name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += l.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, l.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, l.sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, l.count)
+}
+
+// rateMeter counts events per wall-clock second, reporting the count of
+// the last complete second.
+type rateMeter struct {
+	mu sync.Mutex;
+	second time.Time;
+	count int;
+	last int;
+}
+
+func (m *rateMeter) advance(now time.Time) {
+	second := now.Truncate(time.Second)
+	if second.Equal(m.second) {
+		return
+	}
+	if second.Sub(m.second) == time.Second {
+		m.last = m.count
+	} else {
+		m.last = 0
+	}
+	m.second = second
+	m.count = 0
+}
+
+func (m *rateMeter) mark(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	m.count++
+}
+
+// perSecond returns the number of events in the last complete second.
+func (m *rateMeter) perSecond(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	return m.last
+}
+
+// How much each new sample moves an ewma: with 0.1, the last ten or so
+// samples make up most of the average.
+const ewmaWeight = 0.1
+
+// ewma is an exponentially weighted moving average of durations.
+type ewma struct {
+	mu sync.Mutex;
+	// Zero until the first sample.
+	average time.Duration;
+}
+
+func (e *ewma) record(d time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.average == 0 {
+		e.average = d
+	} else {
+		e.average += time.Duration(ewmaWeight * float64(d-e.average))
+	}
+}
+
+// value returns the average, or zero if nothing was recorded yet.
+func (e *ewma) value() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.average
+}
+
+// sortedBackends returns every registered server, sorted by URL.
+func (fairplex *Fairplex) sortedBackends() []*backend {
+	fairplex.mu.Lock()
+	backends := make([]*backend, 0, len(fairplex.backends))
+	for _, b := range fairplex.backends {
+		backends = append(backends, b)
+	}
+	fairplex.mu.Unlock()
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].url.String() < backends[j].url.String()
+	})
+	return backends
+}
+
+// serverStats returns the stats of every registered server, sorted by URL.
+func (fairplex *Fairplex) serverStats() []gin.H {
+	backends := fairplex.sortedBackends()
+	now := time.Now()
+	servers := make([]gin.H, 0, len(backends))
+	for _, b := range backends {
+		servers = append(servers, fairplex.serverStat(b, now))
+	}
+	return servers
+}
+
+// serverStat returns the stats of `b` listed in /stats.
+func (fairplex *Fairplex) serverStat(b *backend, now time.Time) gin.H {
+	rate_limit := 0.0
+	if b.limiter != nil {
+		rate_limit = float64(b.limiter.Limit())
+	}
+	fairplex.mu.Lock()
+	weight := b.weight
+	fairplex.mu.Unlock()
+	if weight == 0 {
+		weight = 1
+	}
+	var last_routed *time.Time
+	if ns := b.lastRouted.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		last_routed = &t
+	}
+	return gin.H{
+		"url": b.url.String(),
+		"name": b.name,
+		"zone": b.zone,
+		"weight": weight,
+		"rate_limit": rate_limit,
+		"current_rate": b.meter.perSecond(now),
+		"requests": b.requests.Load(),
+		"in_flight": b.inFlight.Load(),
+		"latency_ms": float64(b.latency.value()) / float64(time.Millisecond),
+		"last_routed": last_routed,
+	}
+}
+
+// serverStatsHandler serves GET /servers/:id/stats, the stats of the one
+// server with the name or URL `id`, along with its health and its share of
+// the ring.
+func (fairplex *Fairplex) serverStatsHandler(c *gin.Context) {
+	id := c.Param("id")
+	var b *backend
+	if u, err := url.Parse(id); err == nil {
+		normalizeURL(u)
+		fairplex.mu.Lock()
+		b = fairplex.backends[u.String()]
+		fairplex.mu.Unlock()
+	}
+	if b == nil {
+		for _, candidate := range fairplex.sortedBackends() {
+			if candidate.name != "" && candidate.name == id {
+				b = candidate
+				break
+			}
+		}
+	}
+	if b == nil {
+		c.JSON(http.StatusNotFound, gin.H{"status": "error", "reason": "server not registered"})
+		return
+	}
+
+	stat := fairplex.serverStat(b, time.Now())
+	fairplex.mu.Lock()
+	stat["nodes"] = b.nodes
+	stat["ring_share"] = fairplex.ringShare(b)
+	fairplex.mu.Unlock()
+	stat["pool"] = "primary"
+	if b.standby {
+		stat["pool"] = "standby"
+	}
+	stat["healthy"] = b.healthy.Load()
+	stat["failed_probes"] = b.failedProbes.Load()
+	c.JSON(http.StatusOK, stat)
+}
+
+// statsHandler serves GET /stats.
+func (fairplex *Fairplex) statsHandler(c *gin.Context) {
+	s := &fairplex.stats
+	s.mu.Lock()
+	by_client := make(map[string]uint64, len(s.rateLimitedByClient))
+	for client, n := range s.rateLimitedByClient {
+		by_client[client] = n
+	}
+	rate_limited := gin.H{"total": s.rateLimited, "by_client": by_client}
+	s.mu.Unlock()
+
+	routing_latency := gin.H{}
+	if ps := s.routing.percentiles(50, 95, 99); ps != nil {
+		routing_latency = gin.H{"p50_ms": ps[0], "p95_ms": ps[1], "p99_ms": ps[2]}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rate_limited": rate_limited,
+		"routing_latency": routing_latency,
+		"degraded": gin.H{"routed": s.routed.Load(), "degraded": s.degraded.Load(), "ratio": s.degradedRatio()},
+		"active_pool": fairplex.activePool(),
+		"drained": fairplex.isDrained(),
+		"servers": fairplex.serverStats(),
+	})
+}
+
+// metricHeader writes the HELP and TYPE lines of a metric.
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format.
+func (fairplex *Fairplex) metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	w := c.Writer
+
+	backends := fairplex.sortedBackends()
+	metricHeader(w, "fairplex_server_requests_total", "counter", "Requests routed to each server.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "fairplex_server_requests_total{server=%s} %d\n", strconv.Quote(b.url.String()), b.requests.Load())
+	}
+	metricHeader(w, "fairplex_server_last_routed_timestamp_seconds", "gauge", "When a request was last routed to each server, as a Unix timestamp.")
+	for _, b := range backends {
+		if ns := b.lastRouted.Load(); ns != 0 {
+			fmt.Fprintf(w, "fairplex_server_last_routed_timestamp_seconds{server=%s} %g\n", strconv.Quote(b.url.String()), float64(ns)/1e9)
+		}
+	}
+
+	s := &fairplex.stats
+	metricHeader(w, "fairplex_routed_requests_total", "counter", "Balanced requests given a server.")
+	fmt.Fprintf(w, "fairplex_routed_requests_total %d\n", s.routed.Load())
+	metricHeader(w, "fairplex_degraded_requests_total", "counter", "Balanced requests sent to a standby or fallback server, or failed over to another server.")
+	fmt.Fprintf(w, "fairplex_degraded_requests_total %d\n", s.degraded.Load())
+	metricHeader(w, "fairplex_degraded_ratio", "gauge", "Fraction of routed requests that were degraded, since fairplex started.")
+	fmt.Fprintf(w, "fairplex_degraded_ratio %g\n", s.degradedRatio())
+	s.routing.writeHistogram(w, "fairplex_routing_latency_seconds", "Time spent choosing a server and setting up the request to it, excluding the server's own time.")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metricHeader(w, "fairplex_rate_limited_total", "counter", "Requests rejected by the rate limiter.")
+	fmt.Fprintf(w, "fairplex_rate_limited_total %d\n", s.rateLimited)
+
+	clients := make([]string, 0, len(s.rateLimitedByClient))
+	for client := range s.rateLimitedByClient {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	metricHeader(w, "fairplex_rate_limited_by_client_total", "counter", "Requests rejected by the rate limiter, by client IP (or certificate subject, with ClientCertIdentity).")
+	for _, client := range clients {
+		fmt.Fprintf(w, "fairplex_rate_limited_by_client_total{client=%s} %d\n", strconv.Quote(client), s.rateLimitedByClient[client])
+	}
+}
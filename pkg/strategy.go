@@ -0,0 +1,96 @@
+package fairplex
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+)
+
+// Strategy is how a server is picked for a request.
+type Strategy int
+
+const (
+	// StrategyConsistentHash sends a request to the owner of its client and
+	// path on the hash ring, so the same client and path keep going to the
+	// same server. This is the default.
+	StrategyConsistentHash Strategy = iota
+	// StrategyP2C, "power of two choices", picks two healthy servers at
+	// random and sends the request to the one with fewer requests in
+	// flight. It evens out load across a stateless pool, but gives up the
+	// ring's affinity. In-flight requests are only counted in proxy mode;
+	// when redirecting, it amounts to a random pick.
+	StrategyP2C
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case StrategyConsistentHash:
+		return "consistent_hash"
+	case StrategyP2C:
+		return "p2c"
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// selectP2C picks a server from the active pool, or the other pool if none
+// of the active pool's servers are healthy, by the power of two choices.
+// Servers in fairplex's Zone are chosen between first. Servers for which
+// `accept` (which may be nil) returns false are skipped.
+func (fairplex *Fairplex) selectP2C(accept func(*backend) bool) *backend {
+	fairplex.mu.Lock()
+	candidates := fairplex.p2cCandidates(fairplex.standbyActive)
+	if len(candidates) == 0 {
+		candidates = fairplex.p2cCandidates(!fairplex.standbyActive)
+	}
+	fairplex.mu.Unlock()
+
+	if fairplex.Zone != "" {
+		local := slices.DeleteFunc(slices.Clone(candidates), func(b *backend) bool { return b.zone != fairplex.Zone })
+		remote := slices.DeleteFunc(candidates, func(b *backend) bool { return b.zone == fairplex.Zone })
+		candidates = append(twoChoices(local), twoChoices(remote)...)
+	} else {
+		candidates = twoChoices(candidates)
+	}
+	// Accept is only asked about a server once it would be picked, as it
+	// may take a rate limit token.
+	for _, b := range candidates {
+		if accept == nil || accept(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// twoChoices shuffles `candidates` and puts the less loaded of the first two
+// first, giving the order they're tried in: the less loaded of two, then the
+// other, then anyone else.
+func twoChoices(candidates []*backend) []*backend {
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) >= 2 && candidates[1].inFlight.Load() < candidates[0].inFlight.Load() {
+		candidates[0], candidates[1] = candidates[1], candidates[0]
+	}
+	return candidates
+}
+
+// inZone wraps `accept` (which may be nil) to only accept servers in
+// fairplex's Zone.
+func (fairplex *Fairplex) inZone(accept func(*backend) bool) func(*backend) bool {
+	return func(b *backend) bool {
+		return b.zone == fairplex.Zone && (accept == nil || accept(b))
+	}
+}
+
+// p2cCandidates returns the servers of the standby or primary pool that
+// could take a request: those in the ring, healthy and not cooling down.
+// Callers must hold fairplex.mu.
+func (fairplex *Fairplex) p2cCandidates(standby bool) []*backend {
+	var candidates []*backend
+	for _, b := range fairplex.backends {
+		if b.standby == standby && b.nodes > 0 && eligible(b, nil) {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates
+}
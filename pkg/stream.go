@@ -0,0 +1,117 @@
+package fairplex
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isStream reports whether `resp` is a stream of server-sent events.
+func isStream(resp *http.Response) bool {
+	media_type, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return media_type == "text/event-stream"
+}
+
+// startStream prepares the client's connection for the event stream in
+// `resp`: StreamTimeout replaces the server's WriteTimeout, and with a
+// StreamKeepAlive, comments are sent while the server is quiet.
+func (fairplex *Fairplex) startStream(c *gin.Context, resp *http.Response) {
+	var deadline time.Time
+	if fairplex.StreamTimeout > 0 {
+		deadline = time.Now().Add(fairplex.StreamTimeout)
+	}
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(deadline); err != nil {
+		debugf("can't lift the write deadline of a stream: %v\n", err)
+	}
+	if fairplex.StreamKeepAlive > 0 {
+		resp.Body = newKeepAliveBody(resp.Body, fairplex.StreamKeepAlive)
+	}
+}
+
+// The comment sent to keep a quiet event stream alive. Clients ignore it.
+var keepAliveComment = []byte(": keep-alive\n\n")
+
+// keepAliveBody is an event stream that yields keepAliveComment whenever the
+// underlying stream has been quiet for `interval` at the end of an event, so
+// the comment never lands in the middle of one.
+type keepAliveBody struct {
+	body io.ReadCloser;
+	interval time.Duration;
+	// Filled by a goroutine reading `body`, and closed once it's done.
+	chunks chan []byte;
+	err error;
+	// Closed by Close, to stop the goroutine.
+	done chan struct{};
+	// What's left of the last chunk.
+	pending []byte;
+	// The last few bytes yielded, to tell whether they end an event.
+	tail []byte;
+}
+
+func newKeepAliveBody(body io.ReadCloser, interval time.Duration) *keepAliveBody {
+	k := &keepAliveBody{body: body, interval: interval, chunks: make(chan []byte), done: make(chan struct{})}
+	go k.fill()
+	return k
+}
+
+func (k *keepAliveBody) fill() {
+	defer close(k.chunks)
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := k.body.Read(buf)
+		if n > 0 {
+			select {
+			case k.chunks <- buf[:n]:
+			case <-k.done:
+				return
+			}
+		}
+		if err != nil {
+			// Read by Read only once chunks is closed.
+			k.err = err
+			return
+		}
+	}
+}
+
+func (k *keepAliveBody) Read(p []byte) (int, error) {
+	if len(k.pending) == 0 {
+		timer := time.NewTimer(k.interval)
+		defer timer.Stop()
+		for len(k.pending) == 0 {
+			select {
+			case chunk, ok := <-k.chunks:
+				if !ok {
+					return 0, k.err
+				}
+				k.pending = chunk
+			case <-timer.C:
+				if k.betweenEvents() {
+					k.pending = keepAliveComment
+				} else {
+					timer.Reset(k.interval)
+				}
+			}
+		}
+	}
+	n := copy(p, k.pending)
+	k.pending = k.pending[n:]
+	k.tail = append(k.tail, p[:n]...)
+	k.tail = k.tail[max(len(k.tail)-4, 0):]
+	return n, nil
+}
+
+// betweenEvents reports whether what's been yielded so far, if anything,
+// ends with an event.
+func (k *keepAliveBody) betweenEvents() bool {
+	return len(k.tail) == 0 || bytes.HasSuffix(k.tail, []byte("\n\n")) || bytes.HasSuffix(k.tail, []byte("\r\n\r\n"))
+}
+
+func (k *keepAliveBody) Close() error {
+	close(k.done)
+	return k.body.Close()
+}
@@ -0,0 +1,61 @@
+package fairplex
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLongLivedStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(150 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name string;
+		path string;
+		keep_alive time.Duration;
+		complete bool;
+		comments bool;
+	}{
+		{name: "stream outlives WriteTimeout", path: "/events", complete: true},
+		{name: "stream with keep-alives", path: "/events", keep_alive: 50 * time.Millisecond, complete: true, comments: true},
+		{name: "other responses cut off", path: "/slow", complete: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{Proxy: true, WriteTimeout: 200 * time.Millisecond, StreamKeepAlive: tt.keep_alive}
+			proxy := httptest.NewUnstartedServer(nil)
+			proxy.Config = fairplex.newServer("")
+			proxy.Start()
+			t.Cleanup(proxy.Close)
+			register(t, fairplex, srv.URL)
+
+			resp, err := http.Get(proxy.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			complete := err == nil && strings.Contains(string(body), "data: 3\n\n")
+			if complete != tt.complete {
+				t.Errorf("got all four events: %v, want %v (%q, %v)", complete, tt.complete, body, err)
+			}
+			if comments := strings.Contains(string(body), ": keep-alive\n\n"); comments != tt.comments {
+				t.Errorf("keep-alive comments sent: %v, want %v", comments, tt.comments)
+			}
+		})
+	}
+}
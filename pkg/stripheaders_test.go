@@ -0,0 +1,62 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestStripRequestHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.Write([]byte("pong"))
+			return
+		}
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(srv.Close)
+	fairplex := &Fairplex{Proxy: true, StripRequestHeaders: []string{"Authorization", "cookie"}}
+	proxy := startProxy(t, fairplex)
+	// Headers given at registration are still added.
+	postServer(t, proxy.Config.Handler, url.Values{"addr": {srv.URL}, "headers": {"X-Registered: yes"}})
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/users", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic eA==")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("X-Kept", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got http.Header
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header string;
+		present bool;
+	}{
+		{header: "Authorization", present: false},
+		{header: "Cookie", present: false},
+		{header: "X-Hop", present: false},
+		{header: "Keep-Alive", present: false},
+		{header: "Proxy-Authorization", present: false},
+		{header: "Upgrade", present: false},
+		{header: "X-Kept", present: true},
+		{header: "X-Registered", present: true},
+	}
+	for _, tt := range tests {
+		if present := got.Get(tt.header) != ""; present != tt.present {
+			t.Errorf("%v reached the server: %v, want %v", tt.header, present, tt.present)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package fairplex
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Run with -race: lookups during SetServers must see the old ring or the
+// new one in full.
+func TestSetServersSwapsRingAtomically(t *testing.T) {
+	pool := func(first, n int) []*url.URL {
+		var servers []*url.URL
+		for i := first; i < first+n; i++ {
+			u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i))
+			servers = append(servers, u)
+		}
+		return servers
+	}
+	// The pools overlap, so a half-built ring would route some keys to
+	// servers neither full ring gives them to.
+	old_servers, new_servers := pool(0, 6), pool(3, 6)
+	keys := testKeys(500)
+
+	expected := func(servers []*url.URL) []string {
+		fairplex := &Fairplex{VirtualNodes: 20}
+		fairplex.SetServers(servers, nil)
+		owners := make([]string, len(keys))
+		for i, key := range keys {
+			owners[i] = fairplex.selectServer(key, nil).url.String()
+		}
+		return owners
+	}
+	old_owners, new_owners := expected(old_servers), expected(new_servers)
+
+	fairplex := &Fairplex{VirtualNodes: 20}
+	fairplex.SetServers(old_servers, nil)
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() {
+				for i, key := range keys {
+					b := fairplex.selectServer(key, nil)
+					if b == nil {
+						t.Error("no server selected during a swap")
+						return
+					}
+					if owner := b.url.String(); owner != old_owners[i] && owner != new_owners[i] {
+						t.Errorf("key %d went to %v, which owns it in neither ring", i, owner)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			fairplex.SetServers(new_servers, nil)
+		} else {
+			fairplex.SetServers(old_servers, nil)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
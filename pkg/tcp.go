@@ -0,0 +1,130 @@
+package fairplex
+
+import (
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// checkTCP checks a tcp server at `addr` accepts connections, like
+// checkAddr does for an http one.
+func checkTCP(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+	if err != nil {
+		var net_err net.Error
+		if errors.As(err, &net_err) && net_err.Timeout() {
+			return &addrError{"timeout", err}
+		}
+		return &addrError{"unreachable", err}
+	}
+	conn.Close()
+	return nil
+}
+
+// isTCP reports whether `b` is a tcp server, for RunTCP.
+func isTCP(b *backend) bool {
+	return b.url.Scheme == "tcp"
+}
+
+// isHTTP reports whether `b` is an http or https server, for Run.
+func isHTTP(b *backend) bool {
+	return !isTCP(b)
+}
+
+// RunTCP balances raw TCP connections on `addr` over the tcp servers
+// (registered as e.g. "tcp://db:5432") until Shutdown, for servers that
+// don't speak HTTP. A connection goes to the server the ring gives for the
+// client's IP, so each client keeps going to the same server, and its bytes
+// are relayed both ways until both ends are done sending. If a server can't
+// be connected to, the next is tried, up to MaxFailoverAttempts servers.
+// tcp servers are health checked by connecting to them. RunTCP serves no
+// admin routes; run Run on another address for those, with the same
+// Fairplex.
+func (fairplex *Fairplex) RunTCP(addr string) error {
+	if err := fairplex.Validate(); err != nil {
+		return err
+	}
+	fairplex.setup()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fairplex.mu.Lock()
+	fairplex.tcpListener = ln
+	fairplex.mu.Unlock()
+
+	infof("listening for tcp on %v\n", addr)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go fairplex.relayConn(conn)
+	}
+}
+
+// relayConn connects the client `conn` to a tcp server and relays between
+// the two until both ends are done.
+func (fairplex *Fairplex) relayConn(conn net.Conn) {
+	defer conn.Close()
+	started := time.Now()
+	client := clientHost(conn.RemoteAddr().String())
+	key := saltedKey(fairplex.HashSalt, client)
+
+	var tried []*backend
+	var b *backend
+	var server net.Conn
+	for len(tried) < fairplex.maxFailoverAttempts() {
+		b = fairplex.selectServer(key, func(s *backend) bool {
+			return isTCP(s) && !slices.Contains(tried, s) && s.allowRequest()
+		})
+		if b == nil {
+			break
+		}
+		tried = append(tried, b)
+		var err error
+		if server, err = net.DialTimeout("tcp", b.url.Host, orDefault(fairplex.DialTimeout, healthCheckTimeout)); err == nil {
+			break
+		}
+		errorf("error connecting to %v: %v\n", b.url.String(), err)
+		server = nil
+	}
+	if server == nil {
+		errorf("no reachable tcp server for %v after %v attempts\n", client, len(tried))
+		return
+	}
+	defer server.Close()
+	fairplex.stats.routing.record(time.Since(started))
+	b.routed(time.Now())
+	fairplex.stats.routed.Add(1)
+	if len(tried) > 1 || fairplex.isDegraded(b) {
+		fairplex.stats.degraded.Add(1)
+	}
+	b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	debugf("relaying %v to %v\n", client, b.url.String())
+
+	done := make(chan struct{})
+	go func() {
+		relay(server, conn)
+		close(done)
+	}()
+	relay(conn, server)
+	<-done
+}
+
+// relay copies from `src` to `dst` until `src` is done sending, then tells
+// `dst` nothing more is coming, leaving the other direction open.
+func relay(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
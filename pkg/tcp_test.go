@@ -0,0 +1,84 @@
+package fairplex
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// listenTCP starts a listener accepting and closing connections, standing
+// in for a tcp server.
+func listenTCP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return "tcp://" + ln.Addr().String()
+}
+
+func TestHTTPSkipsTCPServers(t *testing.T) {
+	fallback := newTestBackend(t, "fallback")
+	fallback_url, _ := url.Parse(fallback.URL)
+	tests := []struct {
+		name string;
+		fallback *url.URL;
+		want int;
+	}{
+		{name: "fallback", fallback: fallback_url, want: http.StatusTemporaryRedirect},
+		{name: "no fallback", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{FallbackBackend: tt.fallback}
+			r := fairplex.SetupRouter()
+			register(t, fairplex, listenTCP(t))
+			w := serve(r, http.MethodGet, "/x", nil)
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d: %v", w.Code, tt.want, w.Body)
+			}
+			if tt.fallback != nil {
+				if loc := w.Header().Get("Location"); loc != fallback.URL+"/x" {
+					t.Errorf("redirected to %v, want the fallback", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolHealthIgnoresTCP(t *testing.T) {
+	tests := []struct {
+		name string;
+		primary []string;
+		want string;
+	}{
+		{name: "http down, tcp up", primary: []string{deadAddr(t), listenTCP(t)}, want: "standby"},
+		{name: "tcp only", primary: []string{listenTCP(t)}, want: "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{FailoverHysteresis: 1}
+			fairplex.SetupRouter()
+			for _, addr := range tt.primary {
+				register(t, fairplex, addr)
+			}
+			u, _ := url.Parse(newTestBackend(t, "standby").URL)
+			fairplex.addServer(newBackend(u, true))
+			fairplex.checkHealth()
+			if pool := fairplex.activePool(); pool != tt.want {
+				t.Errorf("active pool is %v, want %v", pool, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package fairplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name string;
+		handler func(c *gin.Context, status int);
+		body string;
+	}{
+		{name: "json", body: `"reason":"backend timed out"`},
+		{name: "error handler", handler: func(c *gin.Context, status int) {
+			c.String(status, "custom %d", status)
+		}, body: "custom 504"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+				}
+			}))
+			defer slow.Close()
+			fairplex := &Fairplex{Proxy: true, RequestTimeout: 50 * time.Millisecond, ErrorHandler: tt.handler}
+			srv := startProxy(t, fairplex)
+			register(t, fairplex, slow.URL)
+
+			status, body := send(t, http.MethodGet, srv.URL+"/x", nil)
+			if status != http.StatusGatewayTimeout || !strings.Contains(body, tt.body) {
+				t.Errorf("got %d %q, want 504 with %q", status, body, tt.body)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutBoundsPipeline(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	tests := []struct {
+		name string;
+		timeout time.Duration;
+		want int;
+	}{
+		{name: "over the deadline", timeout: 50 * time.Millisecond, want: http.StatusGatewayTimeout},
+		{name: "no deadline", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fairplex := &Fairplex{Proxy: true, RequestTimeout: tt.timeout}
+			srv := startProxy(t, fairplex)
+			register(t, fairplex, slow.URL)
+			start := time.Now()
+			status, _ := send(t, http.MethodGet, srv.URL+"/x", nil)
+			elapsed := time.Since(start)
+			if status != tt.want {
+				t.Fatalf("got %d, want %d", status, tt.want)
+			}
+			if tt.timeout > 0 && elapsed > 200*time.Millisecond {
+				t.Errorf("request took %v with a %v RequestTimeout", elapsed, tt.timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package fairplex
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// serverTLSConfig builds the TLS config RunTLS serves with from
+// ClientCAFile. It returns nil if that isn't set.
+func (fairplex *Fairplex) serverTLSConfig() (*tls.Config, error) {
+	if fairplex.ClientCAFile == "" {
+		return nil, nil
+	}
+	pool, err := loadCertPool(fairplex.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
+
+// certSubject returns the identity `cert` was issued to: its common name,
+// or if it has none, its first DNS name, URI or email address.
+func certSubject(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// loadCertPool reads the PEM certificates in `path` into a pool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA certificates: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %v", path)
+	}
+	return pool, nil
+}
+
+// clientTLSConfig builds the TLS config fairplex connects to https servers
+// with from InsecureSkipVerify, ClientCertFile, ClientKeyFile and
+// CACertFile. It returns nil if none of them are set.
+func (fairplex *Fairplex) clientTLSConfig() (*tls.Config, error) {
+	if !fairplex.InsecureSkipVerify && fairplex.ClientCertFile == "" && fairplex.ClientKeyFile == "" && fairplex.CACertFile == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: fairplex.InsecureSkipVerify}
+	if fairplex.ClientCertFile != "" || fairplex.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(fairplex.ClientCertFile, fairplex.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if fairplex.CACertFile != "" {
+		pool, err := loadCertPool(fairplex.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
@@ -0,0 +1,231 @@
+package fairplex
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs certificates for tests.
+type testCA struct {
+	cert *x509.Certificate;
+	key *ecdsa.PrivateKey;
+	// Path of the CA certificate in PEM.
+	file string;
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IsCA: true,
+		KeyUsage: x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, file, "CERTIFICATE", der)
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue signs a certificate for `name`, valid for 127.0.0.1 as well, and
+// returns it along with the paths of it and its key in PEM.
+func (ca *testCA) issue(t *testing.T, name string) (tls.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cert_file, key_file := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePEM(t, cert_file, "CERTIFICATE", der)
+	writePEM(t, key_file, "EC PRIVATE KEY", key_der)
+	cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, cert_file, key_file
+}
+
+func writePEM(t *testing.T, file, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server_cert, _, _ := ca.issue(t, "backend")
+	_, client_cert, client_key := ca.issue(t, "fairplex")
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			io.WriteString(w, "pong")
+			return
+		}
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{server_cert},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name string;
+		fairplex *Fairplex;
+		register int;
+		proxied int;
+		body string;
+	}{
+		{
+			name: "client certificate",
+			fairplex: &Fairplex{Proxy: true, ClientCertFile: client_cert, ClientKeyFile: client_key, CACertFile: ca.file},
+			register: http.StatusOK,
+			proxied: http.StatusOK,
+			body: "fairplex",
+		},
+		{
+			name: "no client certificate",
+			fairplex: &Fairplex{Proxy: true, CACertFile: ca.file},
+			register: http.StatusNotAcceptable,
+			proxied: http.StatusBadGateway,
+		},
+		{
+			name: "unknown server CA",
+			fairplex: &Fairplex{Proxy: true, ClientCertFile: client_cert, ClientKeyFile: client_key},
+			register: http.StatusNotAcceptable,
+			proxied: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := startProxy(t, tt.fairplex)
+			w := serveForm(proxy.Config.Handler, http.MethodPost, "/servers", url.Values{"addr": {srv.URL}})
+			if w.Code != tt.register {
+				t.Errorf("registering got %d, want %d: %v", w.Code, tt.register, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				register(t, tt.fairplex, srv.URL)
+			}
+			code, body := send(t, http.MethodGet, proxy.URL+"/whoami", nil)
+			if code != tt.proxied || (tt.body != "" && body != tt.body) {
+				t.Errorf("proxied request got %d %q, want %d %q", code, body, tt.proxied, tt.body)
+			}
+		})
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	server_cert, _, _ := ca.issue(t, "fairplex")
+	alice, _, _ := ca.issue(t, "alice")
+	bob, _, _ := ca.issue(t, "bob")
+
+	fairplex := &Fairplex{ClientCAFile: ca.file, ClientCertIdentity: true, RequestsPerMinute: 1, VirtualNodes: 10}
+	srv := httptest.NewUnstartedServer(fairplex.SetupRouter())
+	cfg, err := fairplex.serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Certificates = []tls.Certificate{server_cert}
+	srv.TLS = cfg
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	for i := 0; i < 5; i++ {
+		register(t, fairplex, fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := func(cert *tls.Certificate) *http.Client {
+		cfg := &tls.Config{RootCAs: pool}
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: cfg},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+	}
+	clients := map[string]*http.Client{"alice": client(&alice), "bob": client(&bob), "anonymous": client(nil)}
+
+	// All three connect from the same IP, but only the one without a
+	// certificate is known by it.
+	tests := []struct {
+		client string;
+		code int;
+		key string;
+	}{
+		{client: "alice", code: http.StatusTemporaryRedirect, key: "cert:aliceusers"},
+		{client: "alice", code: http.StatusTooManyRequests},
+		{client: "bob", code: http.StatusTemporaryRedirect, key: "cert:bobusers"},
+		{client: "anonymous", code: http.StatusTemporaryRedirect, key: "127.0.0.1users"},
+		{client: "anonymous", code: http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		resp, err := clients[tt.client].Get(srv.URL + "/users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("request %d from %v: got %d, want %d", i+1, tt.client, resp.StatusCode, tt.code)
+			continue
+		}
+		if tt.key == "" {
+			continue
+		}
+		want := fairplex.selectServer(saltedKey(fairplex.HashSalt, tt.key), nil).url.String() + "/users"
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("request %d from %v: sent to %v, want %v, as hashed by %q", i+1, tt.client, got, want, tt.key)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package fairplex
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The instrumentation name fairplex's tracer is created with.
+const tracerName = "github.com/eu90h/fairplex"
+
+// tracingMiddleware starts a span covering selection and proxying of a
+// data-plane request, continuing any trace the client sent along.
+func (fairplex *Fairplex) tracingMiddleware(c *gin.Context) {
+	ctx := propagation.TraceContext{}.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := fairplex.TracerProvider.Tracer(tracerName).Start(ctx, "fairplex "+c.Request.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("url.path", c.Request.URL.Path),
+		))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// traceSelection records the chosen server and how long choosing it took on
+// the request's span. It does nothing when tracing is off.
+func (fairplex *Fairplex) traceSelection(c *gin.Context, b *backend, took time.Duration) {
+	if fairplex.TracerProvider == nil {
+		return
+	}
+	span := trace.SpanFromContext(c.Request.Context())
+	if b != nil {
+		span.SetAttributes(attribute.String("fairplex.backend", b.url.String()))
+	}
+	span.SetAttributes(attribute.Float64("fairplex.selection_ms", float64(took)/float64(time.Millisecond)))
+}
+
+// injectTrace adds the trace context of `req` to its headers, so the server
+// it's forwarded to can continue the trace. It does nothing when tracing is off.
+func (fairplex *Fairplex) injectTrace(req *http.Request) {
+	if fairplex.TracerProvider == nil {
+		return
+	}
+	propagation.TraceContext{}.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
@@ -0,0 +1,95 @@
+package fairplex
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestUpdateServerWeight(t *testing.T) {
+	fairplex := &Fairplex{VirtualNodes: 100}
+	r := fairplex.SetupRouter()
+	a := register(t, fairplex, "http://10.0.0.1:8080")
+	register(t, fairplex, "http://10.0.0.2:8080")
+	keys := testKeys(4000)
+	owned := func() map[ringKey]bool {
+		owned := map[ringKey]bool{}
+		for _, key := range keys {
+			if fairplex.selectServer(key, nil) == a {
+				owned[key] = true
+			}
+		}
+		return owned
+	}
+	before := owned()
+
+	tests := []struct {
+		weight string;
+		code int;
+		nodes int;
+		share float64;
+	}{
+		{weight: "3", code: http.StatusOK, nodes: 300, share: 0.75},
+		{weight: "0", code: http.StatusBadRequest, nodes: 300, share: 0.75},
+		{weight: "1", code: http.StatusOK, nodes: 100, share: 0.5},
+	}
+	for _, tt := range tests {
+		w := serveForm(r, http.MethodPut, "/servers", url.Values{"addr": {a.url.String()}, "weight": {tt.weight}})
+		if w.Code != tt.code {
+			t.Fatalf("weight %v: got %d, want %d: %v", tt.weight, w.Code, tt.code, w.Body)
+		}
+		nodes := 0
+		for _, n := range fairplex.RingSnapshot() {
+			if n.Server == a.url.String() {
+				nodes++
+			}
+		}
+		after := owned()
+		share := float64(len(after)) / float64(len(keys))
+		if nodes != tt.nodes || math.Abs(share-tt.share) > 0.1 {
+			t.Errorf("weight %v: %d nodes and %.2f of keys, want %d and about %.2f", tt.weight, nodes, share, tt.nodes, tt.share)
+		}
+		// Gaining weight takes keys from the other server, but never loses any.
+		if tt.code == http.StatusOK && tt.share > 0.5 {
+			for key := range before {
+				if !after[key] {
+					t.Errorf("weight %v: server lost a key it had", tt.weight)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestUpdateServerTags(t *testing.T) {
+	fairplex := &Fairplex{}
+	r := fairplex.SetupRouter()
+	a := register(t, fairplex, "http://10.0.0.1:8080")
+	tagged := func(tag string) int {
+		var servers []url.URL
+		json.Unmarshal(serve(r, http.MethodGet, "/servers?tag="+tag, nil).Body.Bytes(), &servers)
+		return len(servers)
+	}
+
+	tests := []struct {
+		addr string;
+		tags []string;
+		code int;
+		canary int;
+	}{
+		{addr: a.url.String(), tags: []string{"canary, v2"}, code: http.StatusOK, canary: 1},
+		{addr: a.url.String(), tags: []string{""}, code: http.StatusOK, canary: 0},
+		{addr: "http://10.0.0.9:8080", tags: []string{"canary"}, code: http.StatusNotFound, canary: 0},
+	}
+	for _, tt := range tests {
+		w := serveForm(r, http.MethodPut, "/servers", url.Values{"addr": {tt.addr}, "tags": tt.tags})
+		if w.Code != tt.code {
+			t.Errorf("tagging %v with %q: got %d, want %d", tt.addr, tt.tags, w.Code, tt.code)
+		}
+		if got := tagged("canary"); got != tt.canary {
+			t.Errorf("after tagging %v with %q: %d canary servers, want %d", tt.addr, tt.tags, got, tt.canary)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package fairplex
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Validate checks the settings for values fairplex can't use and options
+// that conflict, returning every problem found joined into one error, or
+// nil if there are none. Run, RunTLS and RunTCP refuse to start unless it
+// passes, and SetupRouter panics; zero values are always valid.
+func (fairplex *Fairplex) Validate() error {
+	var errs []error
+	fail := func(format string, v ...any) {
+		errs = append(errs, fmt.Errorf(format, v...))
+	}
+
+	if fairplex.RequestsPerMinute < 0 {
+		fail("RequestsPerMinute is %v, it must not be negative", fairplex.RequestsPerMinute)
+	}
+	for class, rpm := range fairplex.ClassRequestsPerMinute {
+		if rpm < 0 {
+			fail("ClassRequestsPerMinute for %q is %v, it must not be negative", class, rpm)
+		}
+	}
+	for method, rpm := range fairplex.MethodRequestsPerMinute {
+		if rpm < 0 {
+			fail("MethodRequestsPerMinute for %v is %v, it must not be negative", method, rpm)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, pool := range []struct {
+		name string;
+		servers []*url.URL;
+	}{{"Servers", fairplex.Servers}, {"StandbyServers", fairplex.StandbyServers}} {
+		for _, u := range pool.servers {
+			if u == nil {
+				fail("%v holds a nil URL", pool.name)
+				continue
+			}
+			if err := checkServerURL(u); err != nil {
+				fail("server %v in %v: %v", u, pool.name, err)
+				continue
+			}
+			if seen[u.String()] {
+				fail("server %v is listed more than once", u)
+			}
+			seen[u.String()] = true
+		}
+	}
+	for _, server := range []struct {
+		name string;
+		u *url.URL;
+	}{{"FallbackBackend", fairplex.FallbackBackend}, {"ShadowBackend", fairplex.ShadowBackend}} {
+		if server.u == nil {
+			continue
+		}
+		if server.u.Scheme != "http" && server.u.Scheme != "https" {
+			fail("%v %v: scheme must be http or https", server.name, server.u)
+		} else if err := checkServerURL(server.u); err != nil {
+			fail("%v %v: %v", server.name, server.u, err)
+		}
+	}
+
+	for _, count := range []struct {
+		name string;
+		n int64;
+	}{
+		{"VirtualNodes", int64(fairplex.VirtualNodes)},
+		{"MaxFailoverAttempts", int64(fairplex.MaxFailoverAttempts)},
+		{"FailoverHysteresis", int64(fairplex.FailoverHysteresis)},
+		{"ReplicationFactor", int64(fairplex.ReplicationFactor)},
+		{"ReadFanOut", int64(fairplex.ReadFanOut)},
+		{"MaxResponseBytes", fairplex.MaxResponseBytes},
+		{"MaxBufferedBodyBytes", fairplex.MaxBufferedBodyBytes},
+		{"MaxPathLength", int64(fairplex.MaxPathLength)},
+		{"MaxHeaderBytes", int64(fairplex.MaxHeaderBytes)},
+	} {
+		if count.n < 0 {
+			fail("%v is %v, it must not be negative", count.name, count.n)
+		}
+	}
+	// ReadTimeout, WriteTimeout, IdleTimeout and ShutdownGracePeriod take
+	// negative values to mean no limit, so only these can't be negative.
+	for _, timeout := range []struct {
+		name string;
+		d time.Duration;
+	}{
+		{"HealthCheckInterval", fairplex.HealthCheckInterval},
+		{"HealthCheckMaxBackoff", fairplex.HealthCheckMaxBackoff},
+		{"SlowStartDuration", fairplex.SlowStartDuration},
+		{"DialTimeout", fairplex.DialTimeout},
+		{"RequestTimeout", fairplex.RequestTimeout},
+		{"StreamTimeout", fairplex.StreamTimeout},
+		{"StreamKeepAlive", fairplex.StreamKeepAlive},
+	} {
+		if timeout.d < 0 {
+			fail("%v is %v, it must not be negative", timeout.name, timeout.d)
+		}
+	}
+
+	switch strings.ToLower(fairplex.LogLevel) {
+	case "", "debug", "info", "error":
+	default:
+		fail("LogLevel %q must be debug, info or error", fairplex.LogLevel)
+	}
+	switch strings.ToLower(fairplex.AccessLog) {
+	case "", "all", "errors":
+	default:
+		fail("AccessLog %q must be all or errors", fairplex.AccessLog)
+	}
+	if !(fairplex.AccessLogSampleRate >= 0 && fairplex.AccessLogSampleRate <= 1) {
+		fail("AccessLogSampleRate is %v, it must be between 0 and 1", fairplex.AccessLogSampleRate)
+	}
+	if !(fairplex.ShadowPercent >= 0 && fairplex.ShadowPercent <= 100) {
+		fail("ShadowPercent is %v, it must be between 0 and 100", fairplex.ShadowPercent)
+	}
+	if fairplex.Strategy != StrategyConsistentHash && fairplex.Strategy != StrategyP2C {
+		fail("Strategy %d is unknown", int(fairplex.Strategy))
+	}
+	if fairplex.KeyHeaderFallback < KeyFallbackClient || fairplex.KeyHeaderFallback > KeyFallbackEmpty {
+		fail("KeyHeaderFallback %d is unknown", int(fairplex.KeyHeaderFallback))
+	}
+	if fairplex.NonIdempotentRetry < RetryNever || fairplex.NonIdempotentRetry > RetryAlways {
+		fail("NonIdempotentRetry %d is unknown", int(fairplex.NonIdempotentRetry))
+	}
+
+	if (fairplex.ClientCertFile == "") != (fairplex.ClientKeyFile == "") {
+		fail("ClientCertFile and ClientKeyFile must be set together")
+	} else if _, err := fairplex.clientTLSConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if fairplex.ClientCertIdentity && fairplex.ClientCAFile == "" {
+		fail("ClientCertIdentity needs a ClientCAFile to verify certificates with")
+	}
+	if fairplex.HealthCheckExpectBody != "" && strings.EqualFold(fairplex.HealthCheckMethod, "HEAD") {
+		fail("HealthCheckExpectBody is set, but HEAD health checks get no body to match")
+	}
+	if fairplex.ShadowPercent > 0 && fairplex.ShadowBackend == nil {
+		fail("ShadowPercent is set without a ShadowBackend")
+	}
+	if !fairplex.Proxy && fairplex.ReplicationFactor > 1 {
+		fail("ReplicationFactor only applies in proxy mode, but Proxy isn't set")
+	}
+	if !fairplex.Proxy && fairplex.ReadFanOut > 1 {
+		fail("ReadFanOut only applies in proxy mode, but Proxy isn't set")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,82 @@
+package fairplex
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	tests := []struct {
+		name string;
+		fairplex *Fairplex;
+		errs []string;
+	}{
+		{name: "zero value", fairplex: &Fairplex{}},
+		{name: "valid", fairplex: &Fairplex{
+			Proxy: true,
+			Servers: []*url.URL{mustParse("http://a:80")},
+			ReplicationFactor: 3,
+			HealthCheckMethod: "HEAD",
+			ShadowBackend: mustParse("http://shadow:80"),
+			ShadowPercent: 10,
+		}},
+		{name: "negative rate", fairplex: &Fairplex{RequestsPerMinute: -1}, errs: []string{"RequestsPerMinute is -1"}},
+		{name: "negative class rate", fairplex: &Fairplex{ClassRequestsPerMinute: map[string]float64{"free": -1}}, errs: []string{`ClassRequestsPerMinute for "free"`}},
+		{name: "negative counts", fairplex: &Fairplex{VirtualNodes: -1, MaxBufferedBodyBytes: -1}, errs: []string{"VirtualNodes is -1", "MaxBufferedBodyBytes is -1"}},
+		{name: "negative interval", fairplex: &Fairplex{HealthCheckInterval: -time.Second}, errs: []string{"HealthCheckInterval is -1s"}},
+		{name: "duplicate server", fairplex: &Fairplex{Servers: []*url.URL{mustParse("http://a:80")}, StandbyServers: []*url.URL{mustParse("http://a:80")}}, errs: []string{"listed more than once"}},
+		{name: "nil server", fairplex: &Fairplex{Servers: []*url.URL{nil}}, errs: []string{"Servers holds a nil URL"}},
+		{name: "tcp fallback", fairplex: &Fairplex{FallbackBackend: mustParse("tcp://a:80")}, errs: []string{"FallbackBackend tcp://a:80: scheme must be http or https"}},
+		{name: "log level", fairplex: &Fairplex{LogLevel: "loud"}, errs: []string{`LogLevel "loud"`}},
+		{name: "access log", fairplex: &Fairplex{AccessLog: "some"}, errs: []string{`AccessLog "some"`}},
+		{name: "sample rate", fairplex: &Fairplex{AccessLogSampleRate: 1.5}, errs: []string{"AccessLogSampleRate is 1.5"}},
+		{name: "strategy", fairplex: &Fairplex{Strategy: 9}, errs: []string{"Strategy 9 is unknown"}},
+		{name: "retry policy", fairplex: &Fairplex{NonIdempotentRetry: 9}, errs: []string{"NonIdempotentRetry 9 is unknown"}},
+		{name: "client cert without key", fairplex: &Fairplex{ClientCertFile: "cert.pem"}, errs: []string{"ClientCertFile and ClientKeyFile"}},
+		{name: "cert identity without ca", fairplex: &Fairplex{ClientCertIdentity: true}, errs: []string{"ClientCertIdentity needs a ClientCAFile"}},
+		{name: "shadow percent without backend", fairplex: &Fairplex{ShadowPercent: 5}, errs: []string{"ShadowPercent is set without a ShadowBackend"}},
+		{name: "replication without proxy", fairplex: &Fairplex{ReplicationFactor: 3}, errs: []string{"ReplicationFactor only applies in proxy mode"}},
+		{name: "expect body with head", fairplex: &Fairplex{HealthCheckMethod: "head", HealthCheckExpectBody: "ok"}, errs: []string{"HEAD health checks get no body"}},
+		{name: "several", fairplex: &Fairplex{RequestsPerMinute: -1, LogLevel: "loud"}, errs: []string{"RequestsPerMinute", "LogLevel"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fairplex.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate passed, want errors about %v", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate: %v\nwant it to mention %q", err, want)
+				}
+			}
+			if n := len(strings.Split(err.Error(), "\n")); n != len(tt.errs) {
+				t.Errorf("Validate gave %d errors, want %d: %v", n, len(tt.errs), err)
+			}
+		})
+	}
+}
+
+func TestSetupRouterPanicsOnInvalidSettings(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("SetupRouter didn't panic")
+		}
+	}()
+	(&Fairplex{RequestsPerMinute: -1}).SetupRouter()
+}
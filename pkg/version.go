@@ -0,0 +1,21 @@
+package fairplex
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X github.com/eu90h/fairplex/pkg.Version=v1.2.3 -X github.com/eu90h/fairplex/pkg.Commit=$(git rev-parse HEAD)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// versionHandler serves GET /version.
+func versionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": Version, "commit": Commit, "build_time": BuildTime})
+}
@@ -0,0 +1,57 @@
+package fairplex
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestZonePreference(t *testing.T) {
+	tests := []struct {
+		strategy Strategy;
+	}{
+		{strategy: StrategyConsistentHash},
+		{strategy: StrategyP2C},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy.String(), func(t *testing.T) {
+			fairplex := &Fairplex{Zone: "us-east-1a", Strategy: tt.strategy}
+			r := fairplex.SetupRouter()
+			zones := map[string]string{}
+			var local []*backend
+			for i, zone := range []string{"us-east-1a", "us-east-1a", "us-east-1b", "us-east-1b"} {
+				srv := newTestBackend(t, fmt.Sprint(i))
+				postServer(t, r, url.Values{"addr": {srv.URL}, "zone": {zone}})
+				zones[srv.URL] = zone
+				if zone == fairplex.Zone {
+					fairplex.mu.Lock()
+					local = append(local, fairplex.backends[srv.URL])
+					fairplex.mu.Unlock()
+				}
+			}
+			routed := func() map[string]int {
+				counts := map[string]int{}
+				for i := 0; i < 200; i++ {
+					w := serve(r, http.MethodGet, fmt.Sprintf("/item%d", i), nil)
+					location, _, _ := strings.Cut(w.Header().Get("Location"), "/item")
+					counts[zones[location]]++
+				}
+				return counts
+			}
+
+			if counts := routed(); counts["us-east-1a"] != 200 {
+				t.Errorf("with local servers up, requests went to %v, want all to us-east-1a", counts)
+			}
+			local[0].healthy.Store(false)
+			if counts := routed(); counts["us-east-1a"] != 200 {
+				t.Errorf("with one local server up, requests went to %v, want all to us-east-1a", counts)
+			}
+			local[1].healthy.Store(false)
+			if counts := routed(); counts["us-east-1b"] != 200 {
+				t.Errorf("with no local server up, requests went to %v, want all to us-east-1b", counts)
+			}
+		})
+	}
+}